@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// auditTally counts the messages seen by an audit by the attributes the
+// worker acts on.
+type auditTally struct {
+	messages int
+	// duplicates counts redeliveries of messages already counted.
+	duplicates int
+	// types counts the type attribute; plain jobs are "job" and the DONE
+	// sentinel "done".
+	types map[string]int
+	// numJobs counts the raw numJobs attribute values, "(none)" if missing.
+	numJobs map[string]int
+	// expired counts messages whose expiresAt has passed, which the workers
+	// will drop.
+	expired int
+	oldest  time.Time
+	seen    map[string]bool
+}
+
+func newAuditTally() *auditTally {
+	return &auditTally{types: map[string]int{}, numJobs: map[string]int{}, seen: map[string]bool{}}
+}
+
+// add counts msg as of now.
+func (t *auditTally) add(msg *pubsub.Message, now time.Time) {
+	if t.seen[msg.ID] {
+		t.duplicates++
+		return
+	}
+	t.seen[msg.ID] = true
+	t.messages++
+
+	typ := msg.Attributes["type"]
+	switch {
+	case string(msg.Data) == "DONE":
+		typ = "done"
+	case typ == "":
+		typ = "job"
+	}
+	t.types[typ]++
+
+	numJobs, ok := msg.Attributes["numJobs"]
+	if !ok {
+		numJobs = "(none)"
+	}
+	t.numJobs[numJobs]++
+
+	if expiresAt, err := time.Parse(time.RFC3339, msg.Attributes["expiresAt"]); err == nil && now.After(expiresAt) {
+		t.expired++
+	}
+	if !msg.PublishTime.IsZero() && (t.oldest.IsZero() || msg.PublishTime.Before(t.oldest)) {
+		t.oldest = msg.PublishTime
+	}
+}
+
+// runAudit pulls every message currently in subID and tallies it without
+// acking anything. Messages are held until no new one has arrived for idle,
+// so none is counted twice, then all are nacked for the workers to process.
+// While the audit runs, the workers can't receive the held messages.
+//
+// Every audited message uses up a delivery attempt, so with a dead-letter
+// policy an audit can push messages to the dead-letter topic. runAudit
+// refuses such subscriptions unless force is set.
+func runAudit(ctx context.Context, client *pubsub.Client, subID string, idle time.Duration, force bool) (*auditTally, error) {
+	sub := client.Subscription(subID)
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get subscription: %v", err)
+	}
+	if p := cfg.DeadLetterPolicy; p != nil {
+		if !force {
+			return nil, fmt.Errorf("subscription %s has a dead-letter policy (max %d delivery attempts) and each audit uses one attempt per message; rerun with -audit-force to audit anyway", subID, p.MaxDeliveryAttempts)
+		}
+		slog.Warn("Auditing a subscription with a dead-letter policy; each message uses up a delivery attempt.", "maxDeliveryAttempts", p.MaxDeliveryAttempts)
+	}
+	slog.Info("Auditing the subscription; messages are nacked, not consumed.", "subscription", subID)
+	// Hold everything at once: flow control would stall the pull and end
+	// the audit early.
+	sub.ReceiveSettings.MaxOutstandingMessages = -1
+	sub.ReceiveSettings.MaxOutstandingBytes = -1
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	tally := newAuditTally()
+	last := time.Now()
+
+	// The queue counts as drained once no new message arrived for idle.
+	go func() {
+		ticker := time.NewTicker(idle / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mu.Lock()
+				drained := time.Since(last) >= idle
+				mu.Unlock()
+				if drained {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err = sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		tally.add(msg, time.Now())
+		last = time.Now()
+		mu.Unlock()
+		// Receive returns only once every callback has, so the nacks are
+		// sent before the audit ends.
+		<-ctx.Done()
+		msg.Nack()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Receive: %v", err)
+	}
+	return tally, nil
+}
+
+// writeAudit prints the tally as tables of counts by type and by numJobs.
+func writeAudit(w io.Writer, t *auditTally, now time.Time) error {
+	fmt.Fprintf(w, "Messages: %d", t.messages)
+	if !t.oldest.IsZero() {
+		fmt.Fprintf(w, " (oldest published %s ago)", now.Sub(t.oldest).Round(time.Second))
+	}
+	fmt.Fprintln(w)
+	if t.expired > 0 {
+		fmt.Fprintf(w, "Expired: %d (the workers will drop them)\n", t.expired)
+	}
+	if t.duplicates > 0 {
+		fmt.Fprintf(w, "Redelivered during the audit: %d (not counted)\n", t.duplicates)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nTYPE\tCOUNT")
+	for _, k := range sortedAuditKeys(t.types) {
+		fmt.Fprintf(tw, "%s\t%d\n", k, t.types[k])
+	}
+	fmt.Fprintln(tw, "\nNUMJOBS\tCOUNT")
+	for _, k := range sortedAuditKeys(t.numJobs) {
+		fmt.Fprintf(tw, "%s\t%d\n", k, t.numJobs[k])
+	}
+	return tw.Flush()
+}
+
+// sortedAuditKeys returns the keys of counts, numbers first in numeric order,
+// then the rest alphabetically.
+func sortedAuditKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.ParseFloat(keys[i], 64)
+		b, errB := strconv.ParseFloat(keys[j], 64)
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil || errB == nil:
+			return errA == nil
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
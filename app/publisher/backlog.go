@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// backlogMetric is the Cloud Monitoring metric holding a subscription's
+// number of unacknowledged messages.
+const backlogMetric = "pubsub.googleapis.com/subscription/num_undelivered_messages"
+
+// getBacklog returns the subscription's backlog as reported by Cloud
+// Monitoring. The metric is sampled once a minute, so it lags the real
+// backlog by a minute or two.
+func getBacklog(ctx context.Context, projectID, subID string) (int64, error) {
+	backlog, _, err := readBacklog(ctx, projectID, subID)
+	return backlog, err
+}
+
+// readBacklog returns the subscription's newest backlog sample from Cloud
+// Monitoring and the end of the interval it covers. With no samples yet
+// (e.g. a brand new subscription) the backlog is 0 and the time is zero.
+func readBacklog(ctx context.Context, projectID, subID string) (int64, time.Time, error) {
+	svc, err := monitoring.NewService(ctx)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("monitoring.NewService: %v", err)
+	}
+
+	now := time.Now()
+	resp, err := svc.Projects.TimeSeries.List("projects/" + projectID).
+		Filter(fmt.Sprintf(`metric.type="%s" AND resource.labels.subscription_id="%s"`, backlogMetric, subID)).
+		IntervalStartTime(now.Add(-5 * time.Minute).Format(time.RFC3339)).
+		IntervalEndTime(now.Format(time.RFC3339)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("TimeSeries.List: %v", err)
+	}
+	if len(resp.TimeSeries) == 0 || len(resp.TimeSeries[0].Points) == 0 {
+		return 0, time.Time{}, nil
+	}
+
+	// Points are returned newest first.
+	point := resp.TimeSeries[0].Points[0]
+	var at time.Time
+	if point.Interval != nil {
+		at, _ = time.Parse(time.RFC3339, point.Interval.EndTime)
+	}
+	if point.Value == nil || point.Value.Int64Value == nil {
+		return 0, at, nil
+	}
+	return *point.Value.Int64Value, at, nil
+}
+
+// logBacklog logs the current backlog, or a warning if it can't be read.
+func logBacklog(ctx context.Context, projectID, subID, when string) {
+	backlog, err := getBacklog(ctx, projectID, subID)
+	if err != nil {
+		slog.Warn("Could not read backlog", "when", when, "err", err)
+		return
+	}
+	slog.Info("Backlog (Cloud Monitoring, may lag ~1-2 min)", "when", when, "messages", backlog)
+}
+
+// backlogReader reads a backlog sample and the time it was taken, like
+// readBacklog.
+type backlogReader func(ctx context.Context) (int64, time.Time, error)
+
+// waitBacklogSince polls read every interval until it returns a sample
+// taken after since, and returns that sample. If none arrives within
+// timeout, it returns the last sample read with fresh set to false.
+func waitBacklogSince(ctx context.Context, read backlogReader, since time.Time, timeout, interval time.Duration) (backlog int64, fresh bool, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		backlog, at, err := read(ctx)
+		if err != nil {
+			return 0, false, err
+		}
+		if at.After(since) {
+			return backlog, true, nil
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return backlog, false, nil
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return backlog, false, err
+		}
+	}
+}
+
+// Bounds for waiting on a backlog sample taken after the purge in cycle.
+// Cloud Monitoring samples once a minute and takes a minute or two to show
+// a sample.
+const (
+	backlogSettleTimeout  = 4 * time.Minute
+	backlogSettleInterval = 20 * time.Second
+)
+
+// logBacklogSince waits for a backlog sample taken after since and logs
+// it. If none arrives in time, the last one is logged as stale.
+func logBacklogSince(ctx context.Context, projectID, subID, when string, since time.Time) {
+	slog.Info("Waiting for Cloud Monitoring to sample the backlog...", "when", when, "timeout", backlogSettleTimeout)
+	read := func(ctx context.Context) (int64, time.Time, error) { return readBacklog(ctx, projectID, subID) }
+	backlog, fresh, err := waitBacklogSince(ctx, read, since, backlogSettleTimeout, backlogSettleInterval)
+	switch {
+	case err != nil:
+		slog.Warn("Could not read backlog", "when", when, "err", err)
+	case fresh:
+		slog.Info("Backlog (Cloud Monitoring)", "when", when, "messages", backlog)
+	default:
+		slog.Warn("Backlog (Cloud Monitoring, stale: no sample since then yet)", "when", when, "messages", backlog)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// benchSettings configures the bench command.
+type benchSettings struct {
+	messages    int
+	concurrency int
+	batchSize   int
+	purge       bool
+}
+
+// runBench publishes tiny messages as fast as possible and reports the
+// achieved throughput and publish latency percentiles. It shows the publish
+// ceiling before designing a load test. Bench messages carry type=bench, so
+// workers ack them without doing any work.
+func runBench(ctx context.Context, client *pubsub.Client, topicID, subID string, cfg benchSettings) (*runReport, error) {
+	slog.Info("Starting 'bench' mode...", "messages", cfg.messages, "concurrency", cfg.concurrency, "batchSize", cfg.batchSize)
+	topic := getOrCreateTopic(ctx, client, topicID)
+	topic.PublishSettings.CountThreshold = cfg.batchSize
+	topic.PublishSettings.NumGoroutines = cfg.concurrency
+	defer topic.Stop()
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, cfg.messages)
+		failures  int
+		wg        sync.WaitGroup
+	)
+	report := &runReport{Command: "bench", Topic: topicID, StartedAt: time.Now().UTC()}
+
+	record := func(res *pubsub.PublishResult, start time.Time) {
+		_, err := res.Get(ctx)
+		elapsed := time.Since(start)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failures++
+			return
+		}
+		latencies = append(latencies, elapsed)
+	}
+
+	// Split the messages across the publishing goroutines.
+	for g := 0; g < cfg.concurrency; g++ {
+		n := cfg.messages / cfg.concurrency
+		if g < cfg.messages%cfg.concurrency {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var pending sync.WaitGroup
+			for i := 0; i < n; i++ {
+				start := time.Now()
+				res := topic.Publish(ctx, &pubsub.Message{
+					Data:       []byte("bench"),
+					Attributes: map[string]string{"type": "bench"},
+				})
+				pending.Add(1)
+				go func() {
+					defer pending.Done()
+					record(res, start)
+				}()
+			}
+			pending.Wait()
+		}(n)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(report.StartedAt)
+	report.DurationSec = elapsed.Seconds()
+	report.Messages = len(latencies)
+	report.Failures = failures
+	report.MessagesPerSec = float64(len(latencies)) / elapsed.Seconds()
+	report.LatencyMs = computeLatencyStats(latencies)
+
+	slog.Info("Bench finished.",
+		"published", report.Messages,
+		"failed", report.Failures,
+		"messagesPerSec", fmt.Sprintf("%.1f", report.MessagesPerSec),
+		"p50ms", report.LatencyMs.P50,
+		"p90ms", report.LatencyMs.P90,
+		"p99ms", report.LatencyMs.P99)
+
+	// Don't leave thousands of bench messages in the backlog.
+	if cfg.purge {
+		if err := purgeQueue(ctx, client, subID); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
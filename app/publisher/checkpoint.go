@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint records how far a publish batch got, so an interrupted run can
+// be resumed with -resume instead of republishing everything.
+type checkpoint struct {
+	Topic        string `json:"topic"`
+	NumJobs      int    `json:"numJobs"`
+	WorkDuration int    `json:"workDuration"`
+	// Published is the number of messages, counting from the first, that
+	// are known to have been published successfully.
+	Published int `json:"published"`
+}
+
+// loadCheckpoint reads a checkpoint written by save.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint: %v", err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parse checkpoint %s: %v", path, err)
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint atomically: it writes a temporary file in the
+// same directory and renames it over path, so a crash mid-write never
+// leaves a truncated checkpoint behind.
+func (c *checkpoint) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write checkpoint: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close checkpoint: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// volatileAttrs are attributes set fresh for every message, so they are left
+// out of the content hash.
+var volatileAttrs = map[string]bool{requestIDAttr: true, "expiresAt": true}
+
+// volatileDataFields are the fields of a JSON body that differ between
+// otherwise identical jobs: id is the message's sequence number in its batch.
+var volatileDataFields = []string{"id"}
+
+// contentSet remembers the content of the messages published during a run,
+// so -dedupe can skip repeats.
+type contentSet struct {
+	mu     sync.Mutex
+	hashes map[[sha256.Size]byte]struct{}
+}
+
+// add records msg's content and reports whether it was new.
+func (s *contentSet) add(msg *pubsub.Message) bool {
+	h := contentHash(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hashes == nil {
+		s.hashes = map[[sha256.Size]byte]struct{}{}
+	}
+	if _, ok := s.hashes[h]; ok {
+		return false
+	}
+	s.hashes[h] = struct{}{}
+	return true
+}
+
+// contentHash hashes a message's data, ordering key and attributes, except
+// the volatile ones. Each part is length-prefixed so different splits of the
+// same bytes hash differently.
+func contentHash(msg *pubsub.Message) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(s string) {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(s)))
+		h.Write(n[:])
+		h.Write([]byte(s))
+	}
+	write(string(stableData(msg.Data)))
+	write(msg.OrderingKey)
+	keys := make([]string, 0, len(msg.Attributes))
+	for k := range msg.Attributes {
+		if !volatileAttrs[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		write(k)
+		write(msg.Attributes[k])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// stableData returns data without its volatile fields if it is a JSON
+// object, and data unchanged otherwise. The fields are re-encoded in key
+// order, so the result doesn't depend on their order in data.
+func stableData(data []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return data
+	}
+	for _, f := range volatileDataFields {
+		delete(fields, f)
+	}
+	stable, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return stable
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// reportFieldOrder lists the report fields diff compares first, with
+// whether a higher value is better. Numeric fields not listed here (from
+// newer report versions, say) are compared after them, without a verdict.
+var reportFieldOrder = []struct {
+	field        string
+	higherBetter bool
+}{
+	{"messagesPerSec", true},
+	{"messages", true},
+	{"failures", false},
+	{"durationSec", false},
+	{"latencyMs.p50", false},
+	{"latencyMs.p90", false},
+	{"latencyMs.p99", false},
+	{"latencyMs.mean", false},
+	{"latencyMs.max", false},
+}
+
+// reportDiff is how one report field changed. Old or New is nil when the
+// field is missing from that report.
+type reportDiff struct {
+	Field     string   `json:"field"`
+	Old       *float64 `json:"old"`
+	New       *float64 `json:"new"`
+	Delta     *float64 `json:"delta,omitempty"`
+	ChangePct *float64 `json:"changePct,omitempty"`
+	// Verdict is "better", "worse" or "same", or empty when the field has no
+	// preferred direction or is missing from a report.
+	Verdict string `json:"verdict,omitempty"`
+}
+
+// loadReportFields reads a -report file as a flat map of its numeric fields,
+// with nested fields named like latencyMs.p50. Reading it generically
+// rather than into runReport lets reports from different versions be
+// compared.
+func loadReportFields(path string) (map[string]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read report: %v", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse report %s: %v", path, err)
+	}
+	fields := map[string]float64{}
+	flattenNumbers("", raw, fields)
+	return fields, nil
+}
+
+func flattenNumbers(prefix string, v map[string]any, out map[string]float64) {
+	for k, value := range v {
+		switch value := value.(type) {
+		case float64:
+			out[prefix+k] = value
+		case map[string]any:
+			flattenNumbers(prefix+k+".", value, out)
+		}
+	}
+}
+
+// diffReports compares the numeric fields of two reports: the well-known
+// fields first, then any others either report has, sorted by name.
+func diffReports(oldFields, newFields map[string]float64) []reportDiff {
+	var diffs []reportDiff
+	known := map[string]bool{}
+	for _, f := range reportFieldOrder {
+		known[f.field] = true
+		if d, ok := diffField(f.field, oldFields, newFields); ok {
+			d.Verdict = verdict(d, f.higherBetter)
+			diffs = append(diffs, d)
+		}
+	}
+	var others []string
+	seen := map[string]bool{}
+	for _, fields := range []map[string]float64{oldFields, newFields} {
+		for k := range fields {
+			if !known[k] && !seen[k] {
+				seen[k] = true
+				others = append(others, k)
+			}
+		}
+	}
+	sort.Strings(others)
+	for _, k := range others {
+		d, _ := diffField(k, oldFields, newFields)
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// diffField compares field in both reports. It reports false if neither has
+// it.
+func diffField(field string, oldFields, newFields map[string]float64) (reportDiff, bool) {
+	d := reportDiff{Field: field}
+	if v, ok := oldFields[field]; ok {
+		d.Old = &v
+	}
+	if v, ok := newFields[field]; ok {
+		d.New = &v
+	}
+	if d.Old == nil && d.New == nil {
+		return d, false
+	}
+	if d.Old != nil && d.New != nil {
+		delta := *d.New - *d.Old
+		d.Delta = &delta
+		if *d.Old != 0 {
+			pct := 100 * delta / *d.Old
+			d.ChangePct = &pct
+		}
+	}
+	return d, true
+}
+
+func verdict(d reportDiff, higherBetter bool) string {
+	switch {
+	case d.Delta == nil:
+		return ""
+	case *d.Delta == 0:
+		return "same"
+	case (*d.Delta > 0) == higherBetter:
+		return "better"
+	default:
+		return "worse"
+	}
+}
+
+// writeDiff prints the diffs as a table, or as JSON with format "json".
+func writeDiff(w io.Writer, format string, diffs []reportDiff) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tOLD\tNEW\tCHANGE\t")
+	for _, d := range diffs {
+		change := "missing"
+		if d.Delta != nil {
+			change = fmt.Sprintf("%+g", *d.Delta)
+			if d.ChangePct != nil {
+				change += fmt.Sprintf(" (%+.1f%%)", *d.ChangePct)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Field, formatOptional(d.Old), formatOptional(d.New), change, d.Verdict)
+	}
+	return tw.Flush()
+}
+
+func formatOptional(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%g", *v)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// durationWeight is one entry of -durations: jobs of Seconds, picked with
+// the given relative weight.
+type durationWeight struct {
+	Seconds int
+	Weight  int
+}
+
+// durationMix collects -durations, e.g. "30=70,300=30" for 70% 30s jobs and
+// 30% 300s jobs.
+type durationMix []durationWeight
+
+func (m *durationMix) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, d := range *m {
+		parts = append(parts, fmt.Sprintf("%d=%d", d.Seconds, d.Weight))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *durationMix) Set(value string) error {
+	var mix durationMix
+	for _, part := range strings.Split(value, ",") {
+		sec, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return fmt.Errorf("expected seconds=weight, got %q", part)
+		}
+		s, err := strconv.Atoi(sec)
+		if err != nil || s < 0 {
+			return fmt.Errorf("invalid duration %q", sec)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w <= 0 {
+			return fmt.Errorf("invalid weight %q", weight)
+		}
+		for _, d := range mix {
+			if d.Seconds == s {
+				return fmt.Errorf("duration %d listed twice", s)
+			}
+		}
+		mix = append(mix, durationWeight{Seconds: s, Weight: w})
+	}
+	*m = mix
+	return nil
+}
+
+// durationPicker hands out durations in smooth weighted round-robin order,
+// so every stretch of the batch has close to the configured proportions
+// rather than clumping like random picks can.
+type durationPicker struct {
+	mix     durationMix
+	current []int
+	total   int
+}
+
+func newDurationPicker(mix durationMix) *durationPicker {
+	p := &durationPicker{mix: mix, current: make([]int, len(mix))}
+	for _, d := range mix {
+		p.total += d.Weight
+	}
+	return p
+}
+
+// next returns the duration in seconds of the next job.
+func (p *durationPicker) next() int {
+	best := 0
+	for i, d := range p.mix {
+		p.current[i] += d.Weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.mix[best].Seconds
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// fleetConfig says where and what runFleet queries.
+type fleetConfig struct {
+	// APIServer is the Kubernetes API base URL, by default kubectl proxy's
+	// http://localhost:8001, which takes care of authentication.
+	APIServer  string
+	Namespace  string
+	MetricName string
+	// Selector optionally restricts the pods, e.g. app=worker.
+	Selector string
+	// Target is the HPA's averageValue target, used to show the replica
+	// count it would ask for.
+	Target   float64
+	Interval time.Duration
+}
+
+// metricValueList is the part of a custom.metrics.k8s.io MetricValueList
+// that runFleet reads.
+type metricValueList struct {
+	Items []struct {
+		DescribedObject struct {
+			Name string `json:"name"`
+		} `json:"describedObject"`
+		Timestamp time.Time `json:"timestamp"`
+		Value     string    `json:"value"`
+	} `json:"items"`
+}
+
+// podMetric is one pod's value of the metric.
+type podMetric struct {
+	Pod       string
+	Value     float64
+	Timestamp time.Time
+}
+
+// runFleet prints the metric as the HPA sees it through the Custom Metrics
+// API, every cfg.Interval until ctx is cancelled (once if it is 0). Comparing
+// it with what the workers export shows whether a scaling problem lies in the
+// workers or in the adapter between them and the HPA.
+func runFleet(ctx context.Context, w io.Writer, cfg fleetConfig) error {
+	for {
+		pods, err := getFleetMetric(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		writeFleet(w, cfg, pods, time.Now())
+		if cfg.Interval <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+// getFleetMetric reads the metric for every pod in the namespace.
+func getFleetMetric(ctx context.Context, cfg fleetConfig) ([]podMetric, error) {
+	u := fmt.Sprintf("%s/apis/custom.metrics.k8s.io/v1beta1/namespaces/%s/pods/*/%s",
+		strings.TrimSuffix(cfg.APIServer, "/"), url.PathEscape(cfg.Namespace), url.PathEscape(cfg.MetricName))
+	if cfg.Selector != "" {
+		u += "?labelSelector=" + url.QueryEscape(cfg.Selector)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("custom metrics request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("custom metrics request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("custom metrics API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var list metricValueList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("decoding custom metrics response: %v", err)
+	}
+	pods := make([]podMetric, 0, len(list.Items))
+	for _, item := range list.Items {
+		value, err := parseQuantity(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("pod %s: %v", item.DescribedObject.Name, err)
+		}
+		pods = append(pods, podMetric{Pod: item.DescribedObject.Name, Value: value, Timestamp: item.Timestamp})
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Pod < pods[j].Pod })
+	return pods, nil
+}
+
+// writeFleet prints one table of per-pod values followed by the aggregate.
+// For a Pods metric with an AverageValue target, the HPA compares the
+// average with the target and asks for ceil(sum / target) replicas.
+func writeFleet(w io.Writer, cfg fleetConfig, pods []podMetric, now time.Time) {
+	fmt.Fprintf(w, "%s  %s in %s\n", now.Format(time.TimeOnly), cfg.MetricName, cfg.Namespace)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "POD\tVALUE\tAGE")
+	sum := 0.0
+	for _, p := range pods {
+		sum += p.Value
+		fmt.Fprintf(tw, "%s\t%g\t%s\n", p.Pod, p.Value, now.Sub(p.Timestamp).Round(time.Second))
+	}
+	tw.Flush()
+	if len(pods) == 0 {
+		fmt.Fprintln(w, "no pods report the metric")
+		return
+	}
+	avg := sum / float64(len(pods))
+	fmt.Fprintf(w, "pods=%d sum=%g average=%g", len(pods), sum, avg)
+	if cfg.Target > 0 {
+		fmt.Fprintf(w, " target=%g desiredReplicas=%d", cfg.Target, int(math.Ceil(sum/cfg.Target)))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w)
+}
+
+// quantitySuffixes are the Kubernetes quantity suffixes and their factors.
+var quantitySuffixes = map[string]float64{
+	"n": 1e-9, "u": 1e-6, "m": 1e-3,
+	"k": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15, "E": 1e18,
+	"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40, "Pi": 1 << 50, "Ei": 1 << 60,
+}
+
+// parseQuantity parses a Kubernetes quantity such as "1500m" or "2k", the
+// format the Custom Metrics API reports values in.
+func parseQuantity(s string) (float64, error) {
+	// No suffix ends with another, so at most one matches.
+	number, factor := s, 1.0
+	for suffix, f := range quantitySuffixes {
+		if strings.HasSuffix(s, suffix) {
+			number, factor = strings.TrimSuffix(s, suffix), f
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return v * factor, nil
+}
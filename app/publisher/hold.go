@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// runHold keeps the subscription's backlog near depth for holdFor: it fills
+// the queue, then every interval tops it up with as many jobs as the workers
+// drained. Every job reports depth as numJobs, so the metric stays level.
+//
+// The backlog comes from Cloud Monitoring, which lags a minute or two, so an
+// interval shorter than that tops up the same drain twice and overshoots.
+func runHold(ctx context.Context, client *pubsub.Client, projectID, topicID, subID string, depth, workDuration int, holdFor, interval time.Duration) error {
+	slog.Info("Holding backlog depth.", "depth", depth, "for", holdFor, "interval", interval)
+	ctx, cancel := context.WithTimeout(ctx, holdFor)
+	defer cancel()
+
+	if _, _, err := publishJobs(ctx, client, topicID, depth, depth, workDuration, nil); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	topUps := 0
+	for {
+		select {
+		case <-ctx.Done():
+			// Running out of time is the normal way to stop, as is Ctrl-C.
+			slog.Info("Hold finished.", "topUps", topUps)
+			return nil
+		case <-ticker.C:
+		}
+
+		backlog, err := getBacklog(ctx, projectID, subID)
+		if err != nil {
+			slog.Warn("Could not read backlog, skipping top-up", "err", err)
+			continue
+		}
+		deficit := depth - int(backlog)
+		slog.Info("Backlog (Cloud Monitoring, may lag ~1-2 min)", "messages", backlog, "depth", depth)
+		if deficit <= 0 {
+			continue
+		}
+		if _, _, err := publishJobs(ctx, client, topicID, deficit, depth, workDuration, nil); err != nil {
+			return err
+		}
+		topUps++
+	}
+}
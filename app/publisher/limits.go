@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// maxPubSubMessageBytes is Pub/Sub's hard limit on a single message.
+const maxPubSubMessageBytes = 10 * 1000 * 1000
+
+// Pub/Sub's limits on message attributes.
+const (
+	maxAttributes          = 100
+	maxAttributeKeyBytes   = 256
+	maxAttributeValueBytes = 1024
+)
+
+// checkAttributes rejects attribute maps Pub/Sub would refuse, naming the
+// offending key instead of failing with a generic API error.
+func checkAttributes(attrs map[string]string) error {
+	if len(attrs) > maxAttributes {
+		return fmt.Errorf("message has %d attributes, over the limit of %d", len(attrs), maxAttributes)
+	}
+	// Sort the keys so the error is the same on every run.
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(k) > maxAttributeKeyBytes {
+			return fmt.Errorf("attribute key %.32q... is %d bytes, over the %d byte limit", k, len(k), maxAttributeKeyBytes)
+		}
+		if len(attrs[k]) > maxAttributeValueBytes {
+			return fmt.Errorf("attribute %q value is %d bytes, over the %d byte limit", k, len(attrs[k]), maxAttributeValueBytes)
+		}
+	}
+	return nil
+}
+
+// messageSize approximates how Pub/Sub counts a message against its size
+// limit: the data, every attribute key and value, and the ordering key.
+func messageSize(msg *pubsub.Message) int {
+	size := len(msg.Data) + len(msg.OrderingKey)
+	for k, v := range msg.Attributes {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// checkMessageSize rejects messages larger than limit bytes up front, with a
+// clearer error than the one the API would return.
+func checkMessageSize(msg *pubsub.Message, limit int) error {
+	if size := messageSize(msg); size > limit {
+		return fmt.Errorf("message is %d bytes, over the %d byte limit", size, limit)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs a text slog handler as the default logger, honoring
+// LOG_LEVEL (debug, info, warn or error) and LOG_CONTEXT. Per-message logs
+// are at debug level.
+func setupLogging() {
+	level := slog.LevelInfo
+	if value, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			fatal("Invalid LOG_LEVEL", "err", err)
+		}
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	// LOG_CONTEXT tags every line, e.g. with the deployment or experiment,
+	// for filtering aggregated logs.
+	attrs, err := parseLogContext(os.Getenv("LOG_CONTEXT"))
+	if err != nil {
+		slog.SetDefault(logger)
+		fatal("Invalid LOG_CONTEXT", "err", err)
+	}
+	slog.SetDefault(logger.With(attrs...))
+}
+
+// parseLogContext parses LOG_CONTEXT, a comma-separated list of key=value
+// pairs such as "deployment=canary,experiment=42", into slog attributes.
+func parseLogContext(value string) ([]any, error) {
+	var attrs []any
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		if seen[k] {
+			return nil, fmt.Errorf("duplicate key %q", k)
+		}
+		seen[k] = true
+		attrs = append(attrs, slog.String(k, strings.TrimSpace(v)))
+	}
+	return attrs, nil
+}
+
+// fatal logs msg at error level, which LOG_LEVEL never filters, and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -3,207 +3,867 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 )
 
+// Command-line flags. They must be given before the command, e.g.
+// go run . -keepalive-interval 30s keepalive <project_id> <topic_id> <subscription_id>
+var (
+	keepaliveInterval = flag.Duration("keepalive-interval", 30*time.Second, "Interval between keepalive messages")
+	keepaliveValue    = flag.Int("keepalive-value", 1, "numJobs value reported by each keepalive message")
+	metricsAddr       = flag.String("metrics-addr", "", "If set, serve Prometheus metrics on this address (e.g. :9090)")
+	cycleWait         = flag.Duration("cycle-wait", time.Minute, "Time to wait between publishing and purging (cycle command)")
+	maxMessageBytes   = flag.Int("max-message-bytes", maxPubSubMessageBytes, "Reject messages larger than this many bytes (at most 10MB)")
+	messageTTL        = flag.Duration("ttl", 0, "If set, workers skip messages still queued this long after publishing (e.g. 5m)")
+	checkpointFile    = flag.String("checkpoint", "", "Record publish progress in this file (publish command)")
+	resume            = flag.Bool("resume", false, "Continue the batch recorded in -checkpoint instead of starting over")
+	shuffle           = flag.Bool("shuffle", false, "Publish each batch's messages in random order, durations included, instead of in sequence (publish, cycle, auto and hold commands)")
+	seedFlag          = flag.Int64("seed", 0, "Seed for random choices such as -shuffle, to repeat a run; 0 picks one and logs it")
+	autoCreate        = flag.Bool("auto-create", true, "Create the topic if it doesn't exist (otherwise a missing topic is an error)")
+	orderingKeys      = flag.Int("ordering-keys", 0, "If set, publish jobs in order, round-robin across this many ordering keys key-0..key-N-1")
+	benchMessages     = flag.Int("bench-messages", 10000, "Number of messages to publish (bench command)")
+	benchConcurrency  = flag.Int("bench-concurrency", 4, "Number of concurrent publishers (bench command)")
+	benchBatchSize    = flag.Int("bench-batch-size", 100, "Messages per publish request (bench command)")
+	benchPurge        = flag.Bool("bench-purge", false, "Purge the subscription after the benchmark (bench command)")
+	scenarioFile      = flag.String("scenario", "", "Run the scenario steps in this JSON file instead of the built-in one (auto command)")
+	timeline          = flag.Bool("timeline", false, "Print the scenario as a timeline before running it (auto and replay commands)")
+	finalize          = flag.String("finalize", finalizeDone, "How auto and replay end the run: done sends the DONE message, purge empties the subscription so every worker goes stale")
+	mirrorScale       = flag.Float64("mirror-scale", 1, "Multiply numJobs by this factor when mirroring (mirror command)")
+	manifestFormat    = flag.String("manifest-format", "hpa", "Manifest to generate: hpa or keda (manifest command)")
+	manifestMetric    = flag.String("manifest-metric", "numJobs", "Worker metric to scale on (manifest command)")
+	manifestTarget    = flag.String("manifest-target", "1", "Target metric value per replica (manifest command)")
+	manifestMin       = flag.Int("manifest-min-replicas", 1, "Minimum replicas (manifest command)")
+	manifestMax       = flag.Int("manifest-max-replicas", 50, "Maximum replicas (manifest command)")
+	manifestNamespace = flag.String("manifest-namespace", "autoscale-worker", "Namespace of the worker (manifest command)")
+	manifestTargetRef = flag.String("manifest-deployment", "worker-deployment", "Worker Deployment to scale (manifest command)")
+	manifestPromAddr  = flag.String("manifest-prometheus", "http://frontend.default.svc:9090", "Prometheus query endpoint for KEDA (manifest command)")
+	reportFile        = flag.String("report", "", "Write a JSON report of the run to this file (publish and bench commands)")
+	diffFormat        = flag.String("diff-format", "text", "Output of the diff command: text or json")
+	replayStep        = flag.Duration("replay-step", time.Minute, "Time between the published batches, resampled from the recording (replay command)")
+	auditIdle         = flag.Duration("audit-idle", 5*time.Second, "Treat the subscription as drained once no new message arrived for this long (audit command)")
+	auditForce        = flag.Bool("audit-force", false, "Audit even if the subscription has a dead-letter policy, although every audited message uses up a delivery attempt (audit command)")
+	holdFor           = flag.Duration("hold-for", 10*time.Minute, "How long to hold the backlog depth (hold command)")
+	holdInterval      = flag.Duration("hold-interval", 2*time.Minute, "Time between backlog polls and top-ups (hold command)")
+	publishDelay      = flag.Duration("delay", 0, "Wait this long before publishing a batch (publish, cycle, auto and hold commands)")
+	spread            = flag.Duration("spread", 0, "Space each batch's messages evenly over this long instead of publishing them at once")
+	watchInterval     = flag.Duration("watch-interval", 2*time.Second, "Time between scrapes (watch command)")
+	publishTimeout    = flag.Duration("publish-timeout", 0, "If set, give up waiting for a single message's publish after this long")
+	publishRetries    = flag.Int("publish-retries", 0, "Publish a message again this many times when it hits -publish-timeout (may duplicate it)")
+	throttleBackoff   = flag.Duration("throttle-backoff", 10*time.Second, "Wait this long (doubling up to 5m) before publishing again when Pub/Sub reports its quota exceeded; 0 fails the message instead")
+	plan              = flag.Bool("plan", false, "Print what a publish, cycle, auto, hold or keepalive command would publish as JSON and exit")
+	dedupe            = flag.Bool("dedupe", false, "Skip messages with the same content as one already published in this run (publish, cycle and auto commands)")
+	poison            = flag.Int("poison", 0, "Mark the first N jobs as poison, failed by TEST_MODE workers to exercise dead-lettering (publish command)")
+	fleetAPI          = flag.String("fleet-api", "http://localhost:8001", "Kubernetes API server, e.g. from kubectl proxy (fleet command)")
+	fleetNamespace    = flag.String("fleet-namespace", "autoscale-worker", "Namespace of the worker pods (fleet command)")
+	fleetMetric       = flag.String("fleet-metric", "prometheus.googleapis.com|numJobs|gauge", "Custom metric name as the HPA uses it (fleet command)")
+	fleetSelector     = flag.String("fleet-selector", "", "Label selector for the worker pods, e.g. app=worker (fleet command)")
+	fleetTarget       = flag.Float64("fleet-target", 1, "HPA averageValue target, to show the desired replicas (fleet command)")
+	fleetInterval     = flag.Duration("fleet-interval", 15*time.Second, "Time between reports, 0 to report once (fleet command)")
+	extraAttrs        = attrFlag{}
+	durations         durationMix
+)
+
+// publishedContent holds the content hashes of this run's messages for
+// -dedupe. It spans every batch, e.g. all the steps of a scenario.
+var publishedContent = &contentSet{}
+
+func init() {
+	flag.Var(extraAttrs, "attr", "Extra message attribute as key=value (repeatable)")
+	flag.Var(&durations, "durations", "Mix job durations by weight, e.g. 30=70,300=30 (overrides <work_duration_sec>)")
+}
+
+// attrFlag collects repeated -attr key=value flags into a map.
+type attrFlag map[string]string
+
+func (a attrFlag) String() string {
+	pairs := make([]string, 0, len(a))
+	for k, v := range a {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (a attrFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	a[k] = v
+	return nil
+}
+
 func getOrCreateTopic(ctx context.Context, client *pubsub.Client, topicID string) *pubsub.Topic {
 	topic := client.Topic(topicID)
 	exists, err := topic.Exists(ctx)
+	recordAdminOp("get_topic", existsResult(exists), err)
 	if err != nil {
-		log.Fatalf("Failed to check if topic exists: %v", err)
+		fatal("Failed to check if topic exists", "err", err)
 	}
 	if !exists {
+		// With -auto-create=false a typo in the topic name is an error
+		// rather than a new, orphaned topic.
+		if !*autoCreate {
+			fatal("Topic does not exist and -auto-create=false", "topic", topicID)
+		}
 		topic, err = client.CreateTopic(ctx, topicID)
+		recordAdminOp("create_topic", adminCreated, err)
 		if err != nil {
-			log.Fatalf("Failed to create topic: %v", err)
+			fatal("Failed to create topic", "err", err)
 		}
-		log.Printf("Topic %s created.\n", topicID)
+		slog.Info("Topic created.", "topic", topicID)
 	}
 	return topic
 }
 
-func publishBatch(ctx context.Context, client *pubsub.Client, topicID string, numJobs, workDuration int) error {
-	log.Printf("Publishing %d jobs to topic %s...\n", numJobs, topicID)
+func publishBatch(ctx context.Context, client *pubsub.Client, topicID string, numJobs, workDuration int, r *rand.Rand) error {
+	_, _, err := publishJobs(ctx, client, topicID, numJobs, numJobs, workDuration, r)
+	return err
+}
+
+// publishJobs publishes numJobs jobs that each report reportedJobs as their
+// numJobs attribute, and returns how many were published and how many
+// failed. publishBatch reports the batch size; hold tops up the queue with a
+// few jobs that report the whole depth it maintains. With -shuffle, the order
+// is drawn from r, or from runRand if r is nil; batches published
+// concurrently need their own r.
+func publishJobs(ctx context.Context, client *pubsub.Client, topicID string, numJobs, reportedJobs, workDuration int, r *rand.Rand) (published, failed int, err error) {
+	slog.Info("Publishing jobs...", "numJobs", numJobs, "topic", topicID)
 	topic := getOrCreateTopic(ctx, client, topicID)
-	var results []*pubsub.PublishResult
+	var results []publishResult
+	var resultNums []int // message number of each result
+	var resultMsgs []*pubsub.Message
+	skipped := 0
+	// With -ordering-keys, messages are spread round-robin over the keys:
+	// each key is delivered in order, and the keys are independent streams.
+	topic.EnableMessageOrdering = *orderingKeys > 0
 
 	// --- This is the change ---
 	// We now send numJobs as an Attribute, not in the JSON body.
-	numJobsStr := fmt.Sprintf("%d", numJobs)
+	numJobsStr := fmt.Sprintf("%d", reportedJobs)
+
+	// With -checkpoint, progress is saved as messages are confirmed, so an
+	// interrupted batch can be picked up again with -resume.
+	cp := &checkpoint{Topic: topicID, NumJobs: numJobs, WorkDuration: workDuration}
+	if *resume {
+		prev, err := loadCheckpoint(*checkpointFile)
+		if err != nil {
+			return 0, 0, err
+		}
+		if prev.Topic != topicID || prev.NumJobs != numJobs || prev.WorkDuration != workDuration {
+			return 0, 0, fmt.Errorf("checkpoint %s is for a different batch (%d jobs of %ds to %s)", *checkpointFile, prev.NumJobs, prev.WorkDuration, prev.Topic)
+		}
+		cp = prev
+		slog.Info("Resuming after already published messages.", "published", cp.Published)
+	}
+	first := cp.Published + 1
+
+	// With -durations, each job gets its own duration from the mix. The
+	// sequence is deterministic, so replay it up to where a resume starts.
+	var picker *durationPicker
+	mixCounts := map[int]int{}
+	jobDurations := map[int]int{}
+	if len(durations) > 0 {
+		picker = newDurationPicker(durations)
+		for i := 1; i < first; i++ {
+			picker.next()
+		}
+		for i := first; i <= numJobs; i++ {
+			jobDurations[i] = picker.next()
+		}
+	}
+
+	// Messages go out in sequence, or in random order with -shuffle. A
+	// message keeps its number, and so its duration, when shuffled.
+	order := make([]int, 0, numJobs-first+1)
+	for i := first; i <= numJobs; i++ {
+		order = append(order, i)
+	}
+	if *shuffle {
+		if r == nil {
+			r, _ = runRand()
+		}
+		shuffleOrder(r, order)
+	}
+
+	// While Pub/Sub reports its quota exceeded, the batch backs off as a
+	// whole: before each publish, and again for each throttled message.
+	var th *throttle
+	if *throttleBackoff > 0 {
+		th = &throttle{base: *throttleBackoff, max: max(*throttleBackoff, maxThrottleBackoff)}
+	}
+
+	// With -delay and -spread, the message in each slot is published at its
+	// scheduled arrival time, counted from the start of the batch.
+	start := time.Now().Add(*publishDelay)
+	// stopErr ends the batch early. The messages already sent are still
+	// waited for below.
+	var stopErr error
+	for slot, i := range order {
+		if *publishDelay > 0 || *spread > 0 {
+			at := start.Add(time.Duration(first-1+slot) * *spread / time.Duration(numJobs))
+			if err := sleepContext(ctx, time.Until(at)); err != nil {
+				stopErr = fmt.Errorf("interrupted before message %d: %v", i, err)
+				break
+			}
+		}
+		jobDuration := workDuration
+		if picker != nil {
+			jobDuration = jobDurations[i]
+			mixCounts[jobDuration]++
+		}
 
-	for i := 1; i <= numJobs; i++ {
 		// The body just contains job-specific info
 		data, err := json.Marshal(struct {
 			ID       int    `json:"id"`
 			Duration string `json:"duration"`
 		}{
 			ID:       i,
-			Duration: fmt.Sprintf("%ds", workDuration),
+			Duration: fmt.Sprintf("%ds", jobDuration),
 		})
 		if err != nil {
-			return fmt.Errorf("json.Marshal: %v", err)
+			stopErr = fmt.Errorf("json.Marshal: %v", err)
+			break
 		}
 
 		// Publish the message with the 'numJobs' attribute
 		msg := &pubsub.Message{
 			Data: data,
 			Attributes: map[string]string{
-				"numJobs": numJobsStr,
+				"numJobs":     numJobsStr,
+				requestIDAttr: newRequestID(),
 			},
 		}
+		// The worker runs mixed-duration jobs for as long as they say.
+		if picker != nil {
+			msg.Attributes["durationSec"] = strconv.Itoa(jobDuration)
+		}
+		if *orderingKeys > 0 {
+			msg.OrderingKey = orderingKey(i, *orderingKeys)
+		}
+		if i <= *poison {
+			msg.Attributes["poison"] = "true"
+		}
+		if *messageTTL > 0 {
+			msg.Attributes["expiresAt"] = time.Now().Add(*messageTTL).UTC().Format(time.RFC3339)
+		}
+		// Extra -attr attributes never override the ones we set.
+		for k, v := range extraAttrs {
+			if _, ok := msg.Attributes[k]; !ok {
+				msg.Attributes[k] = v
+			}
+		}
+		if err := checkAttributes(msg.Attributes); err != nil {
+			stopErr = fmt.Errorf("message %d: %v", i, err)
+			break
+		}
+		if err := checkMessageSize(msg, *maxMessageBytes); err != nil {
+			stopErr = fmt.Errorf("message %d: %v", i, err)
+			break
+		}
+		if *dedupe && !publishedContent.add(msg) {
+			slog.Debug("Skipping duplicate message", "n", i)
+			skipped++
+			continue
+		}
+		if th != nil {
+			if err := th.pace(ctx, results); err != nil {
+				stopErr = fmt.Errorf("interrupted before message %d: %v", i, err)
+				break
+			}
+		}
 		results = append(results, topic.Publish(ctx, msg))
+		resultNums = append(resultNums, i)
+		resultMsgs = append(resultMsgs, msg)
 	}
 
-	// Wait for all messages to be published
+	// Wait for all messages to be published. The checkpoint only advances
+	// over the unbroken run of successes, so a resume never skips a message
+	// that failed.
+	waitCtx, retries := ctx, *publishRetries
+	if stopErr != nil {
+		// The batch is over, so nothing is published again: just find out
+		// what happened to the messages already sent, even after Ctrl-C.
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), publishDrainTimeout)
+		defer cancel()
+		retries, th = 0, nil
+	}
+	contiguous := true
+	perKey := map[string]int{}
 	for i, res := range results {
-		id, err := res.Get(ctx)
+		n := resultNums[i]
+		msg := resultMsgs[i]
+		id, err := waitPublished(waitCtx, res, *publishTimeout, retries, th, func() publishGetter {
+			return topic.Publish(ctx, msg)
+		})
 		if err != nil {
-			log.Printf("Failed to publish message %d: %v", i+1, err)
+			slog.Error("Failed to publish message", "n", n, "err", err)
+			failed++
+			contiguous = false
+			// A failure pauses its ordering key, and later messages with the
+			// same key fail too until it is resumed.
+			if *orderingKeys > 0 {
+				topic.ResumePublish(orderingKey(n, *orderingKeys))
+			}
 			continue
 		}
-		log.Printf("Published message %d; ID: %s", i+1, id)
+		if *orderingKeys > 0 {
+			perKey[orderingKey(n, *orderingKeys)]++
+		}
+		slog.Debug("Published message", "n", n, "id", id)
+		published++
+		if contiguous {
+			cp.Published = n
+			if *checkpointFile != "" && n%100 == 0 {
+				saveCheckpoint(cp)
+			}
+		}
+	}
+	if *checkpointFile != "" {
+		saveCheckpoint(cp)
+		slog.Info("Checkpoint saved.", "file", *checkpointFile, "published", cp.Published, "of", numJobs)
+	}
+	if stopErr != nil {
+		slog.Warn("Batch stopped early.", "published", published, "failed", failed)
+		return published, failed, stopErr
+	}
+	slog.Info("Published messages with 'numJobs' attribute.", "numJobs", numJobsStr, "published", published, "failed", failed)
+	if *dedupe {
+		slog.Info("Skipped duplicate messages.", "skipped", skipped)
+	}
+	for _, d := range durations {
+		slog.Info("Published jobs per duration.", "durationSec", d.Seconds, "jobs", mixCounts[d.Seconds])
+	}
+	for k := 0; k < *orderingKeys; k++ {
+		key := orderingKey(k+1, *orderingKeys)
+		slog.Info("Published messages per ordering key.", "key", key, "messages", perKey[key])
+	}
+	return published, failed, nil
+}
+
+// publishDrainTimeout bounds the wait for the messages already sent when a
+// batch stops early.
+const publishDrainTimeout = 30 * time.Second
+
+// orderingKey returns the ordering key of the n-th message (counting from 1)
+// when spreading messages round-robin over keys keys.
+func orderingKey(n, keys int) string {
+	return fmt.Sprintf("key-%d", (n-1)%keys)
+}
+
+// saveCheckpoint writes cp to -checkpoint, logging rather than failing the
+// batch if it can't.
+func saveCheckpoint(cp *checkpoint) {
+	if err := cp.save(*checkpointFile); err != nil {
+		slog.Warn("Failed to save checkpoint", "err", err)
 	}
-	log.Printf("Published %d messages with 'numJobs' attribute set to '%s'.\n", numJobs, numJobsStr)
-	return nil
 }
 
+// purgeQueue acknowledges every message in the subscription's backlog by
+// seeking it to the current time: all messages published before then count
+// as acked and are never delivered. Anything published afterwards is kept.
 func purgeQueue(ctx context.Context, client *pubsub.Client, subID string) error {
-	log.Printf("Purging queue for subscription %s...", subID)
+	slog.Info("Purging queue...", "subscription", subID)
 	sub := client.Subscription(subID)
 	err := sub.SeekToTime(ctx, time.Now())
 	if err != nil {
-		return fmt.Errorf("SeekToTime: %v", err)
+		return fmt.Errorf("SeekToTime: %w", err)
 	}
-	log.Println("Queue purged (all unacknowledged messages will be redelivered, then new messages will be processed).")
-	log.Println("Note: This does not delete messages. It resets the subscription cursor.")
-	log.Println("For a full purge, please use the Google Cloud Console to seek to a future timestamp or detach/reattach the subscription.")
+	slog.Info("Queue purged: the backlog was acknowledged and won't be delivered.")
+	slog.Info("Note: Messages already being processed still finish, and their acks are ignored.")
 	return nil
 }
 
-func runAutoMode(ctx context.Context, client *pubsub.Client, topicID string) error {
-	log.Println("Starting 'auto' mode...")
+// Ways -finalize ends an auto run.
+const (
+	// finalizeDone publishes the DONE sentinel. Only the worker that
+	// receives it drops its metric right away.
+	finalizeDone = "done"
+	// finalizePurge empties the subscription before sending DONE. The other
+	// workers receive nothing more, so each one's metric goes stale after
+	// METRIC_TIMEOUT_SEC and the whole fleet scales down.
+	finalizePurge = "purge"
+)
 
-	// Scenario:
-	// 1. 9 messages, 90s each
-	log.Println("--- Scenario 1: 9 Jobs ---")
-	if err := publishBatch(ctx, client, topicID, 9, 90); err != nil {
+func runAutoMode(ctx context.Context, client *pubsub.Client, topicID, subID string, steps []scenarioStep, finalize string) error {
+	slog.Info("Starting 'auto' mode...")
+	if err := runScenario(ctx, client, topicID, steps); err != nil {
 		return err
 	}
-	log.Println("Waiting 2 minutes...")
-	time.Sleep(2 * time.Minute)
-
-	// 2. 3 messages, 90s each
-	log.Println("--- Scenario 2: 3 Jobs ---")
-	if err := publishBatch(ctx, client, topicID, 3, 90); err != nil {
+	if err := finalizeRun(ctx, client, topicID, subID, finalize); err != nil {
 		return err
 	}
-	log.Println("Waiting 1 minute...")
-	time.Sleep(1 * time.Minute)
-
-	// 3. 15 messages, 90s each (Spike)
-	log.Println("--- Scenario 3: 15 Jobs (Spike) ---")
-	if err := publishBatch(ctx, client, topicID, 15, 90); err != nil {
-		return err
-	}
-	log.Println("Waiting 3 minutes...")
-	time.Sleep(3 * time.Minute)
+	slog.Info("Auto mode finished.")
+	return nil
+}
 
-	// 4. 7 messages, 90s each
-	log.Println("--- Scenario 4: 7 Jobs ---")
-	if err := publishBatch(ctx, client, topicID, 7, 90); err != nil {
-		return err
+// finalizeRun ends a scenario run as -finalize says.
+func finalizeRun(ctx context.Context, client *pubsub.Client, topicID, subID, finalize string) error {
+	slog.Info("Finalizing the run", "action", finalize)
+	if finalize == finalizePurge {
+		if err := purgeQueue(ctx, client, subID); err != nil {
+			return err
+		}
+		slog.Info("Workers will reset their metric once METRIC_TIMEOUT_SEC passes without a job.")
 	}
-	log.Println("Waiting 3 minutes...")
-	time.Sleep(3 * time.Minute)
-
-	// 5. Send a "DONE" message with numJobs = 0
-	log.Println("--- Scenario 5: Done (0 Jobs) ---")
+	// Finally, send a "DONE" message with numJobs = 0
+	slog.Info("--- Done (0 Jobs) ---")
+	return publishDone(ctx, client, topicID)
+}
 
-	// --- FIX: Get the topic before publishing ---
+// publishDone publishes the DONE sentinel (numJobs=0), which tells the
+// workers the run is over so they drop their metric to 0 right away.
+func publishDone(ctx context.Context, client *pubsub.Client, topicID string) error {
 	topic := getOrCreateTopic(ctx, client, topicID)
-	// --- End Fix ---
-
 	msg := &pubsub.Message{
 		Data: []byte("DONE"),
 		Attributes: map[string]string{
-			"numJobs": "0",
+			"numJobs":     "0",
+			requestIDAttr: newRequestID(),
 		},
 	}
-	res := topic.Publish(ctx, msg)
-	_, err := res.Get(ctx)
-	if err != nil {
+	if _, err := topic.Publish(ctx, msg).Get(ctx); err != nil {
 		return fmt.Errorf("Failed to publish DONE message: %v", err)
 	}
+	return nil
+}
+
+// runCycle publishes a batch, waits, then purges the subscription, so users
+// can watch how the workers and the HPA react to a backlog that appears and
+// then vanishes. The backlog is reported before and after the purge; the
+// report after it waits for Cloud Monitoring to sample the purged backlog.
+func runCycle(ctx context.Context, client *pubsub.Client, projectID, topicID, subID string, numJobs, workDuration int, wait time.Duration) error {
+	slog.Info("Starting 'cycle' mode...")
+	if err := publishBatch(ctx, client, topicID, numJobs, workDuration, nil); err != nil {
+		return err
+	}
 
-	log.Println("Auto mode finished.")
+	slog.Info("Waiting before purging...", "wait", wait)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+	}
+
+	logBacklog(ctx, projectID, subID, "before purge")
+	purgedAt := time.Now()
+	if err := purgeQueue(ctx, client, subID); err != nil {
+		return err
+	}
+	// Monitoring would still show the backlog from before the purge for a
+	// while, so wait for a sample that covers it.
+	logBacklogSince(ctx, projectID, subID, "after purge", purgedAt)
+
+	slog.Info("Cycle finished.")
 	return nil
 }
 
+// runKeepalive publishes a low-value keepalive message every interval until
+// the context is cancelled (Ctrl-C). As long as the workers keep receiving it,
+// numJobs never goes stale, so the HPA keeps a minimum number of pods warm
+// between bursts instead of scaling all the way down.
+func runKeepalive(ctx context.Context, client *pubsub.Client, topicID string, interval time.Duration, value int) error {
+	slog.Info("Sending keepalive. Press Ctrl-C to stop.", "numJobs", value, "interval", interval)
+	topic := getOrCreateTopic(ctx, client, topicID)
+	valueStr := strconv.Itoa(value)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// The "type" attribute tells the worker to refresh its metric and ack
+		// right away instead of simulating a full job.
+		msg := &pubsub.Message{
+			Data: []byte("KEEPALIVE"),
+			Attributes: map[string]string{
+				"numJobs":     valueStr,
+				"type":        "keepalive",
+				requestIDAttr: newRequestID(),
+			},
+		}
+		if _, err := topic.Publish(ctx, msg).Get(ctx); err != nil {
+			if ctx.Err() != nil {
+				slog.Info("Keepalive stopped.")
+				return nil
+			}
+			return fmt.Errorf("Failed to publish keepalive message: %v", err)
+		}
+		slog.Info("Published keepalive message.", "numJobs", valueStr)
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Keepalive stopped.")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
 func printUsage() {
-	fmt.Println("Usage: go run . <command> <project_id> <topic_id> <subscription_id> [args]")
+	fmt.Println("Usage: go run . [flags] <command> <project_id> <topic_id> <subscription_id> [args]")
 	fmt.Println("Commands:")
-	fmt.Println("  publish <project_id> <topic_id> <subscription_id> <num_messages> <work_duration_sec>")
-	fmt.Println("  purge   <project_id> <topic_id> <subscription_id>")
-	fmt.Println("  auto    <project_id> <topic_id> <subscription_id>")
+	fmt.Println("  publish   <project_id> <topic_id> <subscription_id> <num_messages> <work_duration_sec>")
+	fmt.Println("  purge     <project_id> <topic_id> <subscription_id>")
+	fmt.Println("  auto      <project_id> <topic_id> <subscription_id>")
+	fmt.Println("  keepalive <project_id> <topic_id> <subscription_id>")
+	fmt.Println("  hold      <project_id> <topic_id> <subscription_id> <depth> <work_duration_sec>")
+	fmt.Println("  cycle     <project_id> <topic_id> <subscription_id> <num_messages> <work_duration_sec>")
+	fmt.Println("  bench     <project_id> <topic_id> <subscription_id>")
+	fmt.Println("  mirror    <project_id> <topic_id> <subscription_id> <dest_topic_id>")
+	fmt.Println("  audit     <project_id> <topic_id> <subscription_id> (counts the queued messages without consuming them)")
+	fmt.Println("  replay    <project_id> <topic_id> <subscription_id> <series_file> <work_duration_sec> (reproduces a recorded numJobs series)")
+	fmt.Println("  timeline  (no arguments, prints the auto mode scenario as a chart)")
+	fmt.Println("  manifest  (no arguments, prints an HPA or KEDA ScaledObject to stdout)")
+	fmt.Println("  watch     <worker_url> (e.g. localhost:8080, shows its key metrics live)")
+	fmt.Println("  fleet     (no arguments, reports the metric the HPA sees through the Custom Metrics API)")
+	fmt.Println("  diff      <old_report> <new_report> (compares two -report files)")
+	fmt.Println("Flags:")
+	flag.PrintDefaults()
+}
+
+// loadScenarioFlag returns the steps from -scenario, or the default scenario.
+func loadScenarioFlag() []scenarioStep {
+	if *scenarioFile == "" {
+		return defaultScenario
+	}
+	steps, err := loadScenario(*scenarioFile)
+	if err != nil {
+		fatal("Failed to load scenario", "err", err)
+	}
+	return steps
 }
 
 func main() {
-	if len(os.Args) < 5 {
+	setupLogging()
+
+	flag.Usage = printUsage
+	flag.Parse()
+	args := flag.Args()
+
+	// timeline only plans the scenario, so it needs neither arguments nor a
+	// client.
+	if len(args) == 1 && args[0] == "timeline" {
+		writeTimeline(os.Stdout, loadScenarioFlag())
+		return
+	}
+
+	// manifest only renders YAML, so it needs neither arguments nor a client.
+	if len(args) == 1 && args[0] == "manifest" {
+		err := writeManifest(os.Stdout, *manifestFormat, manifestConfig{
+			Namespace:         *manifestNamespace,
+			Deployment:        *manifestTargetRef,
+			MetricName:        *manifestMetric,
+			TargetValue:       *manifestTarget,
+			MinReplicas:       *manifestMin,
+			MaxReplicas:       *manifestMax,
+			PrometheusAddress: *manifestPromAddr,
+		})
+		if err != nil {
+			fatal("Failed to generate manifest", "err", err)
+		}
+		return
+	}
+
+	// watch only scrapes a worker.
+	if len(args) == 2 && args[0] == "watch" {
+		if *watchInterval <= 0 {
+			fatal("Invalid -watch-interval", "interval", *watchInterval)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runWatch(ctx, os.Stdout, metricsURL(args[1]), *watchInterval); err != nil {
+			fatal("Watch failed", "err", err)
+		}
+		return
+	}
+
+	// fleet talks to Kubernetes, not Pub/Sub.
+	if len(args) == 1 && args[0] == "fleet" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err := runFleet(ctx, os.Stdout, fleetConfig{
+			APIServer:  *fleetAPI,
+			Namespace:  *fleetNamespace,
+			MetricName: *fleetMetric,
+			Selector:   *fleetSelector,
+			Target:     *fleetTarget,
+			Interval:   *fleetInterval,
+		})
+		if err != nil {
+			fatal("Fleet report failed", "err", err)
+		}
+		return
+	}
+
+	// diff only reads two -report files.
+	if len(args) == 3 && args[0] == "diff" {
+		if *diffFormat != "text" && *diffFormat != "json" {
+			fatal("Invalid -diff-format, want text or json", "format", *diffFormat)
+		}
+		oldFields, err := loadReportFields(args[1])
+		if err != nil {
+			fatal("Failed to load report", "err", err)
+		}
+		newFields, err := loadReportFields(args[2])
+		if err != nil {
+			fatal("Failed to load report", "err", err)
+		}
+		if err := writeDiff(os.Stdout, *diffFormat, diffReports(oldFields, newFields)); err != nil {
+			fatal("Failed to write diff", "err", err)
+		}
+		return
+	}
+
+	if len(args) < 4 {
 		printUsage()
 		return
 	}
 
-	command := os.Args[1]
-	projectID := os.Args[2]
-	topicID := os.Args[3]
-	subID := os.Args[4] // Used by purge, but good to be consistent
+	command := args[0]
+	projectID := args[1]
+	topicID := args[2]
+	subID := args[3] // Used by purge, but good to be consistent
 
-	ctx := context.Background()
-	client, err := pubsub.NewClient(ctx, projectID)
+	if *maxMessageBytes <= 0 || *maxMessageBytes > maxPubSubMessageBytes {
+		fatal("Invalid -max-message-bytes", "max", maxPubSubMessageBytes)
+	}
+
+	// Catch -attr mistakes before connecting. The attributes we add
+	// ourselves are checked again per message.
+	if err := checkAttributes(extraAttrs); err != nil {
+		fatal("Invalid -attr", "err", err)
+	}
+
+	if *orderingKeys < 0 {
+		fatal("Invalid -ordering-keys", "keys", *orderingKeys)
+	}
+
+	if *publishTimeout < 0 || *publishRetries < 0 {
+		fatal("-publish-timeout and -publish-retries must not be negative")
+	}
+	if *throttleBackoff < 0 {
+		fatal("-throttle-backoff must not be negative")
+	}
+	if *finalize != finalizeDone && *finalize != finalizePurge {
+		fatal("Invalid -finalize, want done or purge", "finalize", *finalize)
+	}
+
+	if *resume && *checkpointFile == "" {
+		fatal("-resume requires -checkpoint")
+	}
+	// The other commands publish several batches, some of them at once,
+	// which would overwrite each other's progress in the one file.
+	if *checkpointFile != "" && command != "publish" {
+		fatal("-checkpoint is only supported by publish", "command", command)
+	}
+	// A checkpoint records how far into the sequence a batch got, which
+	// means nothing once the order is shuffled.
+	if *shuffle && *checkpointFile != "" {
+		fatal("-shuffle can't be combined with -checkpoint")
+	}
+
+	// -plan describes the run instead of doing it, so it needs no client.
+	if *plan {
+		p, err := buildPlan(command, topicID, args[4:])
+		if err != nil {
+			fatal("Failed to build plan", "err", err)
+		}
+		if err := writePlan(os.Stdout, p); err != nil {
+			fatal("Failed to write plan", "err", err)
+		}
+		return
+	}
+
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+
+	// Cancel the context on Ctrl-C so long-running commands can stop cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	clientOpts, err := pubsubClientOptions()
+	if err != nil {
+		fatal("Failed to configure pubsub client", "err", err)
+	}
+	client, err := pubsub.NewClient(ctx, projectID, clientOpts...)
 	if err != nil {
-		log.Fatalf("Failed to create pubsub client: %v", err)
+		fatal("Failed to create pubsub client", "err", err)
 	}
 	defer client.Close()
 
 	switch command {
 	case "publish":
-		if len(os.Args) != 7 {
+		if len(args) != 6 {
 			printUsage()
 			return
 		}
-		numJobs, err := strconv.Atoi(os.Args[5])
+		numJobs, err := strconv.Atoi(args[4])
+		if err != nil {
+			fatal("Invalid <num_messages>", "err", err)
+		}
+		workDuration, err := strconv.Atoi(args[5])
 		if err != nil {
-			log.Fatalf("Invalid <num_messages>: %v", err)
+			fatal("Invalid <work_duration_sec>", "err", err)
 		}
-		workDuration, err := strconv.Atoi(os.Args[6])
+		report := &runReport{Command: "publish", Topic: topicID, StartedAt: time.Now().UTC()}
+		published, failed, err := publishJobs(ctx, client, topicID, numJobs, numJobs, workDuration, nil)
 		if err != nil {
-			log.Fatalf("Invalid <work_duration_sec>: %v", err)
+			fatal("Failed to publish", "err", err)
 		}
-		if err := publishBatch(ctx, client, topicID, numJobs, workDuration); err != nil {
-			log.Fatalf("Failed to publish: %v", err)
+		if *reportFile != "" {
+			elapsed := time.Since(report.StartedAt)
+			report.DurationSec = elapsed.Seconds()
+			report.Messages = published
+			report.Failures = failed
+			report.MessagesPerSec = float64(published) / elapsed.Seconds()
+			if *shuffle {
+				report.Shuffled = true
+				_, report.Seed = runRand()
+			}
+			if err := writeReport(*reportFile, report); err != nil {
+				fatal("Failed to write report", "err", err)
+			}
 		}
 
 	case "purge":
 		if err := purgeQueue(ctx, client, subID); err != nil {
-			log.Fatalf("Failed to purge: %v", err)
+			fatal("Failed to purge", "err", err)
 		}
 
 	case "auto":
-		if err := runAutoMode(ctx, client, topicID); err != nil {
-			log.Fatalf("Failed to run auto mode: %v", err)
+		steps := loadScenarioFlag()
+		if *timeline {
+			writeTimeline(os.Stdout, steps)
+		}
+		if err := runAutoMode(ctx, client, topicID, subID, steps, *finalize); err != nil {
+			fatal("Failed to run auto mode", "err", err)
+		}
+
+	case "replay":
+		if len(args) != 6 {
+			printUsage()
+			return
+		}
+		workDuration, err := strconv.Atoi(args[5])
+		if err != nil {
+			fatal("Invalid <work_duration_sec>", "err", err)
+		}
+		steps, err := loadReplay(args[4], workDuration)
+		if err != nil {
+			fatal("Failed to load replay", "err", err)
+		}
+		if *timeline {
+			writeTimeline(os.Stdout, steps)
+		}
+		slog.Info("Replaying the recorded series", "steps", len(steps), "step", *replayStep)
+		if err := runScenario(ctx, client, topicID, steps); err != nil {
+			fatal("Failed to replay", "err", err)
+		}
+		if err := finalizeRun(ctx, client, topicID, subID, *finalize); err != nil {
+			fatal("Failed to finalize replay", "err", err)
+		}
+
+	case "cycle":
+		if len(args) != 6 {
+			printUsage()
+			return
+		}
+		numJobs, err := strconv.Atoi(args[4])
+		if err != nil {
+			fatal("Invalid <num_messages>", "err", err)
+		}
+		workDuration, err := strconv.Atoi(args[5])
+		if err != nil {
+			fatal("Invalid <work_duration_sec>", "err", err)
+		}
+		if err := runCycle(ctx, client, projectID, topicID, subID, numJobs, workDuration, *cycleWait); err != nil {
+			fatal("Failed to run cycle", "err", err)
+		}
+
+	case "hold":
+		if len(args) != 6 {
+			printUsage()
+			return
+		}
+		depth, err := strconv.Atoi(args[4])
+		if err != nil || depth <= 0 {
+			fatal("Invalid <depth>", "depth", args[4])
+		}
+		workDuration, err := strconv.Atoi(args[5])
+		if err != nil {
+			fatal("Invalid <work_duration_sec>", "err", err)
+		}
+		if *holdFor <= 0 || *holdInterval <= 0 {
+			fatal("-hold-for and -hold-interval must be positive")
+		}
+		if err := runHold(ctx, client, projectID, topicID, subID, depth, workDuration, *holdFor, *holdInterval); err != nil {
+			fatal("Failed to run hold", "err", err)
+		}
+
+	case "keepalive":
+		if *keepaliveInterval <= 0 {
+			fatal("Invalid -keepalive-interval", "interval", *keepaliveInterval)
+		}
+		if err := runKeepalive(ctx, client, topicID, *keepaliveInterval, *keepaliveValue); err != nil {
+			fatal("Failed to run keepalive", "err", err)
+		}
+
+	case "bench":
+		if *benchMessages <= 0 || *benchConcurrency <= 0 || *benchBatchSize <= 0 {
+			fatal("-bench-messages, -bench-concurrency and -bench-batch-size must be positive")
+		}
+		report, err := runBench(ctx, client, topicID, subID, benchSettings{
+			messages:    *benchMessages,
+			concurrency: *benchConcurrency,
+			batchSize:   *benchBatchSize,
+			purge:       *benchPurge,
+		})
+		if err != nil {
+			fatal("Failed to run bench", "err", err)
+		}
+		if *reportFile != "" {
+			if err := writeReport(*reportFile, report); err != nil {
+				fatal("Failed to write report", "err", err)
+			}
+		}
+
+	case "mirror":
+		if len(args) != 5 {
+			printUsage()
+			return
+		}
+		if *mirrorScale <= 0 {
+			fatal("Invalid -mirror-scale", "scale", *mirrorScale)
+		}
+		if err := runMirror(ctx, client, subID, args[4], *mirrorScale); err != nil {
+			fatal("Failed to run mirror", "err", err)
+		}
+
+	case "audit":
+		if *auditIdle <= 0 {
+			fatal("Invalid -audit-idle", "idle", *auditIdle)
+		}
+		tally, err := runAudit(ctx, client, subID, *auditIdle, *auditForce)
+		if err != nil {
+			fatal("Failed to run audit", "err", err)
+		}
+		if err := writeAudit(os.Stdout, tally, time.Now()); err != nil {
+			fatal("Failed to write audit", "err", err)
 		}
 
 	default:
-		log.Printf("Unknown command: %s\n", command)
+		slog.Error("Unknown command", "command", command)
 		printUsage()
 	}
 }
-
-
-
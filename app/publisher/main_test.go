@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckMessageSize(t *testing.T) {
+	msg := &pubsub.Message{
+		Data:       []byte(strings.Repeat("x", 90)),
+		Attributes: map[string]string{"numJobs": "1"}, // 8 bytes
+	}
+	if err := checkMessageSize(msg, 100); err != nil {
+		t.Fatalf("98 byte message rejected with limit 100: %v", err)
+	}
+
+	oversized := &pubsub.Message{Data: make([]byte, maxPubSubMessageBytes+1)}
+	err := checkMessageSize(oversized, maxPubSubMessageBytes)
+	if err == nil {
+		t.Fatal("oversized message was not rejected")
+	}
+	if !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckAttributes(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxAttributes; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	atLimit := map[string]string{}
+	for i := 0; i < maxAttributes; i++ {
+		atLimit[fmt.Sprintf("k%d", i)] = "v"
+	}
+
+	tests := []struct {
+		name    string
+		attrs   map[string]string
+		wantErr string
+	}{
+		{"empty", nil, ""},
+		{"typical", map[string]string{"numJobs": "7", "env": "dev"}, ""},
+		{"at count limit", atLimit, ""},
+		{"too many", tooMany, "attributes, over the limit"},
+		{"key at limit", map[string]string{strings.Repeat("k", maxAttributeKeyBytes): "v"}, ""},
+		{"key too long", map[string]string{strings.Repeat("k", maxAttributeKeyBytes+1): "v"}, "attribute key"},
+		{"value at limit", map[string]string{"k": strings.Repeat("v", maxAttributeValueBytes)}, ""},
+		{"value too long", map[string]string{"big": strings.Repeat("v", maxAttributeValueBytes+1)}, `attribute "big" value`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAttributes(tt.attrs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// slowResult is a publish that never completes: Get blocks until its
+// context is done.
+type slowResult struct{}
+
+func (slowResult) Get(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// doneResult is a publish that already completed with id.
+type doneResult string
+
+func (r doneResult) Get(context.Context) (string, error) { return string(r), nil }
+
+func TestContentSet(t *testing.T) {
+	job := func(id int, duration, numJobs string) *pubsub.Message {
+		return &pubsub.Message{
+			Data: []byte(fmt.Sprintf(`{"id":%d,"duration":%q}`, id, duration)),
+			Attributes: map[string]string{
+				"numJobs":     numJobs,
+				requestIDAttr: newRequestID(),
+				"expiresAt":   time.Now().Add(time.Duration(id) * time.Second).UTC().Format(time.RFC3339),
+			},
+		}
+	}
+	var s contentSet
+	for _, tc := range []struct {
+		name string
+		msg  *pubsub.Message
+		want bool
+	}{
+		{"first job", job(1, "90s", "5"), true},
+		{"same job with another id, request ID and expiry", job(2, "90s", "5"), false},
+		{"same fields in another order", &pubsub.Message{Data: []byte(`{"duration":"90s","id":3}`), Attributes: map[string]string{"numJobs": "5"}}, false},
+		{"another duration", job(4, "30s", "5"), true},
+		{"another numJobs", job(5, "90s", "6"), true},
+		{"another ordering key", &pubsub.Message{Data: []byte(`{"id":6,"duration":"90s"}`), Attributes: map[string]string{"numJobs": "5"}, OrderingKey: "key-1"}, true},
+		{"non-JSON data", &pubsub.Message{Data: []byte("DONE"), Attributes: map[string]string{"numJobs": "0"}}, true},
+		{"repeated non-JSON data", &pubsub.Message{Data: []byte("DONE"), Attributes: map[string]string{"numJobs": "0"}}, false},
+	} {
+		if got := s.add(tc.msg); got != tc.want {
+			t.Errorf("%s: add = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWaitPublishedTimesOut(t *testing.T) {
+	start := time.Now()
+	_, err := waitPublished(context.Background(), slowResult{}, 50*time.Millisecond, 0, nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("waited %v for a 50ms timeout", elapsed)
+	}
+}
+
+func TestWaitPublishedRetries(t *testing.T) {
+	republished := 0
+	id, err := waitPublished(context.Background(), slowResult{}, 50*time.Millisecond, 2, nil, func() publishGetter {
+		republished++
+		if republished < 2 {
+			return slowResult{}
+		}
+		return doneResult("id-2")
+	})
+	if err != nil || id != "id-2" {
+		t.Fatalf("waitPublished = %q, %v, want id-2 after retrying", id, err)
+	}
+	if republished != 2 {
+		t.Errorf("republished %d times, want 2", republished)
+	}
+}
+
+func TestWaitPublishedNoTimeout(t *testing.T) {
+	id, err := waitPublished(context.Background(), doneResult("id-1"), 0, 3, nil, nil)
+	if err != nil || id != "id-1" {
+		t.Fatalf("waitPublished = %q, %v, want id-1", id, err)
+	}
+}
+
+// errResult is a publish that failed with err.
+type errResult struct{ err error }
+
+func (r errResult) Get(context.Context) (string, error) { return "", r.err }
+
+func TestWaitPublishedBacksOffOnQuota(t *testing.T) {
+	quota := errResult{status.Error(codes.ResourceExhausted, "quota exceeded")}
+	th := &throttle{base: 10 * time.Millisecond, max: 20 * time.Millisecond}
+	throttled := testutil.ToFloat64(publishThrottled)
+	republished := 0
+	start := time.Now()
+	id, err := waitPublished(context.Background(), quota, 0, 0, th, func() publishGetter {
+		republished++
+		if republished < 3 {
+			return quota
+		}
+		return doneResult("id-3")
+	})
+	if err != nil || id != "id-3" {
+		t.Fatalf("waitPublished = %q, %v, want id-3 once the quota frees up", id, err)
+	}
+	// Backoffs of 10ms, 20ms and 20ms (capped).
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("republished after %v, want backoffs totalling at least 50ms", elapsed)
+	}
+	if got := testutil.ToFloat64(publishThrottled) - throttled; got != 3 {
+		t.Errorf("publish_throttled_total rose by %v, want 3", got)
+	}
+	if th.delay != 0 {
+		t.Errorf("backoff is %v after a successful publish, want it reset", th.delay)
+	}
+
+	// Without a throttle the quota error is returned right away.
+	if _, err := waitPublished(context.Background(), quota, 0, 0, nil, nil); !isQuotaExceeded(err) {
+		t.Errorf("err = %v, want the quota error", err)
+	}
+}
+
+// readyResult is a publish that has completed with err, or is still in
+// flight if pending.
+type readyResult struct {
+	err     error
+	pending bool
+}
+
+func (r readyResult) Get(context.Context) (string, error) { return "id", r.err }
+
+func (r readyResult) Ready() <-chan struct{} {
+	if r.pending {
+		return nil
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func TestThrottlePacesPublishes(t *testing.T) {
+	ctx := context.Background()
+	quota := readyResult{err: status.Error(codes.ResourceExhausted, "quota exceeded")}
+	th := &throttle{base: 10 * time.Millisecond, max: 20 * time.Millisecond}
+
+	// Successful publishes let the next one through right away.
+	results := []publishResult{readyResult{}, readyResult{}}
+	if err := th.pace(ctx, results); err != nil || th.delay != 0 {
+		t.Fatalf("pace after successes: err %v, delay %v, want no backoff", err, th.delay)
+	}
+
+	// A rejected publish holds the next one back, and the backoff grows.
+	results = append(results, quota)
+	start := time.Now()
+	if err := th.pace(ctx, results); err != nil {
+		t.Fatalf("pace: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("paced for %v, want at least 10ms", elapsed)
+	}
+	if th.delay != 20*time.Millisecond {
+		t.Errorf("backoff is %v, want 20ms", th.delay)
+	}
+
+	// Results are only looked at once, and those still in flight wait.
+	results = append(results, readyResult{pending: true}, quota)
+	if err := th.pace(ctx, results); err != nil || th.checked != 3 {
+		t.Errorf("pace with a pending result: err %v, checked %d, want 3", err, th.checked)
+	}
+
+	// A later success resets the backoff.
+	results[3] = readyResult{}
+	if err := th.pace(ctx, results[:4]); err != nil || th.delay != 0 {
+		t.Errorf("pace after recovering: err %v, delay %v, want the backoff reset", err, th.delay)
+	}
+
+	// Cancelling the context stops the wait.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := th.pace(cctx, append(results[:4], quota)); err == nil {
+		t.Error("pace succeeded with a cancelled context")
+	}
+}
+
+func TestWaitBacklogSince(t *testing.T) {
+	ctx := context.Background()
+	purged := time.Now()
+	// Monitoring shows the old backlog twice before a sample after the purge.
+	samples := []struct {
+		backlog int64
+		at      time.Time
+	}{
+		{40, purged.Add(-time.Minute)},
+		{40, purged.Add(-time.Second)},
+		{0, purged.Add(30 * time.Second)},
+	}
+	reads := 0
+	read := func(context.Context) (int64, time.Time, error) {
+		s := samples[min(reads, len(samples)-1)]
+		reads++
+		return s.backlog, s.at, nil
+	}
+	backlog, fresh, err := waitBacklogSince(ctx, read, purged, time.Second, time.Millisecond)
+	if err != nil || !fresh || backlog != 0 || reads != 3 {
+		t.Errorf("waitBacklogSince = %d, %v, %v after %d reads, want a fresh 0 after 3", backlog, fresh, err, reads)
+	}
+
+	// Without a newer sample, the last one is returned as stale.
+	reads = 0
+	samples = samples[:2]
+	backlog, fresh, err = waitBacklogSince(ctx, read, purged, 20*time.Millisecond, 5*time.Millisecond)
+	if err != nil || fresh || backlog != 40 {
+		t.Errorf("waitBacklogSince = %d, %v, %v, want a stale 40", backlog, fresh, err)
+	}
+}
+
+func TestDiffReports(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.json")
+	newPath := filepath.Join(dir, "new.json")
+	// The old report predates failures; the new one has a field diff
+	// doesn't know about.
+	os.WriteFile(oldPath, []byte(`{"command": "bench", "messagesPerSec": 100, "latencyMs": {"p50": 20, "p99": 80}}`), 0o644)
+	os.WriteFile(newPath, []byte(`{"command": "bench", "messagesPerSec": 150, "failures": 2, "latencyMs": {"p50": 20, "p99": 100}, "retries": 3}`), 0o644)
+
+	oldFields, err := loadReportFields(oldPath)
+	if err != nil {
+		t.Fatalf("loadReportFields: %v", err)
+	}
+	newFields, err := loadReportFields(newPath)
+	if err != nil {
+		t.Fatalf("loadReportFields: %v", err)
+	}
+	got := map[string]reportDiff{}
+	var order []string
+	for _, d := range diffReports(oldFields, newFields) {
+		got[d.Field] = d
+		order = append(order, d.Field)
+	}
+
+	wantOrder := []string{"messagesPerSec", "failures", "latencyMs.p50", "latencyMs.p99", "retries"}
+	if fmt.Sprint(order) != fmt.Sprint(wantOrder) {
+		t.Errorf("fields %v, want %v", order, wantOrder)
+	}
+	if d := got["messagesPerSec"]; d.Verdict != "better" || d.ChangePct == nil || *d.ChangePct != 50 {
+		t.Errorf("messagesPerSec diff = %+v, want 50%% better", d)
+	}
+	if d := got["latencyMs.p99"]; d.Verdict != "worse" || *d.Delta != 20 {
+		t.Errorf("latencyMs.p99 diff = %+v, want 20 worse", d)
+	}
+	if d := got["latencyMs.p50"]; d.Verdict != "same" {
+		t.Errorf("latencyMs.p50 diff = %+v, want same", d)
+	}
+	if d := got["failures"]; d.Old != nil || d.Delta != nil || d.Verdict != "" {
+		t.Errorf("failures diff = %+v, want it missing from the old report", d)
+	}
+
+	var out strings.Builder
+	if err := writeDiff(&out, "text", diffReports(oldFields, newFields)); err != nil {
+		t.Fatalf("writeDiff: %v", err)
+	}
+	if !strings.Contains(out.String(), "missing") {
+		t.Errorf("text diff doesn't show the missing field:\n%s", out.String())
+	}
+}
+
+func TestAuditTally(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tally := newAuditTally()
+	msgs := []*pubsub.Message{
+		{ID: "1", Attributes: map[string]string{"numJobs": "10"}, PublishTime: now.Add(-90 * time.Second)},
+		{ID: "2", Attributes: map[string]string{"numJobs": "2"}, PublishTime: now.Add(-time.Minute)},
+		{ID: "3", Attributes: map[string]string{"numJobs": "10", "expiresAt": now.Add(-time.Second).Format(time.RFC3339)}},
+		{ID: "4", Attributes: map[string]string{"numJobs": "5", "type": "keepalive"}},
+		{ID: "5", Data: []byte("DONE"), Attributes: map[string]string{"numJobs": "0"}},
+		{ID: "6", Attributes: map[string]string{"type": "bench"}},
+		// A redelivery isn't counted again.
+		{ID: "1", Attributes: map[string]string{"numJobs": "10"}},
+	}
+	for _, msg := range msgs {
+		tally.add(msg, now)
+	}
+
+	var b strings.Builder
+	if err := writeAudit(&b, tally, now); err != nil {
+		t.Fatalf("writeAudit: %v", err)
+	}
+	want := `Messages: 6 (oldest published 1m30s ago)
+Expired: 1 (the workers will drop them)
+Redelivered during the audit: 1 (not counted)
+
+TYPE       COUNT
+bench      1
+done       1
+job        3
+keepalive  1
+
+NUMJOBS  COUNT
+0        1
+2        1
+5        1
+10       2
+(none)   1
+`
+	if got := b.String(); got != want {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestShuffleOrder(t *testing.T) {
+	order := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	shuffled := append([]int(nil), order...)
+	shuffleOrder(rand.New(rand.NewSource(42)), shuffled)
+	if reflect.DeepEqual(shuffled, order) {
+		t.Fatalf("order unchanged by shuffling: %v", shuffled)
+	}
+	sorted := append([]int(nil), shuffled...)
+	sort.Ints(sorted)
+	if !reflect.DeepEqual(sorted, order) {
+		t.Fatalf("shuffled %v is not a permutation of %v", shuffled, order)
+	}
+
+	// The same seed gives the same order.
+	again := append([]int(nil), order...)
+	shuffleOrder(rand.New(rand.NewSource(42)), again)
+	if !reflect.DeepEqual(again, shuffled) {
+		t.Fatalf("seed 42 shuffled to %v, then %v", shuffled, again)
+	}
+}
+
+func TestReportSeedIsNotCompared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := writeReport(path, &runReport{Command: "publish", Messages: 3, Shuffled: true, Seed: 42}); err != nil {
+		t.Fatalf("writeReport: %v", err)
+	}
+	fields, err := loadReportFields(path)
+	if err != nil {
+		t.Fatalf("loadReportFields: %v", err)
+	}
+	if _, ok := fields["seed"]; ok {
+		t.Errorf("seed loaded as a measurement: %v", fields)
+	}
+	if fields["messages"] != 3 {
+		t.Errorf("messages = %v, want 3", fields["messages"])
+	}
+}
+
+func TestLoadSeries(t *testing.T) {
+	dir := t.TempDir()
+	promJSON := `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"__name__":"numJobs"},"values":[[1700000060,"4"],[1700000000,"2"],[1700000120,"NaN"]]}]}}`
+	csvData := "timestamp,value\n2023-11-14T22:13:20Z,2\n1700000060, 4\n1700000120,NaN\n"
+	want := []loadSample{
+		{At: time.Unix(1700000000, 0).UTC(), Value: 2},
+		{At: time.Unix(1700000060, 0).UTC(), Value: 4},
+	}
+	for name, data := range map[string]string{"range.json": promJSON, "series.csv": csvData} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadSeries(path)
+		if err != nil {
+			t.Fatalf("loadSeries(%s): %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("loadSeries(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	twoSeries := filepath.Join(dir, "two.json")
+	os.WriteFile(twoSeries, []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"values":[]},{"values":[]}]}}`), 0o644)
+	if _, err := loadSeries(twoSeries); err == nil || !strings.Contains(err.Error(), "exactly one series") {
+		t.Errorf("two series: err = %v, want a request to aggregate", err)
+	}
+}
+
+func TestLoadSeriesRejectsBadValues(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"inf.json":      `{"status":"success","data":{"resultType":"matrix","result":[{"values":[[1700000000,"2"],[1700000060,"+Inf"]]}]}}`,
+		"negative.json": `{"status":"success","data":{"resultType":"matrix","result":[{"values":[[1700000000,"-1"]]}]}}`,
+		"inf.csv":       "1700000000,2\n1700000060,Inf\n",
+		"negative.csv":  "1700000000,-3\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSeries(path); err == nil || !strings.Contains(err.Error(), "finite and non-negative") {
+			t.Errorf("loadSeries(%s): err = %v, want a rejected value", name, err)
+		}
+	}
+}
+
+func TestReplaySteps(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	samples := []loadSample{
+		{At: start, Value: 0},
+		{At: start.Add(2 * time.Minute), Value: 10},
+		// A gap in the recording is interpolated across.
+		{At: start.Add(6 * time.Minute), Value: 2},
+	}
+	values := resampleSeries(samples, time.Minute)
+	wantValues := []float64{0, 5, 10, 8, 6, 4, 2}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Fatalf("resampled %v, want %v", values, wantValues)
+	}
+
+	steps := replaySteps([]float64{0, 2.5, 7.4}, 30*time.Second, 90)
+	want := []scenarioStep{
+		{Name: "t+0s", NumJobs: 0, WorkDuration: 90, WaitSec: 30},
+		{Name: "t+30s", NumJobs: 3, WorkDuration: 90, WaitSec: 30},
+		{Name: "t+1m0s", NumJobs: 7, WorkDuration: 90, WaitSec: 30},
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("steps %+v, want %+v", steps, want)
+	}
+}
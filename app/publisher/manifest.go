@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/template"
+)
+
+// manifestConfig holds the values substituted into a generated manifest.
+type manifestConfig struct {
+	Namespace   string
+	Deployment  string
+	MetricName  string
+	TargetValue string
+	MinReplicas int
+	MaxReplicas int
+	// PrometheusAddress is the query endpoint KEDA reads the metric from.
+	PrometheusAddress string
+}
+
+// hpaTemplate matches kubernetes/worker-hpa.yaml, minus the scaling behavior
+// tuned for the lab. It keeps that file's name, so applying it replaces the
+// lab's HPA instead of adding a second one for the same Deployment. The
+// metric goes through the Custom Metrics Stackdriver Adapter, which exposes
+// Managed Prometheus metrics as prometheus.googleapis.com|<name>|gauge.
+var hpaTemplate = template.Must(template.New("hpa").Parse(`apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: worker-hpa
+  namespace: {{.Namespace}}
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: {{.Deployment}}
+  minReplicas: {{.MinReplicas}}
+  maxReplicas: {{.MaxReplicas}}
+  metrics:
+  - type: Pods
+    pods:
+      metric:
+        name: prometheus.googleapis.com|{{.MetricName}}|gauge
+      target:
+        type: AverageValue
+        averageValue: {{.TargetValue}}
+`))
+
+// scaledObjectTemplate is the KEDA equivalent. KEDA divides the query result
+// by the threshold, so summing over pods gives the same replica count as the
+// HPA's per-pod average.
+var scaledObjectTemplate = template.Must(template.New("keda").Parse(`apiVersion: keda.sh/v1alpha1
+kind: ScaledObject
+metadata:
+  name: {{.Deployment}}-scaler
+  namespace: {{.Namespace}}
+spec:
+  scaleTargetRef:
+    name: {{.Deployment}}
+  minReplicaCount: {{.MinReplicas}}
+  maxReplicaCount: {{.MaxReplicas}}
+  triggers:
+  - type: prometheus
+    metricType: AverageValue
+    metadata:
+      serverAddress: {{.PrometheusAddress}}
+      query: sum({{.MetricName}}{namespace="{{.Namespace}}"})
+      threshold: "{{.TargetValue}}"
+`))
+
+// writeManifest prints a manifest in the given format ("hpa" or "keda") that
+// scales the worker on its custom metric. It only generates YAML and never
+// talks to a cluster.
+func writeManifest(w io.Writer, format string, cfg manifestConfig) error {
+	if cfg.MinReplicas < 0 || cfg.MaxReplicas < 1 || cfg.MaxReplicas < cfg.MinReplicas {
+		return fmt.Errorf("invalid replica bounds %d..%d", cfg.MinReplicas, cfg.MaxReplicas)
+	}
+	var tmpl *template.Template
+	switch format {
+	case "hpa":
+		tmpl = hpaTemplate
+	case "keda":
+		tmpl = scaledObjectTemplate
+	default:
+		return fmt.Errorf("unknown manifest format %q (want hpa or keda)", format)
+	}
+	if err := tmpl.Execute(w, cfg); err != nil {
+		return fmt.Errorf("render manifest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// adminOps counts topic/subscription admin operations by outcome, so it's
+// visible how often resources are created versus found.
+var adminOps = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pubsub_admin_operations_total",
+		Help: "The number of Pub/Sub admin operations, by operation and result.",
+	},
+	[]string{"operation", "result"},
+)
+
+// publishTimeouts counts publishes that didn't complete within
+// -publish-timeout, retried or not.
+var publishTimeouts = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "publish_timeouts_total",
+		Help: "The number of publishes that timed out after -publish-timeout.",
+	},
+)
+
+// publishThrottled counts publishes that hit a Pub/Sub quota and were
+// retried after a backoff.
+var publishThrottled = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "publish_throttled_total",
+		Help: "The number of publishes rejected as over quota (ResourceExhausted) and retried after -throttle-backoff.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(adminOps, publishTimeouts, publishThrottled)
+}
+
+// Results of pubsub_admin_operations_total: a get finds the resource or
+// not, and a create creates it. Any failed call is an error.
+const (
+	adminFound    = "found"
+	adminNotFound = "not_found"
+	adminCreated  = "created"
+	adminError    = "error"
+)
+
+// existsResult is the result of a get that reported whether the resource
+// exists.
+func existsResult(exists bool) string {
+	if exists {
+		return adminFound
+	}
+	return adminNotFound
+}
+
+// recordAdminOp increments adminOps for the given operation with result, or
+// with adminError if err is set.
+func recordAdminOp(operation, result string, err error) {
+	if err != nil {
+		result = adminError
+	}
+	adminOps.WithLabelValues(operation, result).Inc()
+}
+
+// serveMetrics exposes /metrics on addr in the background. It is used for
+// long-running commands (auto, keepalive) that Prometheus can scrape.
+func serveMetrics(addr string) {
+	go func() {
+		slog.Info("Starting metrics server", "addr", addr)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Warn("Metrics server failed", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// runMirror consumes subID and republishes every message to destTopicID, so
+// a second stage of workers can scale on the same numJobs signal. Data and
+// attributes are kept; numJobs is multiplied by scale (rounded up) when
+// scale isn't 1. A message is acked only once its copy is published. Runs
+// until the context is cancelled (Ctrl-C).
+func runMirror(ctx context.Context, client *pubsub.Client, subID, destTopicID string, scale float64) error {
+	slog.Info("Mirroring. Press Ctrl-C to stop.", "subscription", subID, "topic", destTopicID, "scale", scale)
+	dest := getOrCreateTopic(ctx, client, destTopicID)
+	defer dest.Stop()
+
+	err := client.Subscription(subID).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		attrs := make(map[string]string, len(msg.Attributes))
+		for k, v := range msg.Attributes {
+			attrs[k] = v
+		}
+		if scaled, ok := scaleNumJobs(attrs["numJobs"], scale); ok {
+			attrs["numJobs"] = scaled
+		}
+		if _, err := dest.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attrs}).Get(ctx); err != nil {
+			slog.Error("Failed to mirror message", "id", msg.ID, "err", err)
+			msg.Nack()
+			return
+		}
+		slog.Debug("Mirrored message", "id", msg.ID, "numJobs", attrs["numJobs"])
+		msg.Ack()
+	})
+	if err != nil {
+		return fmt.Errorf("Receive: %v", err)
+	}
+	slog.Info("Mirror stopped.")
+	return nil
+}
+
+// scaleNumJobs multiplies a numJobs attribute by scale, rounding up so a
+// non-empty backlog never mirrors as 0. It reports false if there is nothing
+// to change: scale is 1 or the value isn't a number.
+func scaleNumJobs(value string, scale float64) (string, bool) {
+	if scale == 1 {
+		return "", false
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.Itoa(int(math.Ceil(n * scale))), true
+}
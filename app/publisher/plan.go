@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// publishPlan describes what a publish command would do, as printed by
+// -plan. It is meant to be reviewed or diffed, so it only contains values
+// that are the same on every run (no request IDs or expiry times).
+type publishPlan struct {
+	Command string        `json:"command"`
+	Topic   string        `json:"topic"`
+	Batches []plannedStep `json:"batches"`
+	// TotalJobs and JobsPerMinute cover the batches; hold and keepalive
+	// publish more as they run.
+	TotalJobs     int     `json:"totalJobs"`
+	SpanSec       int     `json:"spanSec"`
+	JobsPerMinute float64 `json:"jobsPerMinute,omitempty"`
+	// RepeatEverySec and RunForSec describe the publishing that follows the
+	// batches: top-ups for hold, keepalive messages for keepalive.
+	RepeatEverySec float64           `json:"repeatEverySec,omitempty"`
+	RunForSec      float64           `json:"runForSec,omitempty"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	TTLSec         float64           `json:"ttlSec,omitempty"`
+	OrderingKeys   int               `json:"orderingKeys,omitempty"`
+	Poison         int               `json:"poison,omitempty"`
+	Dedupe         bool              `json:"dedupe,omitempty"`
+	Shuffle        bool              `json:"shuffle,omitempty"`
+	// DelaySec and SpreadSec shift each batch's start and space its
+	// messages out, relative to the batch's startSec.
+	DelaySec  float64 `json:"delaySec,omitempty"`
+	SpreadSec float64 `json:"spreadSec,omitempty"`
+	// Finalize is how an auto run ends, see -finalize.
+	Finalize string `json:"finalize,omitempty"`
+}
+
+// plannedStep is a batch with the time it starts and, with -durations, how
+// many of its jobs get each duration.
+type plannedStep struct {
+	scenarioStep
+	StartSec        int            `json:"startSec"`
+	JobsPerDuration map[string]int `json:"jobsPerDurationSec,omitempty"`
+}
+
+// buildPlan returns the plan for command with its arguments after the
+// subscription ID, using the same flags the command would.
+func buildPlan(command, topicID string, args []string) (*publishPlan, error) {
+	var steps []scenarioStep
+	p := &publishPlan{
+		Command:      command,
+		Topic:        topicID,
+		Attributes:   extraAttrs,
+		TTLSec:       messageTTL.Seconds(),
+		OrderingKeys: *orderingKeys,
+		Poison:       *poison,
+		Dedupe:       *dedupe,
+		Shuffle:      *shuffle,
+		DelaySec:     publishDelay.Seconds(),
+		SpreadSec:    spread.Seconds(),
+	}
+	switch command {
+	case "publish", "cycle", "hold":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s takes 2 arguments, got %d", command, len(args))
+		}
+		numJobs, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid count: %v", err)
+		}
+		workDuration, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid <work_duration_sec>: %v", err)
+		}
+		steps = []scenarioStep{{Name: command, NumJobs: numJobs, WorkDuration: workDuration}}
+		if command == "cycle" {
+			steps[0].WaitSec = int(cycleWait.Seconds())
+		}
+		if command == "hold" {
+			p.RepeatEverySec = holdInterval.Seconds()
+			p.RunForSec = holdFor.Seconds()
+		}
+	case "auto":
+		steps = loadScenarioFlag()
+		p.Finalize = *finalize
+	case "replay":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("replay takes 2 arguments, got %d", len(args))
+		}
+		workDuration, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid <work_duration_sec>: %v", err)
+		}
+		if steps, err = loadReplay(args[0], workDuration); err != nil {
+			return nil, err
+		}
+		p.Finalize = *finalize
+	case "keepalive":
+		p.RepeatEverySec = keepaliveInterval.Seconds()
+	default:
+		return nil, fmt.Errorf("-plan does not support the %s command", command)
+	}
+
+	starts, span := stepStarts(steps)
+	p.SpanSec = span
+	p.Batches = []plannedStep{}
+	for i, step := range steps {
+		ps := plannedStep{scenarioStep: step, StartSec: starts[i]}
+		if len(durations) > 0 {
+			ps.JobsPerDuration = map[string]int{}
+			picker := newDurationPicker(durations)
+			for j := 0; j < step.NumJobs; j++ {
+				ps.JobsPerDuration[strconv.Itoa(picker.next())]++
+			}
+		}
+		p.Batches = append(p.Batches, ps)
+		p.TotalJobs += step.NumJobs
+	}
+	if span > 0 {
+		p.JobsPerMinute = float64(p.TotalJobs) / (float64(span) / 60)
+	}
+	return p, nil
+}
+
+// writePlan writes p as indented JSON.
+func writePlan(w io.Writer, p *publishPlan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestClient starts a pstest server and returns a client connected to it.
+func newTestClient(t *testing.T) (*pubsub.Client, *pstest.Server) {
+	t.Helper()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+
+	client, err := pubsub.NewClient(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, srv
+}
+
+func TestPublishBatchSetsNumJobs(t *testing.T) {
+	client, srv := newTestClient(t)
+	ctx := context.Background()
+
+	if err := publishBatch(ctx, client, "jobs", 7, 90, nil); err != nil {
+		t.Fatalf("publishBatch: %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 7 {
+		t.Fatalf("got %d messages, want 7", len(msgs))
+	}
+	for _, m := range msgs {
+		if got := m.Attributes["numJobs"]; got != "7" {
+			t.Errorf("message %s: numJobs = %q, want \"7\"", m.ID, got)
+		}
+		var body struct {
+			ID       int    `json:"id"`
+			Duration string `json:"duration"`
+		}
+		if err := json.Unmarshal(m.Data, &body); err != nil {
+			t.Fatalf("message %s: invalid body %q: %v", m.ID, m.Data, err)
+		}
+		if body.Duration != "90s" {
+			t.Errorf("message %s: duration = %q, want \"90s\"", m.ID, body.Duration)
+		}
+	}
+}
+
+func TestPublishDone(t *testing.T) {
+	client, srv := newTestClient(t)
+	ctx := context.Background()
+
+	if err := publishDone(ctx, client, "jobs"); err != nil {
+		t.Fatalf("publishDone: %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if string(msgs[0].Data) != "DONE" || msgs[0].Attributes["numJobs"] != "0" {
+		t.Errorf("DONE message = %q with numJobs %q, want \"DONE\" with \"0\"", msgs[0].Data, msgs[0].Attributes["numJobs"])
+	}
+}
+
+func TestPurgeQueue(t *testing.T) {
+	client, srv := newTestClient(t)
+	ctx := context.Background()
+
+	topic, err := client.CreateTopic(ctx, "jobs")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	sub, err := client.CreateSubscription(ctx, "jobs-sub", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	if err := publishBatch(ctx, client, "jobs", 5, 90, nil); err != nil {
+		t.Fatalf("publishBatch: %v", err)
+	}
+
+	if err := purgeQueue(ctx, client, "jobs-sub"); err != nil {
+		t.Fatalf("purgeQueue: %v", err)
+	}
+
+	// The backlog is gone: every message counts as acked...
+	for _, m := range srv.Messages() {
+		if m.Acks == 0 {
+			t.Errorf("message %s was not acked by the purge", m.ID)
+		}
+	}
+	// ...and only what's published afterwards is delivered.
+	if err := publishDone(ctx, client, "jobs"); err != nil {
+		t.Fatalf("publishDone: %v", err)
+	}
+	rctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var received atomic.Int32
+	err = sub.Receive(rctx, func(_ context.Context, msg *pubsub.Message) {
+		received.Add(1)
+		if string(msg.Data) != "DONE" {
+			t.Errorf("received %q after the purge, want only DONE", msg.Data)
+		}
+		msg.Ack()
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if n := received.Load(); n != 1 {
+		t.Errorf("received %d messages after the purge, want 1", n)
+	}
+}
+
+func TestPurgeQueueMissingSubscription(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	err := purgeQueue(context.Background(), client, "missing")
+	if err == nil {
+		t.Fatal("purging a missing subscription succeeded")
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("error = %v, want NotFound", err)
+	}
+}
+
+func TestFinalizeRunPurgeSendsDone(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+
+	topic, err := client.CreateTopic(ctx, "jobs")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	sub, err := client.CreateSubscription(ctx, "jobs-sub", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	if err := publishBatch(ctx, client, "jobs", 5, 90, nil); err != nil {
+		t.Fatalf("publishBatch: %v", err)
+	}
+
+	if err := finalizeRun(ctx, client, "jobs", "jobs-sub", finalizePurge); err != nil {
+		t.Fatalf("finalizeRun: %v", err)
+	}
+
+	// The batch was purged, but DONE survives it.
+	rctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var got []string
+	var mu sync.Mutex
+	err = sub.Receive(rctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		got = append(got, string(msg.Data))
+		mu.Unlock()
+		msg.Ack()
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if len(got) != 1 || got[0] != "DONE" {
+		t.Errorf("received %q after finalizing, want only DONE", got)
+	}
+}
+
+func TestGetOrCreateTopicCountsAdminOps(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+	count := func(operation, result string) float64 {
+		return testutil.ToFloat64(adminOps.WithLabelValues(operation, result))
+	}
+	notFound, created, found := count("get_topic", adminNotFound), count("create_topic", adminCreated), count("get_topic", adminFound)
+
+	// The first call creates the topic, the second finds it.
+	getOrCreateTopic(ctx, client, "jobs").Stop()
+	getOrCreateTopic(ctx, client, "jobs").Stop()
+	if got := count("get_topic", adminNotFound) - notFound; got != 1 {
+		t.Errorf("get_topic not_found counted %v times, want 1", got)
+	}
+	if got := count("create_topic", adminCreated) - created; got != 1 {
+		t.Errorf("create_topic created counted %v times, want 1", got)
+	}
+	if got := count("get_topic", adminFound) - found; got != 1 {
+		t.Errorf("get_topic found counted %v times, want 1", got)
+	}
+}
+
+func TestRunScenarioShufflesConcurrentSteps(t *testing.T) {
+	client, srv := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.CreateTopic(ctx, "jobs"); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	defer func(prev bool) { *shuffle = prev }(*shuffle)
+	*shuffle = true
+
+	// Without a wait the steps publish at the same time, each shuffling its
+	// batch; run with -race to catch them sharing one source.
+	steps := []scenarioStep{
+		{Name: "a", NumJobs: 10, WorkDuration: 90},
+		{Name: "b", NumJobs: 12, WorkDuration: 90},
+	}
+	if err := runScenario(ctx, client, "jobs", steps); err != nil {
+		t.Fatalf("runScenario: %v", err)
+	}
+	perStep := map[string]int{}
+	for _, m := range srv.Messages() {
+		perStep[m.Attributes["numJobs"]]++
+	}
+	if perStep["10"] != 10 || perStep["12"] != 12 {
+		t.Errorf("published %v messages per step, want 10 and 12", perStep)
+	}
+}
+
+func TestPublishBatchDedupe(t *testing.T) {
+	client, srv := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.CreateTopic(ctx, "jobs"); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	*dedupe = true
+	publishedContent = &contentSet{}
+	t.Cleanup(func() {
+		*dedupe = false
+		publishedContent = &contentSet{}
+	})
+
+	// Identical jobs collapse into one, and a repeated batch adds nothing;
+	// a batch with another job count is new.
+	for _, numJobs := range []int{3, 3, 4} {
+		if err := publishBatch(ctx, client, "jobs", numJobs, 90, nil); err != nil {
+			t.Fatalf("publishBatch(%d): %v", numJobs, err)
+		}
+	}
+	if n := len(srv.Messages()); n != 2 {
+		t.Errorf("published %d messages, want 2", n)
+	}
+}
+
+func TestRunAuditDeadLetterPolicy(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+
+	topic, err := client.CreateTopic(ctx, "jobs")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	dlq, err := client.CreateTopic(ctx, "jobs-dlq")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	_, err = client.CreateSubscription(ctx, "jobs-sub", pubsub.SubscriptionConfig{
+		Topic:            topic,
+		DeadLetterPolicy: &pubsub.DeadLetterPolicy{DeadLetterTopic: dlq.String(), MaxDeliveryAttempts: 5},
+	})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	if err := publishBatch(ctx, client, "jobs", 2, 90, nil); err != nil {
+		t.Fatalf("publishBatch: %v", err)
+	}
+
+	// Each audit would use up a delivery attempt, so it needs -audit-force.
+	if _, err := runAudit(ctx, client, "jobs-sub", 200*time.Millisecond, false); err == nil || !strings.Contains(err.Error(), "-audit-force") {
+		t.Fatalf("runAudit without force: err = %v, want a refusal", err)
+	}
+	tally, err := runAudit(ctx, client, "jobs-sub", 200*time.Millisecond, true)
+	if err != nil {
+		t.Fatalf("runAudit with force: %v", err)
+	}
+	if tally.messages != 2 {
+		t.Errorf("audited %d messages, want 2", tally.messages)
+	}
+}
+
+func TestPublishJobsDrainsOnEarlyStop(t *testing.T) {
+	client, srv := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.CreateTopic(ctx, "jobs"); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	// Message 10 is the first with a two-digit id, one byte over the limit.
+	limit := messageSize(&pubsub.Message{
+		Data:       []byte(`{"id":9,"duration":"90s"}`),
+		Attributes: map[string]string{"numJobs": "12", requestIDAttr: newRequestID()},
+	})
+	defer func(prev int) { *maxMessageBytes = prev }(*maxMessageBytes)
+	*maxMessageBytes = limit
+
+	published, failed, err := publishJobs(ctx, client, "jobs", 12, 12, 90, nil)
+	if err == nil || !strings.Contains(err.Error(), "message 10") {
+		t.Fatalf("publishJobs: err = %v, want message 10 rejected", err)
+	}
+	// The messages sent before the stop were waited for and counted.
+	if published != 9 || failed != 0 {
+		t.Errorf("published %d and failed %d, want 9 and 0", published, failed)
+	}
+	if n := len(srv.Messages()); n != 9 {
+		t.Errorf("server has %d messages, want 9", n)
+	}
+}
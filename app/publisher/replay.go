@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadSample is one recorded numJobs value.
+type loadSample struct {
+	At    time.Time
+	Value float64
+}
+
+// loadSeries reads a recorded numJobs series from path: either the JSON
+// response of a Prometheus range query (/api/v1/query_range) with a single
+// series, or CSV rows of timestamp,value. The samples are returned in time
+// order.
+func loadSeries(path string) ([]loadSample, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read series: %v", err)
+	}
+	var samples []loadSample
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		samples, err = parsePrometheusRange(data)
+	} else {
+		samples, err = parseSeriesCSV(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse series %s: %v", path, err)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("series %s has no samples", path)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].At.Before(samples[j].At) })
+	return samples, nil
+}
+
+// parsePrometheusRange parses a range query response. Values come as
+// [<unix seconds>, "<value>"] pairs; NaN samples are skipped.
+func parsePrometheusRange(data []byte) ([]loadSample, error) {
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Values [][2]json.RawMessage `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" || resp.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("want a successful range query (status %q, resultType %q)", resp.Status, resp.Data.ResultType)
+	}
+	if n := len(resp.Data.Result); n != 1 {
+		return nil, fmt.Errorf("want exactly one series, got %d: aggregate them in the query, e.g. max(numJobs)", n)
+	}
+	var samples []loadSample
+	for i, pair := range resp.Data.Result[0].Values {
+		var ts float64
+		var value string
+		if err := json.Unmarshal(pair[0], &ts); err != nil {
+			return nil, fmt.Errorf("sample %d: invalid timestamp: %v", i+1, err)
+		}
+		if err := json.Unmarshal(pair[1], &value); err != nil {
+			return nil, fmt.Errorf("sample %d: invalid value: %v", i+1, err)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: invalid value %q", i+1, value)
+		}
+		if math.IsNaN(v) {
+			continue
+		}
+		if err := checkSampleValue(v); err != nil {
+			return nil, fmt.Errorf("sample %d: %v", i+1, err)
+		}
+		samples = append(samples, loadSample{At: unixSeconds(ts), Value: v})
+	}
+	return samples, nil
+}
+
+// parseSeriesCSV parses timestamp,value rows. Timestamps are Unix seconds or
+// RFC 3339. A first row whose value isn't a number is taken as a header, and
+// NaN rows are skipped.
+func parseSeriesCSV(data string) ([]loadSample, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var samples []loadSample
+	for i, row := range rows {
+		v, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("row %d: invalid value %q", i+1, row[1])
+		}
+		if math.IsNaN(v) {
+			continue
+		}
+		if err := checkSampleValue(v); err != nil {
+			return nil, fmt.Errorf("row %d: %v", i+1, err)
+		}
+		var at time.Time
+		if ts, err := strconv.ParseFloat(row[0], 64); err == nil {
+			at = unixSeconds(ts)
+		} else if at, err = time.Parse(time.RFC3339, row[0]); err != nil {
+			return nil, fmt.Errorf("row %d: invalid timestamp %q, want Unix seconds or RFC 3339", i+1, row[0])
+		}
+		samples = append(samples, loadSample{At: at, Value: v})
+	}
+	return samples, nil
+}
+
+// checkSampleValue rejects values that can't be replayed as a job count.
+func checkSampleValue(v float64) error {
+	if math.IsInf(v, 0) || v < 0 {
+		return fmt.Errorf("value %v must be finite and non-negative", v)
+	}
+	return nil
+}
+
+func unixSeconds(ts float64) time.Time {
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// resampleSeries returns the series' value every step from its first sample
+// to its last, interpolating linearly between the samples around each
+// point. Gaps in the recording are bridged the same way.
+func resampleSeries(samples []loadSample, step time.Duration) []float64 {
+	var values []float64
+	start, end := samples[0].At, samples[len(samples)-1].At
+	j := 0
+	for t := start; !t.After(end); t = t.Add(step) {
+		// samples[j] is the last sample at or before t.
+		for j+1 < len(samples) && !samples[j+1].At.After(t) {
+			j++
+		}
+		if j+1 == len(samples) {
+			values = append(values, samples[j].Value)
+			continue
+		}
+		a, b := samples[j], samples[j+1]
+		frac := float64(t.Sub(a.At)) / float64(b.At.Sub(a.At))
+		values = append(values, a.Value+frac*(b.Value-a.Value))
+	}
+	return values
+}
+
+// replaySteps turns the resampled values into scenario steps, one per
+// timestep: each publishes the recorded numJobs value (rounded) as a batch,
+// so the workers' metric follows the recording. A step recorded as 0
+// publishes nothing and lets the metric go stale.
+func replaySteps(values []float64, step time.Duration, workDuration int) []scenarioStep {
+	steps := make([]scenarioStep, 0, len(values))
+	for i, v := range values {
+		steps = append(steps, scenarioStep{
+			Name:         fmt.Sprintf("t+%s", time.Duration(i)*step),
+			NumJobs:      int(math.Round(v)),
+			WorkDuration: workDuration,
+			WaitSec:      int(step.Seconds()),
+		})
+	}
+	return steps
+}
+
+// loadReplay reads the series at path and returns the steps that replay it
+// every -replay-step.
+func loadReplay(path string, workDuration int) ([]scenarioStep, error) {
+	if *replayStep < time.Second || *replayStep%time.Second != 0 {
+		return nil, fmt.Errorf("-replay-step must be a whole number of seconds")
+	}
+	samples, err := loadSeries(path)
+	if err != nil {
+		return nil, err
+	}
+	steps := replaySteps(resampleSeries(samples, *replayStep), *replayStep, workDuration)
+	for _, s := range steps {
+		if err := validateStep(s); err != nil {
+			return nil, fmt.Errorf("replay %s step %s: %v", path, s.Name, err)
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runReport is the machine-readable summary of a run, written with -report.
+type runReport struct {
+	Command        string       `json:"command"`
+	Topic          string       `json:"topic"`
+	StartedAt      time.Time    `json:"startedAt"`
+	DurationSec    float64      `json:"durationSec"`
+	Messages       int          `json:"messages"`
+	Failures       int          `json:"failures"`
+	MessagesPerSec float64      `json:"messagesPerSec"`
+	LatencyMs      latencyStats `json:"latencyMs"`
+	// Shuffled records that -shuffle randomized the message order, and Seed
+	// the seed that repeats it. Seed is a string in JSON, so diff doesn't
+	// compare it as a measurement.
+	Shuffled bool  `json:"shuffled,omitempty"`
+	Seed     int64 `json:"seed,omitempty,string"`
+}
+
+// writeReport writes the report as indented JSON to path.
+func writeReport(path string, r *runReport) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write report: %v", err)
+	}
+	return nil
+}
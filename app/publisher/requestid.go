@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// requestIDAttr is the message attribute carrying the correlation ID that
+// the worker logs on every line for the job.
+const requestIDAttr = "requestId"
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand doesn't fail on supported platforms.
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// publishGetter is the part of *pubsub.PublishResult the publisher waits on.
+type publishGetter interface {
+	Get(ctx context.Context) (serverID string, err error)
+}
+
+// publishResult is a publish that may still be in flight, as returned by
+// Topic.Publish.
+type publishResult interface {
+	publishGetter
+	Ready() <-chan struct{}
+}
+
+// getWithTimeout waits for res for at most timeout, or without a limit if
+// timeout is 0, so one slow publish doesn't stall the rest of the batch.
+func getWithTimeout(ctx context.Context, res publishGetter, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return res.Get(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return res.Get(ctx)
+}
+
+// maxThrottleBackoff caps the doubling of -throttle-backoff.
+const maxThrottleBackoff = 5 * time.Minute
+
+// maxThrottledAttempts bounds how often a message is published again after
+// hitting the quota, so a quota that never frees up fails the message.
+const maxThrottledAttempts = 10
+
+// throttle is the backoff shared by a batch's publishes while Pub/Sub reports
+// its quota exhausted. Each throttled publish doubles the delay, up to max,
+// and a successful publish resets it, so the batch slows down as a whole
+// instead of every message hammering the API on its own.
+type throttle struct {
+	base, max time.Duration
+	delay     time.Duration
+	// checked is how many of the batch's results pace has looked at.
+	checked int
+}
+
+// pace holds the publish loop back while the quota is exhausted. It looks at
+// the results that completed since the last call, in publish order, and if
+// one of them was refused over quota, waits the backoff before the next
+// message goes out. A successful one resets the backoff.
+func (t *throttle) pace(ctx context.Context, results []publishResult) error {
+	quota := false
+scan:
+	for ; t.checked < len(results); t.checked++ {
+		select {
+		case <-results[t.checked].Ready():
+		default:
+			// Still in flight, and so most likely is everything after it.
+			break scan
+		}
+		if _, err := results[t.checked].Get(ctx); isQuotaExceeded(err) {
+			quota = true
+		} else if err == nil && !quota {
+			t.reset()
+		}
+	}
+	if !quota {
+		return nil
+	}
+	slog.Warn("Publish quota exceeded, slowing down the batch", "delay", max(t.delay, t.base))
+	return t.wait(ctx)
+}
+
+// wait sleeps for the current delay and doubles it for the next time.
+func (t *throttle) wait(ctx context.Context) error {
+	if t.delay < t.base {
+		t.delay = t.base
+	}
+	d := t.delay
+	t.delay = min(2*t.delay, t.max)
+	return sleepContext(ctx, d)
+}
+
+// reset goes back to the base delay after a publish gets through.
+func (t *throttle) reset() {
+	t.delay = 0
+}
+
+// isQuotaExceeded reports whether err is Pub/Sub refusing a publish because
+// a quota is exhausted.
+func isQuotaExceeded(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// waitPublished waits for res with -publish-timeout. A publish that times
+// out is published again, up to retries times, by calling republish. The
+// timed-out attempt may still succeed later, so a retry can duplicate the
+// message. A publish over quota is published again after th's backoff, up
+// to maxThrottledAttempts times (never if th is nil). Other errors are
+// returned as they are, since the client already retried them.
+func waitPublished(ctx context.Context, res publishGetter, timeout time.Duration, retries int, th *throttle, republish func() publishGetter) (string, error) {
+	id, err := getWithTimeout(ctx, res, timeout)
+	timeouts, throttled := 0, 0
+	for ctx.Err() == nil {
+		if errors.Is(err, context.DeadlineExceeded) && timeouts < retries {
+			timeouts++
+			publishTimeouts.Inc()
+			slog.Warn("Publish timed out, retrying", "timeout", timeout, "attempt", timeouts)
+		} else if isQuotaExceeded(err) && th != nil && throttled < maxThrottledAttempts {
+			throttled++
+			publishThrottled.Inc()
+			slog.Warn("Publish quota exceeded, backing off", "delay", max(th.delay, th.base), "attempt", throttled)
+			if th.wait(ctx) != nil {
+				break
+			}
+		} else {
+			break
+		}
+		id, err = getWithTimeout(ctx, republish(), timeout)
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		publishTimeouts.Inc()
+	}
+	if err == nil && th != nil {
+		th.reset()
+	}
+	return id, err
+}
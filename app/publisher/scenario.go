@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// scenarioStep is one batch of the auto mode scenario.
+type scenarioStep struct {
+	Name         string `json:"name"`
+	NumJobs      int    `json:"numJobs"`
+	WorkDuration int    `json:"workDurationSec"`
+	// WaitSec is how long the batch is given to drain before the next step.
+	WaitSec int `json:"waitSec"`
+	// OverlapSec starts the next step this long before WaitSec is up, so
+	// the two batches are in flight at the same time.
+	OverlapSec int `json:"overlapSec"`
+}
+
+// defaultScenario is the scenario auto mode runs without -scenario.
+var defaultScenario = []scenarioStep{
+	{Name: "9 Jobs", NumJobs: 9, WorkDuration: 90, WaitSec: 120},
+	{Name: "3 Jobs", NumJobs: 3, WorkDuration: 90, WaitSec: 60},
+	{Name: "15 Jobs (Spike)", NumJobs: 15, WorkDuration: 90, WaitSec: 180},
+	{Name: "7 Jobs", NumJobs: 7, WorkDuration: 90, WaitSec: 180},
+}
+
+// loadScenario reads a JSON array of steps from path.
+func loadScenario(path string) ([]scenarioStep, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read scenario: %v", err)
+	}
+	var steps []scenarioStep
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("parse scenario %s: %v", path, err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("scenario %s has no steps", path)
+	}
+	for i, s := range steps {
+		if s.NumJobs == 0 {
+			return nil, fmt.Errorf("scenario %s step %d: numJobs must be positive", path, i+1)
+		}
+		if err := validateStep(s); err != nil {
+			return nil, fmt.Errorf("scenario %s step %d: %v", path, i+1, err)
+		}
+	}
+	return steps, nil
+}
+
+// validateStep checks the step's counts and durations. A step with no jobs
+// is valid here: replayed steps use it to let the metric go stale.
+func validateStep(s scenarioStep) error {
+	if s.NumJobs < 0 || s.WorkDuration < 0 || s.WaitSec < 0 {
+		return fmt.Errorf("numJobs and durations must be non-negative")
+	}
+	if s.OverlapSec < 0 || s.OverlapSec > s.WaitSec {
+		return fmt.Errorf("overlapSec must be between 0 and waitSec")
+	}
+	return nil
+}
+
+// sleepContext waits for d, or returns the context's error if it is
+// cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// runScenario runs the steps in order. Each step publishes its batch and then
+// waits for it to drain; with overlapSec the next step starts before that
+// wait is over, so batches overlap. Returns once every step's wait is over,
+// the first error, or when the context is cancelled.
+func runScenario(ctx context.Context, client *pubsub.Client, topicID string, steps []scenarioStep) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for i, step := range steps {
+		slog.Info(fmt.Sprintf("--- Scenario %d: %s ---", i+1, step.Name))
+		// Overlapping steps publish concurrently, so each shuffles from its
+		// own source. Seeding them here, in step order, keeps the run
+		// repeatable with -seed however the steps interleave.
+		var stepRand *rand.Rand
+		if *shuffle {
+			r, _ := runRand()
+			stepRand = rand.New(rand.NewSource(r.Int63()))
+		}
+		wg.Add(1)
+		go func(step scenarioStep) {
+			defer wg.Done()
+			if err := publishBatch(ctx, client, topicID, step.NumJobs, step.WorkDuration, stepRand); err != nil {
+				fail(err)
+				return
+			}
+			if err := sleepContext(ctx, time.Duration(step.WaitSec)*time.Second); err != nil {
+				fail(err)
+			}
+		}(step)
+
+		next := time.Duration(step.WaitSec-step.OverlapSec) * time.Second
+		if step.OverlapSec > 0 {
+			slog.Info("Starting the next step early (overlap)...", "after", next)
+		} else {
+			slog.Info("Waiting...", "wait", next)
+		}
+		if err := sleepContext(ctx, next); err != nil {
+			fail(err)
+			break
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// timelineWidth is the number of columns of the timeline bars.
+const timelineWidth = 60
+
+// writeTimeline prints the scenario as an ASCII Gantt chart: when each step
+// publishes ('|') and how long its batch gets to drain ('='), followed by
+// the DONE message. Start times follow the same waits and overlaps as
+// runScenario.
+func writeTimeline(w io.Writer, steps []scenarioStep) {
+	starts, end := stepStarts(steps)
+	if end == 0 {
+		end = 1
+	}
+	col := func(sec int) int { return sec * (timelineWidth - 1) / end }
+
+	names := make([]string, len(steps))
+	nameWidth := len("STEP")
+	for i, step := range steps {
+		names[i] = fmt.Sprintf("%d. %s", i+1, step.Name)
+		nameWidth = max(nameWidth, len(names[i]))
+	}
+
+	fmt.Fprintf(w, "%-*s %7s %7s  %s\n", nameWidth, "STEP", "START", "END", "TIMELINE (0s to "+formatSeconds(end)+")")
+	for i, step := range steps {
+		from, to := col(starts[i]), col(starts[i]+step.WaitSec)
+		bar := strings.Repeat(" ", from) + "|" + strings.Repeat("=", max(to-from-1, 0))
+		fmt.Fprintf(w, "%-*s %7s %7s  %s\n", nameWidth, names[i], formatSeconds(starts[i]), formatSeconds(starts[i]+step.WaitSec), bar)
+	}
+	fmt.Fprintf(w, "%-*s %7s %7s  %s\n", nameWidth, "DONE", formatSeconds(end), "", strings.Repeat(" ", col(end))+"|")
+}
+
+// stepStarts returns when each step starts, in seconds from the beginning of
+// the scenario, and when the last wait is over.
+func stepStarts(steps []scenarioStep) (starts []int, end int) {
+	starts = make([]int, len(steps))
+	at := 0
+	for i, step := range steps {
+		starts[i] = at
+		end = max(end, at+step.WaitSec)
+		at += step.WaitSec - step.OverlapSec
+	}
+	return starts, end
+}
+
+// formatSeconds formats sec as a duration like 2m30s.
+func formatSeconds(sec int) string {
+	return (time.Duration(sec) * time.Second).String()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// runRand is the source of every random choice of a run, seeded once from
+// -seed. The seed is logged, so passing it back with -seed repeats the run.
+var runRand = sync.OnceValues(func() (*rand.Rand, int64) {
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	slog.Info("Random choices use seed; pass -seed to repeat them.", "seed", seed)
+	return rand.New(rand.NewSource(seed)), seed
+})
+
+// shuffleOrder puts the message numbers in order into a random order drawn
+// from r.
+func shuffleOrder(r *rand.Rand, order []int) {
+	r.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// latencyStats summarizes a set of latency samples, in milliseconds.
+type latencyStats struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// computeLatencyStats returns the summary of samples. It sorts samples in
+// place.
+func computeLatencyStats(samples []time.Duration) latencyStats {
+	if len(samples) == 0 {
+		return latencyStats{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var total time.Duration
+	for _, s := range samples {
+		total += s
+	}
+	return latencyStats{
+		Count: len(samples),
+		Min:   toMillis(samples[0]),
+		Mean:  toMillis(total / time.Duration(len(samples))),
+		P50:   toMillis(percentile(samples, 50)),
+		P90:   toMillis(percentile(samples, 90)),
+		P99:   toMillis(percentile(samples, 99)),
+		Max:   toMillis(samples[len(samples)-1]),
+	}
+}
+
+// percentile returns the p-th percentile of sorted samples using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// watchedMetrics are the worker metrics watch shows, in order.
+var watchedMetrics = []struct{ name, label string }{
+	{"numJobs", "numJobs"},
+	{"average_num_jobs", "average numJobs"},
+	{"desired_replicas", "desired replicas"},
+	{"in_flight_jobs", "in flight"},
+	{"peak_outstanding_messages", "peak outstanding"},
+	{"jobs_processed_total", "processed"},
+	{"throughput_messages_per_minute", "throughput/min"},
+	{"worker_paused", "paused"},
+}
+
+// runWatch scrapes a worker's /metrics every interval and redraws a table of
+// the key values until ctx is cancelled. Failed scrapes are reported and
+// retried with a growing delay, so the worker can restart underneath.
+func runWatch(ctx context.Context, w io.Writer, url string, interval time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	delay := interval
+	failures := 0
+	for {
+		families, err := scrapeMetrics(ctx, client, url)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			failures++
+			delay = min(delay*2, 30*time.Second)
+			fmt.Fprintf(w, "%s  scrape failed (%d in a row), retrying in %s: %v\n", time.Now().Format(time.TimeOnly), failures, delay, err)
+		} else {
+			failures = 0
+			delay = interval
+			// Clear the screen so the table updates in place.
+			fmt.Fprint(w, "\033[H\033[2J")
+			writeWatch(w, url, families, time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// scrapeMetrics fetches and parses a Prometheus text exposition.
+func scrapeMetrics(ctx context.Context, client *http.Client, url string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Ask for the text format; the parser doesn't read protobuf.
+	req.Header.Set("Accept", "text/plain")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parse metrics: %v", err)
+	}
+	return families, nil
+}
+
+// writeWatch prints the watched metrics. Metrics with several series (e.g.
+// one per label value) are summed; missing ones print as "-".
+func writeWatch(w io.Writer, url string, families map[string]*dto.MetricFamily, now time.Time) {
+	fmt.Fprintf(w, "%s  %s\n\n", now.Format(time.TimeOnly), url)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, m := range watchedMetrics {
+		value := "-"
+		if f, ok := families[m.name]; ok {
+			value = fmt.Sprintf("%g", sumFamily(f))
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", m.label, value)
+	}
+	tw.Flush()
+}
+
+// sumFamily adds up the values of a gauge or counter family.
+func sumFamily(f *dto.MetricFamily) float64 {
+	sum := 0.0
+	for _, m := range f.GetMetric() {
+		switch {
+		case m.GetGauge() != nil:
+			sum += m.GetGauge().GetValue()
+		case m.GetCounter() != nil:
+			sum += m.GetCounter().GetValue()
+		case m.GetUntyped() != nil:
+			sum += m.GetUntyped().GetValue()
+		}
+	}
+	return sum
+}
+
+// metricsURL accepts a worker address like localhost:8080 and adds the
+// scheme and path if they are missing.
+func metricsURL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://"), "/") {
+		addr += "/metrics"
+	}
+	return addr
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	// Embed the time zone database, so ACTIVE_HOURS_TZ works in images
+	// without one.
+	_ "time/tzdata"
+)
+
+// activeWindow is the time of day the worker processes messages, e.g.
+// 09:00-17:00. An end before the start means the window spans midnight.
+type activeWindow struct {
+	start, end time.Duration // since midnight
+	loc        *time.Location
+}
+
+// parseActiveHours parses ACTIVE_HOURS, "HH:MM-HH:MM", in the IANA time zone
+// tz (the local time zone if empty).
+func parseActiveHours(value, tz string) (*activeWindow, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", value)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("window %q is empty", value)
+	}
+	loc := time.Local
+	if tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("time zone: %v", err)
+		}
+	}
+	return &activeWindow{start: start, end: end, loc: loc}, nil
+}
+
+// parseTimeOfDay parses "HH:MM" as the time since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t falls within the window.
+func (w *activeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return sinceMidnight >= w.start && sinceMidnight < w.end
+	}
+	return sinceMidnight >= w.start || sinceMidnight < w.end
+}
+
+// activeHoursGate pauses the worker outside its active window and resumes it
+// inside, simulating a business-hours workload.
+type activeHoursGate struct {
+	window *activeWindow
+	pauser *pauseController
+	state  *globalState
+	// now is time.Now outside of tests.
+	now func() time.Time
+	// pausedByWindow is set while the gate holds the pause, so it never
+	// resumes a worker that was paused through /pause.
+	pausedByWindow bool
+}
+
+// check pauses or resumes the worker for the current time. Closing the window
+// also drops numJobs to 0 (or MIN_NUM_JOBS), since this worker won't take on
+// any more work, which lets the HPA scale the deployment in overnight. In
+// "add" mode numJobs is left alone: it returns to 0 as the running jobs
+// finish, and resetting it now would drive it negative.
+func (g *activeHoursGate) check() {
+	active := g.window.contains(g.now())
+	switch {
+	case !active && !g.pausedByWindow:
+		if g.pauser.pause() {
+			g.pausedByWindow = true
+			if g.state.gaugeMode != gaugeModeAdd {
+				g.state.updateMetric(0)
+			}
+			slog.Info("Outside ACTIVE_HOURS, pausing: no new messages will be pulled.")
+		}
+	case active && g.pausedByWindow:
+		g.pausedByWindow = false
+		g.pauser.resume()
+		slog.Info("Within ACTIVE_HOURS, resuming.")
+	}
+}
+
+// run checks the window every interval until ctx is cancelled.
+func (g *activeHoursGate) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		g.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxAttributeLabelLength is the longest attribute value promoted to a
+	// label as-is. Longer values are almost always IDs, not categories.
+	maxAttributeLabelLength = 64
+	// otherLabelValue replaces values that were rejected for cardinality.
+	otherLabelValue = "other"
+)
+
+// labelNameRe matches valid Prometheus label names.
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// attributeLabels promotes an allowlist of message attributes to labels on
+// the message_attributes_info gauge. Cardinality is bounded twice: values
+// that are too long are replaced with "other", and once maxSeries distinct
+// label combinations have been seen, new combinations are recorded as
+// "other" as well.
+type attributeLabels struct {
+	names     []string
+	maxSeries int
+	info      *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// newAttributeLabels parses a comma-separated allowlist of attribute names.
+// It returns nil if the allowlist is empty.
+func newAttributeLabels(allowlist string, maxSeries int) (*attributeLabels, error) {
+	var names []string
+	for _, name := range strings.Split(allowlist, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// Names starting with __ are reserved for Prometheus itself.
+		if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%q is not a valid Prometheus label name", name)
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("duplicate attribute %q", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	return &attributeLabels{
+		names:     names,
+		maxSeries: maxSeries,
+		info: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "message_attributes_info",
+				Help: "Set to 1 for each combination of allowlisted message attributes seen.",
+			},
+			names,
+		),
+		seen: make(map[string]bool),
+	}, nil
+}
+
+// observe records the allowlisted attributes of a message.
+func (a *attributeLabels) observe(attrs map[string]string) {
+	values := make([]string, len(a.names))
+	for i, name := range a.names {
+		v := attrs[name]
+		if len(v) > maxAttributeLabelLength {
+			v = otherLabelValue
+		}
+		values[i] = v
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := strings.Join(values, "\x00")
+	if !a.seen[key] {
+		if len(a.seen) >= a.maxSeries {
+			for i := range values {
+				values[i] = otherLabelValue
+			}
+		} else {
+			a.seen[key] = true
+		}
+	}
+	a.info.WithLabelValues(values...).Set(1)
+}
+
+// contractAttributes are the attributes the worker reads, by their canonical
+// names. caseFoldedValue marks those whose values are case-insensitive.
+var contractAttributes = []struct {
+	name            string
+	caseFoldedValue bool
+}{
+	{"numJobs", false},
+	{"type", true},
+	{"expiresAt", false},
+	{requestIDAttr, false},
+	{"durationSec", false},
+	{poisonAttr, true},
+	// JOB_TYPES entries are matched exactly, so the value keeps its case.
+	{jobTypeAttr, false},
+}
+
+// normalizeAttributes returns attrs with the attributes the worker reads
+// tidied up for NORMALIZE_ATTRIBUTES: a key that matches one of them apart
+// from case and surrounding whitespace (like " NumJobs") is renamed to it,
+// values are trimmed, and the values of type and poison are lower-cased. A
+// key that is already canonical wins over its variants. Other attributes are
+// kept as they are.
+func normalizeAttributes(attrs map[string]string) map[string]string {
+	if len(attrs) == 0 {
+		return attrs
+	}
+	out := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		out[k] = v
+	}
+	for _, ca := range contractAttributes {
+		value, ok := attrs[ca.name]
+		if !ok {
+			for k, v := range attrs {
+				if strings.EqualFold(strings.TrimSpace(k), ca.name) {
+					value, ok = v, true
+					delete(out, k)
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if ca.caseFoldedValue {
+			value = strings.ToLower(value)
+		}
+		out[ca.name] = value
+	}
+	return out
+}
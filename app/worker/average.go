@@ -0,0 +1,58 @@
+package main
+
+import "time"
+
+// averageSamples is how many numJobs values a valueWindow keeps. Beyond that
+// the oldest are overwritten, shortening the effective window.
+const averageSamples = 4096
+
+// valueWindow keeps recent metric values in a ring buffer and averages those
+// reported within the window. It is guarded by globalState.mu.
+type valueWindow struct {
+	window  time.Duration
+	samples [averageSamples]struct {
+		at    time.Time
+		value float64
+	}
+	next  int // index the next sample is written to
+	count int // number of valid samples, at most averageSamples
+}
+
+func newValueWindow(window time.Duration) *valueWindow {
+	return &valueWindow{window: window}
+}
+
+// record adds value, reported at t.
+func (w *valueWindow) record(t time.Time, value float64) {
+	if w == nil {
+		return
+	}
+	w.samples[w.next].at = t
+	w.samples[w.next].value = value
+	w.next = (w.next + 1) % averageSamples
+	if w.count < averageSamples {
+		w.count++
+	}
+}
+
+// average returns the mean of the values reported within the window ending
+// at now, or 0 if there are none.
+func (w *valueWindow) average(now time.Time) float64 {
+	if w == nil {
+		return 0
+	}
+	since := now.Add(-w.window)
+	sum, n := 0.0, 0
+	for i := 1; i <= w.count; i++ {
+		s := w.samples[(w.next-i+averageSamples)%averageSamples]
+		if !s.at.After(since) {
+			break
+		}
+		sum += s.value
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// backlogMetric is the Cloud Monitoring metric holding a subscription's
+// number of unacknowledged messages.
+const backlogMetric = "pubsub.googleapis.com/subscription/num_undelivered_messages"
+
+// errNoBacklogData means Cloud Monitoring has no recent backlog sample for
+// the subscription, e.g. because it is brand new. That is not a backlog of 0.
+var errNoBacklogData = errors.New("no backlog data in Cloud Monitoring yet")
+
+// getBacklog returns the subscription's backlog as reported by Cloud
+// Monitoring, or errNoBacklogData. The metric is sampled once a minute, so
+// it lags the real backlog by a minute or two.
+func getBacklog(ctx context.Context, svc *monitoring.Service, projectID, subID string) (int64, error) {
+	now := time.Now()
+	resp, err := svc.Projects.TimeSeries.List("projects/" + projectID).
+		Filter(fmt.Sprintf(`metric.type="%s" AND resource.labels.subscription_id="%s"`, backlogMetric, subID)).
+		IntervalStartTime(now.Add(-5 * time.Minute).Format(time.RFC3339)).
+		IntervalEndTime(now.Format(time.RFC3339)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return 0, fmt.Errorf("TimeSeries.List: %v", err)
+	}
+	if len(resp.TimeSeries) == 0 || len(resp.TimeSeries[0].Points) == 0 {
+		return 0, errNoBacklogData
+	}
+
+	// Points are returned newest first.
+	value := resp.TimeSeries[0].Points[0].Value
+	if value == nil || value.Int64Value == nil {
+		return 0, errNoBacklogData
+	}
+	return *value.Int64Value, nil
+}
+
+// pollBacklog reads the subscription's backlog from Cloud Monitoring every
+// interval and exports it next to its divergence from the publisher-supplied
+// numJobs. A large divergence means the reported count has drifted from
+// reality, e.g. through duplicates or lost messages.
+func (s *globalState) pollBacklog(ctx context.Context, projectID, subID string, interval time.Duration) {
+	svc, err := monitoring.NewService(ctx)
+	if err != nil {
+		slog.Error("Backlog polling disabled", "err", fmt.Errorf("monitoring.NewService: %v", err))
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		backlog, err := getBacklog(ctx, svc, projectID, subID)
+		switch {
+		case errors.Is(err, errNoBacklogData):
+			// Leave a gap rather than report an empty queue.
+			subscriptionBacklog.Set(math.NaN())
+			metricBacklogDivergence.Set(math.NaN())
+			slog.Info("Polled backlog: no data yet")
+		case err != nil:
+			slog.Warn("Could not read backlog", "err", err)
+		default:
+			reported := s.snapshot().NumJobs
+			subscriptionBacklog.Set(float64(backlog))
+			metricBacklogDivergence.Set(reported - float64(backlog))
+			slog.Debug("Polled backlog", "backlog", backlog, "numJobs", reported)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// canaryType is the type attribute of startup canary messages.
+const canaryType = "canary"
+
+// canaryMaxAge is how long a canary is passed back for its own worker to
+// receive. Older canaries belong to a worker that gave up (or died) and are
+// acked by whoever receives them.
+const canaryMaxAge = time.Minute
+
+// errCanaryNoPublish means the worker may not publish to the topic, so the
+// canary can't run at all.
+var errCanaryNoPublish = errors.New("no permission to publish the canary")
+
+// canaryWatch is this worker's startup canary. It is published to TOPIC_ID
+// while jobs are processed as usual, and the handler recognizes it when it
+// comes back through the subscription. Until then the worker reports not
+// ready, however long a backlog delays it, and nothing is nacked on its
+// account.
+type canaryWatch struct {
+	id string
+	// received gets the result of checking the canary when it arrives.
+	received chan error
+}
+
+func newCanaryWatch(id string) *canaryWatch {
+	return &canaryWatch{id: id, received: make(chan error, 1)}
+}
+
+// owns reports whether msg is this worker's canary.
+func (c *canaryWatch) owns(msg *pubsub.Message) bool {
+	return c != nil && msg.Attributes[requestIDAttr] == c.id
+}
+
+// deliver reports a received canary to run. Copies beyond the first that
+// run hasn't picked up yet are dropped.
+func (c *canaryWatch) deliver(msg *pubsub.Message) {
+	select {
+	case c.received <- checkCanary(msg):
+	default:
+	}
+}
+
+// run publishes the canary to topic and waits up to timeout for it, again
+// after every timeout, until it arrives intact. It then marks the worker
+// ready. If the worker may not publish to the topic, the check is skipped.
+func (c *canaryWatch) run(ctx context.Context, topic *pubsub.Topic, timeout time.Duration, ready *readiness) {
+	for {
+		start := time.Now()
+		err := publishCanary(ctx, topic, c.id)
+		switch {
+		case errors.Is(err, errCanaryNoPublish):
+			slog.Warn("Worker may not publish to the topic, skipping the startup canary", "topic", topic.ID())
+			ready.ready.Store(true)
+			return
+		case err != nil && ctx.Err() == nil:
+			slog.Warn("Could not publish the startup canary, trying again", "err", err, "retryIn", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-c.received:
+			if err == nil {
+				slog.Info("Startup canary received.", "roundTrip", time.Since(start).Round(time.Millisecond))
+				startupCanarySuccess.Set(1)
+				ready.ready.Store(true)
+				return
+			}
+			slog.Error("Startup canary arrived damaged, staying unready", "err", err)
+		case <-time.After(timeout):
+			slog.Warn("Startup canary not received yet, staying unready and publishing another. Is the subscription attached to the topic, and does its filter let the canary through?", "timeout", timeout)
+		}
+	}
+}
+
+// publishCanary publishes a canary addressed to id on topic.
+func publishCanary(ctx context.Context, topic *pubsub.Topic, id string) error {
+	_, err := topic.Publish(ctx, &pubsub.Message{
+		Data: []byte(canaryType),
+		Attributes: map[string]string{
+			"numJobs":     "0",
+			"type":        canaryType,
+			requestIDAttr: id,
+		},
+	}).Get(ctx)
+	if status.Code(err) == codes.PermissionDenied {
+		return errCanaryNoPublish
+	}
+	if err != nil {
+		return fmt.Errorf("publish canary: %v", err)
+	}
+	return nil
+}
+
+// checkCanary checks that a received canary still carries the attributes
+// that real jobs depend on.
+func checkCanary(msg *pubsub.Message) error {
+	if string(msg.Data) != canaryType {
+		return fmt.Errorf("canary body is %q, want %q", msg.Data, canaryType)
+	}
+	if _, err := strconv.ParseFloat(msg.Attributes["numJobs"], 64); err != nil {
+		return fmt.Errorf("canary lost its numJobs attribute: %v", err)
+	}
+	return nil
+}
+
+// handleCanary disposes of another worker's canary. A fresh one goes back
+// for the worker that sent it; a stale one is dropped, and its worker
+// publishes another.
+func handleCanary(msg *pubsub.Message, now time.Time) {
+	if now.Sub(msg.PublishTime) < canaryMaxAge {
+		msg.Nack()
+		return
+	}
+	msg.Ack()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// concurrencyAverage is a time-weighted exponential moving average of the
+// number of jobs in flight. Each count is weighted by how long it lasted, so
+// a burst of short jobs counts for less than one long job. It is guarded by
+// globalState.mu.
+type concurrencyAverage struct {
+	window  time.Duration
+	average float64
+	current int       // jobs in flight since last
+	last    time.Time // when current last changed
+}
+
+func newConcurrencyAverage(window time.Duration) *concurrencyAverage {
+	return &concurrencyAverage{window: window}
+}
+
+// observe records that inFlight jobs are in flight as of now.
+func (c *concurrencyAverage) observe(now time.Time, inFlight int) {
+	if c == nil {
+		return
+	}
+	c.average = c.at(now)
+	c.current = inFlight
+	c.last = now
+}
+
+// at returns the average as of now, assuming the count hasn't changed since
+// the last observation.
+func (c *concurrencyAverage) at(now time.Time) float64 {
+	if c == nil || c.last.IsZero() {
+		return 0
+	}
+	dt := now.Sub(c.last)
+	if dt <= 0 {
+		return c.average
+	}
+	alpha := 1 - math.Exp(-float64(dt)/float64(c.window))
+	return c.average + alpha*(float64(c.current)-c.average)
+}
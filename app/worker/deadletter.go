@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Failure reasons, for DLQ_REASONS and the reason label of
+// dead_lettered_total.
+const (
+	// failurePoison is a poison message in TEST_MODE.
+	failurePoison = "poison"
+	// failureRepublish is a failed republish in LOOP_MODE.
+	failureRepublish = "republish"
+)
+
+// jobFailure describes why processing a message failed.
+type jobFailure struct {
+	reason string
+	err    error
+	// attempt is the message's delivery attempt, or 0 if unknown: Pub/Sub
+	// only counts attempts on subscriptions with a dead-letter policy.
+	attempt int
+}
+
+func newJobFailure(msg *pubsub.Message, reason string, err error) jobFailure {
+	f := jobFailure{reason: reason, err: err}
+	if msg.DeliveryAttempt != nil {
+		f.attempt = *msg.DeliveryAttempt
+	}
+	return f
+}
+
+// deadLetterRule holds the settings a deadLetterPolicy decides by.
+type deadLetterRule struct {
+	// maxAttempts routes a message failing on this delivery attempt or
+	// later.
+	maxAttempts int
+	// reasons routes a message failing for one of these reasons right away.
+	reasons map[string]bool
+}
+
+// deadLetterPolicy decides whether a failed message goes to the dead-letter
+// topic instead of being nacked for another attempt.
+type deadLetterPolicy func(rule deadLetterRule, f jobFailure) bool
+
+// deadLetterPolicies maps each DLQ_POLICY value to its decision. "either"
+// combines the other two.
+var deadLetterPolicies = map[string]deadLetterPolicy{
+	"attempts": routeOnAttempts,
+	"reason":   routeOnReason,
+	"either": func(rule deadLetterRule, f jobFailure) bool {
+		return routeOnReason(rule, f) || routeOnAttempts(rule, f)
+	},
+}
+
+// routeOnAttempts routes messages that used up rule.maxAttempts deliveries.
+func routeOnAttempts(rule deadLetterRule, f jobFailure) bool {
+	return f.attempt > 0 && rule.maxAttempts > 0 && f.attempt >= rule.maxAttempts
+}
+
+// routeOnReason routes messages failing for one of rule.reasons, which will
+// fail again however often they are retried.
+func routeOnReason(rule deadLetterRule, f jobFailure) bool {
+	return rule.reasons[f.reason]
+}
+
+// lookupDeadLetterPolicy returns the policy registered as name.
+func lookupDeadLetterPolicy(name string) (deadLetterPolicy, error) {
+	return lookupNamed(deadLetterPolicies, "dead-letter policy", name)
+}
+
+// parseFailureReasons parses DLQ_REASONS, a comma-separated list.
+func parseFailureReasons(value string) map[string]bool {
+	reasons := map[string]bool{}
+	for _, r := range strings.Split(value, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			reasons[r] = true
+		}
+	}
+	return reasons
+}
+
+// deadLetterRouter republishes failed messages to a dead-letter topic when
+// its policy says so. Unlike the subscription's dead-letter policy, which
+// only counts attempts, it can act on why a message failed.
+type deadLetterRouter struct {
+	topic  *pubsub.Topic
+	subID  string
+	policy deadLetterPolicy
+	rule   deadLetterRule
+}
+
+// shouldRoute reports whether f sends its message to the dead-letter topic.
+// A nil router routes nothing.
+func (d *deadLetterRouter) shouldRoute(f jobFailure) bool {
+	return d != nil && d.policy(d.rule, f)
+}
+
+// route publishes a copy of msg with the failure recorded in its
+// attributes, and waits until it is stored.
+func (d *deadLetterRouter) route(ctx context.Context, msg *pubsub.Message, f jobFailure) error {
+	attrs := make(map[string]string, len(msg.Attributes)+5)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs["deadLetterReason"] = f.reason
+	if f.err != nil {
+		attrs["deadLetterError"] = f.err.Error()
+	}
+	if f.attempt > 0 {
+		attrs["deliveryAttempt"] = strconv.Itoa(f.attempt)
+	}
+	attrs["deadLetterSubscription"] = d.subID
+	attrs["deadLetteredAt"] = time.Now().UTC().Format(time.RFC3339)
+	if _, err := d.topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attrs}).Get(ctx); err != nil {
+		return fmt.Errorf("publish to dead-letter topic: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deliveryState is what a dedupeStore knows about a message ID.
+type deliveryState int
+
+const (
+	// deliveryNew means no other delivery is known: process the message.
+	deliveryNew deliveryState = iota
+	// deliveryInProgress means another delivery is being processed. It may
+	// still fail, or its pod may die, so the duplicate is handed back
+	// rather than acked.
+	deliveryInProgress
+	// deliveryDone means the message was processed and acked within the
+	// window, so the duplicate can be acked without work.
+	deliveryDone
+)
+
+// dedupeStore remembers which message IDs were processed within a window, so
+// a duplicate delivery can be acked without doing the job twice. An ID is
+// only marked done once its message is acked: until then it is claimed for
+// a short while, so a job lost with its pod is processed again.
+type dedupeStore interface {
+	// claim marks id as in progress unless it is already known, and
+	// returns what was known about it before.
+	claim(ctx context.Context, id string) (deliveryState, error)
+	// complete marks id as done for the window, once its message is acked.
+	complete(ctx context.Context, id string) error
+	// forget drops id, so a message handed back with a nack is processed
+	// when it is redelivered.
+	forget(ctx context.Context, id string) error
+}
+
+// dedupeClaimMargin is added to JOB_DURATION_SEC for how long a delivery
+// stays claimed, for jobs that run a little long.
+const dedupeClaimMargin = 30 * time.Second
+
+// memoryDedupe is a dedupeStore for a single pod. Duplicates delivered to
+// other pods go unnoticed; use redisDedupe for those.
+type memoryDedupe struct {
+	mu sync.Mutex
+	// window is how long a done ID is remembered, inProgress how long a
+	// claim lasts.
+	window     time.Duration
+	inProgress time.Duration
+	seen       map[string]memoryDelivery
+	lastSweep  time.Time
+	now        func() time.Time
+}
+
+type memoryDelivery struct {
+	state   deliveryState
+	expires time.Time
+}
+
+func newMemoryDedupe(window, inProgress time.Duration) *memoryDedupe {
+	return &memoryDedupe{window: window, inProgress: inProgress, seen: map[string]memoryDelivery{}, now: time.Now}
+}
+
+func (m *memoryDedupe) claim(_ context.Context, id string) (deliveryState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	// Drop expired IDs once per window, so the map holds about one
+	// window's worth of messages.
+	if now.Sub(m.lastSweep) >= m.window {
+		for k, d := range m.seen {
+			if !now.Before(d.expires) {
+				delete(m.seen, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	if d, ok := m.seen[id]; ok && now.Before(d.expires) {
+		return d.state, nil
+	}
+	m.seen[id] = memoryDelivery{state: deliveryInProgress, expires: now.Add(m.inProgress)}
+	return deliveryNew, nil
+}
+
+func (m *memoryDedupe) complete(_ context.Context, id string) error {
+	m.mu.Lock()
+	m.seen[id] = memoryDelivery{state: deliveryDone, expires: m.now().Add(m.window)}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryDedupe) forget(_ context.Context, id string) error {
+	m.mu.Lock()
+	delete(m.seen, id)
+	m.mu.Unlock()
+	return nil
+}
+
+// redisTimeout bounds connecting to Redis and each command, so an
+// unreachable Redis delays messages briefly instead of stalling them.
+const redisTimeout = 2 * time.Second
+
+// redisDedupe is a dedupeStore shared by every pod through Redis, so
+// duplicates delivered to different pods are caught too. Each ID is a key
+// claimed with SET NX, holding "processing" for the in-progress TTL, then
+// "done" for the window.
+type redisDedupe struct {
+	client     *redis.Client
+	prefix     string
+	window     time.Duration
+	inProgress time.Duration
+}
+
+// Values of redisDedupe's keys.
+const (
+	redisInProgress = "processing"
+	redisDone       = "done"
+)
+
+// newRedisDedupe connects to the Redis at addr, either host:port or a URL:
+// redis://[:password@]host:port[/db], or rediss:// for TLS, as Memorystore
+// requires with AUTH and in-transit encryption. caFile, if set, is a PEM file
+// of the CA that signed the server's certificate, such as Memorystore's
+// server CA.
+func newRedisDedupe(addr, caFile, prefix string, window, inProgress time.Duration) (*redisDedupe, error) {
+	opts := &redis.Options{Addr: addr}
+	if strings.Contains(addr, "://") {
+		var err error
+		if opts, err = redis.ParseURL(addr); err != nil {
+			return nil, fmt.Errorf("invalid Redis URL: %v", err)
+		}
+	}
+	if caFile != "" {
+		if opts.TLSConfig == nil {
+			return nil, fmt.Errorf("a CA file needs a rediss:// URL")
+		}
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", caFile)
+		}
+		opts.TLSConfig.RootCAs = roots
+	}
+	opts.DialTimeout = redisTimeout
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+	return &redisDedupe{client: redis.NewClient(opts), prefix: prefix, window: window, inProgress: inProgress}, nil
+}
+
+func (d *redisDedupe) claim(ctx context.Context, id string) (deliveryState, error) {
+	claimed, err := d.client.SetNX(ctx, d.prefix+id, redisInProgress, d.inProgress).Result()
+	if err != nil {
+		return deliveryNew, fmt.Errorf("redis SET: %v", err)
+	}
+	if claimed {
+		return deliveryNew, nil
+	}
+	value, err := d.client.Get(ctx, d.prefix+id).Result()
+	switch {
+	case err == redis.Nil:
+		// The key expired in between. Treat it as in progress: the
+		// redelivery that follows will claim it.
+		return deliveryInProgress, nil
+	case err != nil:
+		return deliveryNew, fmt.Errorf("redis GET: %v", err)
+	case value == redisDone:
+		return deliveryDone, nil
+	}
+	return deliveryInProgress, nil
+}
+
+func (d *redisDedupe) complete(ctx context.Context, id string) error {
+	if err := d.client.Set(ctx, d.prefix+id, redisDone, d.window).Err(); err != nil {
+		return fmt.Errorf("redis SET: %v", err)
+	}
+	return nil
+}
+
+func (d *redisDedupe) forget(ctx context.Context, id string) error {
+	if err := d.client.Del(ctx, d.prefix+id).Err(); err != nil {
+		return fmt.Errorf("redis DEL: %v", err)
+	}
+	return nil
+}
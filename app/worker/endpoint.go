@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"google.golang.org/api/option"
+)
+
+// pubsubClientOptions returns the options for the Pub/Sub client. If
+// PUBSUB_ENDPOINT is set, the client talks to that endpoint instead of the
+// global one, e.g. us-east1-pubsub.googleapis.com:443 to keep messages in a
+// region.
+func pubsubClientOptions() ([]option.ClientOption, error) {
+	endpoint := os.Getenv("PUBSUB_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+	if err := validateEndpoint(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid PUBSUB_ENDPOINT %q: %v", endpoint, err)
+	}
+	return []option.ClientOption{option.WithEndpoint(endpoint)}, nil
+}
+
+// validateEndpoint checks that endpoint is a host:port pair. A URL such as
+// https://pubsub.googleapis.com is a common mistake that the client would
+// only reject on the first call.
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("expected host:port: %v", err)
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
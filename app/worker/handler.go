@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// doneMessage is the body of the sentinel the publisher sends when a run
+// is over (with numJobs=0).
+const doneMessage = "DONE"
+
+// messageHandler processes messages received from the subscription.
+type messageHandler struct {
+	state       *globalState
+	jobDuration time.Duration
+	// defaultNumJobs is used when a message's numJobs attribute is missing
+	// or invalid.
+	defaultNumJobs float64
+	// work runs a job and returns early if its context is cancelled. It is
+	// the WORK_FUNC from workFuncs outside of tests.
+	work workFunc
+	// lifetime is cancelled when the worker shuts down, which aborts the
+	// job in progress. Pausing doesn't cancel it, so jobs still finish.
+	// Nil means the job always runs to completion.
+	lifetime   context.Context
+	attrLabels *attributeLabels
+	// loopTopic is set in LOOP_MODE, where processed messages are
+	// republished to keep the backlog full.
+	loopTopic *pubsub.Topic
+	// resultsTopic, if set, receives a result message after each job.
+	resultsTopic *pubsub.Topic
+	// exactlyOnce confirms every ack, as required on subscriptions with
+	// exactly-once delivery.
+	exactlyOnce bool
+	// logSample limits how many messages are logged at info level. Errors
+	// are always logged.
+	logSample *logSampler
+	// testMode honors the poison attribute, so dead-letter routing can be
+	// demonstrated with messages that always fail.
+	testMode bool
+	// pressure, if set, defers jobs while memory or disk is short.
+	pressure *pressureGate
+	// ordered, if set, acks messages with the same ordering key in the
+	// order they were received (ORDERED_DRAIN).
+	ordered *orderedAcks
+	// normalizeAttrs tolerates attribute keys and values that differ from
+	// the contract in case or whitespace. Parsing is strict without it.
+	normalizeAttrs bool
+	// deadLetter, if set, routes failed messages to a dead-letter topic
+	// instead of nacking them, depending on why they failed.
+	deadLetter *deadLetterRouter
+	// dedupe, if set, remembers delivered message IDs so duplicates are
+	// acked without running the job again.
+	dedupe dedupeStore
+	// leases, if set, counts messages whose lease ran out while they were
+	// processed.
+	leases *leaseTracker
+	// canary, if set, is this worker's STARTUP_CANARY, waiting to be
+	// received.
+	canary *canaryWatch
+	// jobTypes is the JOB_TYPES allowlist for the jobType label of
+	// job_processing_duration_seconds.
+	jobTypes jobTypes
+}
+
+// poisonAttr marks a message that always fails processing in TEST_MODE.
+const poisonAttr = "poison"
+
+// observePullDelay records how long msg waited between publish and its first
+// pull. Redeliveries are skipped when the attempt is known, since their delay
+// includes earlier processing. Clock skew between the publisher and the worker
+// can make the delay negative, which is recorded as 0.
+func observePullDelay(msg *pubsub.Message, now time.Time) {
+	if msg.PublishTime.IsZero() || msg.DeliveryAttempt != nil && *msg.DeliveryAttempt > 1 {
+		return
+	}
+	pullDelay.Observe(max(now.Sub(msg.PublishTime), 0).Seconds())
+}
+
+// handleMessage is the Receive callback. It updates the metric from the
+// message's numJobs attribute, does the work, and acks.
+func (h *messageHandler) handleMessage(ctx context.Context, msg *pubsub.Message) {
+	observePullDelay(msg, time.Now())
+	if h.normalizeAttrs {
+		msg.Attributes = normalizeAttributes(msg.Attributes)
+	}
+	// Every log line for this message carries its request ID. Messages
+	// without one get a fresh ID, which is also passed on to the results and
+	// loop topics.
+	if msg.Attributes[requestIDAttr] == "" {
+		if msg.Attributes == nil {
+			msg.Attributes = map[string]string{}
+		}
+		msg.Attributes[requestIDAttr] = newRequestID()
+	}
+	reqID := msg.Attributes[requestIDAttr]
+	log := slog.With("requestId", reqID)
+	// From here on, every path acks or nacks through h.ack or h.nack, which
+	// keeps ordered messages in order.
+	h.ordered.register(msg)
+
+	log.Debug("Received message!", "id", msg.ID)
+	// DeliveryAttempt is nil unless the subscription has a dead-letter
+	// policy.
+	if msg.DeliveryAttempt != nil {
+		deliveryAttempts.Observe(float64(*msg.DeliveryAttempt))
+	}
+	release := h.trackLease(msg, log)
+	defer release()
+	// Canaries are meant for the worker that is starting up and sent them.
+	// They skip deduplication: the one passed on here is redelivered on
+	// purpose, and must not be acked as a duplicate before its owner gets
+	// it.
+	if msg.Attributes["type"] == canaryType {
+		if h.canary.owns(msg) {
+			log.Debug("Own canary received.")
+			h.canary.deliver(msg)
+			msg.Ack()
+			return
+		}
+		log.Debug("Another worker's canary, passing it on.")
+		handleCanary(msg, time.Now())
+		return
+	}
+	// A message already processed within the dedupe window (by any pod,
+	// with Redis) is acked without work. One still being processed is
+	// handed back: that delivery may yet fail. If the store is unreachable
+	// the message is processed anyway: doing a job twice beats losing it.
+	if h.dedupe != nil {
+		state, err := h.dedupe.claim(ctx, msg.ID)
+		switch {
+		case err != nil:
+			log.Warn("Dedupe store unavailable, processing anyway.", "id", msg.ID, "err", err)
+		case state == deliveryDone:
+			log.Info("Duplicate delivery, acking without work.", "id", msg.ID)
+			duplicateMessages.Inc()
+			h.settleDuplicate(ctx, msg, log, true)
+			return
+		case state == deliveryInProgress:
+			log.Info("Duplicate of a message still being processed, nacking.", "id", msg.ID)
+			h.settleDuplicate(ctx, msg, log, false)
+			return
+		}
+	}
+	h.state.messageStarted()
+	defer h.state.messageFinished()
+
+	// Time-sensitive jobs carry an expiresAt attribute. Stale work is
+	// dropped (acked) rather than processed.
+	logged := h.logSample.sampled(msg.ID)
+
+	if expired, expiresAt := isExpired(msg.Attributes, time.Now()); expired {
+		if logged {
+			log.Info("Message expired, acking without work.", "expiresAt", expiresAt)
+		}
+		expiredMessages.Inc()
+		h.publishResult(ctx, msg, outcomeExpired, 0)
+		h.ack(ctx, msg, log)
+		return
+	}
+
+	// The DONE sentinel means the run is over: drop the metric to 0 right
+	// away so the HPA can scale down, and don't treat it as a job.
+	if string(msg.Data) == doneMessage {
+		log.Info("DONE message, setting numJobs metric to 0 and acking without work.")
+		if h.state.gaugeMode != gaugeModeAdd {
+			h.state.updateMetric(0)
+		}
+		h.ack(ctx, msg, log)
+		return
+	}
+
+	// Bench messages only measure publish throughput. Ack them right away
+	// without touching the metric.
+	if msg.Attributes["type"] == "bench" {
+		h.ack(ctx, msg, log)
+		return
+	}
+
+	// 1. Parse the "numJobs" attribute from the message
+	jobValStr := msg.Attributes["numJobs"]
+	jobVal, err := strconv.ParseFloat(jobValStr, 64)
+	if err != nil {
+		log.Warn("'numJobs' attribute missing or invalid, using the default", "err", err, "default", h.defaultNumJobs)
+		invalidNumJobs.Inc()
+		jobVal = h.defaultNumJobs
+	}
+
+	h.state.observeNumJobs(jobVal)
+	if h.attrLabels != nil {
+		h.attrLabels.observe(msg.Attributes)
+	}
+
+	// 2. Update global state and metric
+	if h.state.gaugeMode == gaugeModeAdd {
+		h.state.addMetric(jobVal)
+		defer h.state.addMetric(-jobVal)
+		log.Debug("Added to numJobs metric", "value", jobVal)
+	} else {
+		h.state.updateMetric(jobVal)
+		log.Debug("Set numJobs metric", "value", jobVal)
+	}
+
+	// Keepalive messages only exist to refresh the metric and keep a
+	// minimum number of pods warm, so there is no work to do.
+	if msg.Attributes["type"] == "keepalive" {
+		log.Debug("Keepalive message, acking without work.")
+		h.ack(ctx, msg, log)
+		return
+	}
+
+	// Poison messages fail every delivery, so they end up in the
+	// subscription's dead-letter topic once its max delivery attempts are
+	// used up, or in DLQ_TOPIC_ID as its policy decides.
+	if h.testMode && msg.Attributes[poisonAttr] == "true" {
+		log.Warn("Poison message.", "id", msg.ID)
+		err := fmt.Errorf("poison message %s", msg.ID)
+		h.state.recordError(err)
+		poisonMessages.Inc()
+		h.publishResult(ctx, msg, outcomeFailed, 0)
+		h.fail(ctx, msg, log, newJobFailure(msg, failurePoison, err))
+		return
+	}
+
+	// Under memory or disk pressure, hand the job back for later (or for
+	// another pod) rather than risk an OOM kill mid-job.
+	if resource, detail := h.pressure.exceeded(); resource != "" {
+		log.Warn("Resource pressure, nacking.", "resource", resource, "detail", detail)
+		pressureRejections.WithLabelValues(resource).Inc()
+		h.nack(msg)
+		return
+	}
+
+	// 3. Simulate the long-running, low-CPU work
+	duration := jobDuration(msg.Attributes, h.jobDuration)
+	if logged {
+		log.Info("Starting work...", "numJobs", jobVal, "duration", duration)
+	}
+	start := time.Now()
+	h.state.jobStarted(activeJob{RequestID: reqID, MessageID: msg.ID, NumJobs: jobVal, StartedAt: start})
+	workCtx := h.lifetime
+	if workCtx == nil {
+		workCtx = context.Background()
+	}
+	h.work(workCtx, duration)
+	h.state.jobFinished(msg.ID)
+	elapsed := time.Since(start)
+
+	// A job cut short by shutdown isn't done: nack it so another worker
+	// picks it up.
+	if workCtx.Err() != nil {
+		log.Info("Work aborted by shutdown, nacking.", "elapsed", elapsed)
+		droppedOnShutdown.Inc()
+		h.nack(msg)
+		return
+	}
+	h.state.jobCompleted()
+	log.Debug("Work finished.")
+	// Receive cancels ctx on shutdown and pause while the job runs on
+	// h.lifetime, so the publishes and the ack that settle a finished job
+	// don't depend on it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), settleTimeout)
+	defer cancel()
+
+	// In loop mode, put the message back on the topic before acking so
+	// the backlog never drains. If that fails, nack so it is redelivered.
+	if h.loopTopic != nil {
+		if _, err := h.loopTopic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: msg.Attributes}).Get(ctx); err != nil {
+			log.Error("Failed to republish message", "err", err)
+			err = fmt.Errorf("republish message %s: %v", msg.ID, err)
+			h.state.recordError(err)
+			h.publishResult(ctx, msg, outcomeFailed, elapsed)
+			h.fail(ctx, msg, log, newJobFailure(msg, failureRepublish, err))
+			return
+		}
+		republishedMessages.Inc()
+	}
+
+	// Only jobs that completed count towards their type's latency.
+	jobProcessingDuration.WithLabelValues(h.jobTypes.label(msg.Attributes)).Observe(elapsed.Seconds())
+	h.state.recordOutcome(true)
+	h.publishResult(ctx, msg, outcomeSuccess, elapsed)
+
+	// 4. Acknowledge the message
+	// This tells Pub/Sub we are done, and the client is free
+	// to pull the next message (respecting MaxOutstandingMessages=1).
+	h.ack(ctx, msg, log)
+}
+
+// settleTimeout bounds the publishes and the ack that follow a finished
+// job, which are no longer cancelled with the message's context.
+const settleTimeout = 30 * time.Second
+
+// ackConfirmTimeout bounds the extra wait for an ack result when the
+// message's context is cancelled before the result arrives.
+const ackConfirmTimeout = 10 * time.Second
+
+// ack acknowledges msg, once the messages received before it with the same
+// ordering key are settled if ORDERED_DRAIN is on. If one of those was
+// nacked, msg is nacked instead.
+func (h *messageHandler) ack(ctx context.Context, msg *pubsub.Message, log *slog.Logger) {
+	h.ordered.finish(msg, true, func(ack bool) {
+		if !ack {
+			log.Info("An earlier message with the same ordering key was nacked, nacking too.", "id", msg.ID)
+			h.forgetDelivery(msg)
+			msg.Nack()
+			return
+		}
+		// A failed ack means a redelivery, which has to be processed.
+		if h.confirmAck(ctx, msg, log) {
+			h.completeDelivery(msg)
+		} else {
+			h.forgetDelivery(msg)
+		}
+	})
+}
+
+// settleDuplicate acks or nacks a duplicate delivery, in order with
+// ORDERED_DRAIN, leaving the dedupe store's record of the delivery it
+// duplicates alone.
+func (h *messageHandler) settleDuplicate(ctx context.Context, msg *pubsub.Message, log *slog.Logger, ack bool) {
+	h.ordered.finish(msg, ack, func(ack bool) {
+		if !ack {
+			msg.Nack()
+			return
+		}
+		h.confirmAck(ctx, msg, log)
+	})
+}
+
+// fail counts a message whose processing failed and settles it: it is
+// routed to the dead-letter topic and acked if DLQ_TOPIC_ID's policy says
+// so, and nacked for another attempt otherwise or if routing fails.
+func (h *messageHandler) fail(ctx context.Context, msg *pubsub.Message, log *slog.Logger, f jobFailure) {
+	h.state.recordOutcome(false)
+	if !h.deadLetter.shouldRoute(f) {
+		h.nack(msg)
+		return
+	}
+	if err := h.deadLetter.route(ctx, msg, f); err != nil {
+		log.Error("Failed to route message to the dead-letter topic, nacking", "id", msg.ID, "err", err)
+		h.state.recordError(fmt.Errorf("dead-letter message %s: %v", msg.ID, err))
+		h.nack(msg)
+		return
+	}
+	log.Warn("Routed failed message to the dead-letter topic, acking.", "id", msg.ID, "reason", f.reason, "attempt", f.attempt)
+	deadLettered.WithLabelValues(f.reason).Inc()
+	h.ack(ctx, msg, log)
+}
+
+// nack nacks msg, in order with ORDERED_DRAIN.
+func (h *messageHandler) nack(msg *pubsub.Message) {
+	h.ordered.finish(msg, false, func(bool) {
+		h.forgetDelivery(msg)
+		msg.Nack()
+	})
+}
+
+// completeDelivery marks an acked message as done in the dedupe store, so
+// its duplicates within the window are acked without work.
+func (h *messageHandler) completeDelivery(msg *pubsub.Message) {
+	if h.dedupe == nil {
+		return
+	}
+	if err := h.dedupe.complete(context.Background(), msg.ID); err != nil {
+		slog.Warn("Could not mark acked message as done in the dedupe store, a duplicate may be processed again", "id", msg.ID, "err", err)
+	}
+}
+
+// forgetDelivery removes a nacked message from the dedupe store, so its
+// redelivery is processed rather than taken for a duplicate.
+func (h *messageHandler) forgetDelivery(msg *pubsub.Message) {
+	if h.dedupe == nil {
+		return
+	}
+	if err := h.dedupe.forget(context.Background(), msg.ID); err != nil {
+		slog.Warn("Could not remove nacked message from the dedupe store, its redelivery is handed back until the claim expires", "id", msg.ID, "err", err)
+	}
+}
+
+// confirmAck acks msg. With exactly-once delivery an ack can fail (for
+// example when the lease already expired), so the result is checked and
+// failures are counted in ack_errors_total. The client retries transient
+// errors itself and acking the same message again is a no-op, so the only
+// retry left to us is waiting for the result again if our context was
+// cancelled first (typically at shutdown). Anything else means the message
+// will be redelivered. Without exactly-once the ack is fire-and-forget: the
+// client reports no errors. confirmAck returns false if the ack failed.
+func (h *messageHandler) confirmAck(ctx context.Context, msg *pubsub.Message, log *slog.Logger) bool {
+	if !h.exactlyOnce {
+		msg.Ack()
+		return true
+	}
+	result := msg.AckWithResult()
+	status, err := result.Get(ctx)
+	if err != nil && ctx.Err() != nil {
+		log.Debug("Context cancelled before the ack was confirmed, waiting again", "id", msg.ID)
+		waitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ackConfirmTimeout)
+		status, err = result.Get(waitCtx)
+		cancel()
+	}
+	if err != nil || status != pubsub.AcknowledgeStatusSuccess {
+		reason := ackFailureReason(status, err)
+		log.Error("Ack failed, the message will be redelivered", "id", msg.ID, "reason", reason, "err", err)
+		ackErrors.WithLabelValues(reason).Inc()
+		if err == nil {
+			err = fmt.Errorf("%s", reason)
+		}
+		h.state.recordError(fmt.Errorf("ack message %s: %v", msg.ID, err))
+		return false
+	}
+	log.Debug("Ack confirmed", "id", msg.ID)
+	return true
+}
+
+// ackFailureReason names why an ack failed, for the reason label of
+// ack_errors_total.
+func ackFailureReason(status pubsub.AcknowledgeStatus, err error) string {
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	switch status {
+	case pubsub.AcknowledgeStatusPermissionDenied:
+		return "permission_denied"
+	case pubsub.AcknowledgeStatusFailedPrecondition:
+		return "failed_precondition"
+	case pubsub.AcknowledgeStatusInvalidAckID:
+		return "invalid_ack_id"
+	}
+	return "other"
+}
+
+// withMemory wraps work so each job also holds memoryMB of resident memory
+// for its duration, to demonstrate memory-based scaling and OOM kills. The
+// memory is released when the job ends.
+func withMemory(work workFunc, memoryMB int) workFunc {
+	if memoryMB <= 0 {
+		return work
+	}
+	return func(ctx context.Context, duration time.Duration) {
+		buf := make([]byte, memoryMB<<20)
+		// Write to every page so the memory is actually resident, checking
+		// for cancellation between chunks since this can take a while.
+		const pageSize = 4096
+		for chunk := 0; chunk < len(buf); chunk += 64 << 20 {
+			if ctx.Err() != nil {
+				return
+			}
+			end := chunk + 64<<20
+			if end > len(buf) {
+				end = len(buf)
+			}
+			for i := chunk; i < end; i += pageSize {
+				buf[i] = 1
+			}
+		}
+		work(ctx, duration)
+		runtime.KeepAlive(buf)
+		// Hand the memory back to the OS right away so the pod's usage drops
+		// when the job ends instead of whenever the GC gets around to it.
+		debug.FreeOSMemory()
+	}
+}
+
+// withAllocSampling wraps work so a fraction rate of jobs report the bytes
+// they allocated in job_allocated_bytes. runtime.ReadMemStats stops the world
+// briefly, which is why only a sample of jobs pays for it. The counter is
+// process-wide, so with several jobs at once a sample includes the others'
+// allocations too.
+func withAllocSampling(work workFunc, rate float64, rng *randSource) workFunc {
+	if rate <= 0 {
+		return work
+	}
+	return func(ctx context.Context, duration time.Duration) {
+		if rate < 1 && rng.Float64() >= rate {
+			work(ctx, duration)
+			return
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		work(ctx, duration)
+		runtime.ReadMemStats(&after)
+		jobAllocatedBytes.Set(float64(after.TotalAlloc - before.TotalAlloc))
+	}
+}
+
+// jobDuration returns the duration from the message's durationSec attribute,
+// set when the publisher mixes durations, or fallback without one.
+func jobDuration(attrs map[string]string, fallback time.Duration) time.Duration {
+	value, ok := attrs["durationSec"]
+	if !ok {
+		return fallback
+	}
+	sec, err := strconv.Atoi(value)
+	if err != nil || sec < 0 {
+		slog.Warn("Invalid 'durationSec' attribute", "value", value)
+		return fallback
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// isExpired reports whether the message's expiresAt attribute (RFC 3339) is
+// before now. Messages without a valid expiresAt never expire.
+func isExpired(attrs map[string]string, now time.Time) (bool, time.Time) {
+	value, ok := attrs["expiresAt"]
+	if !ok {
+		return false, time.Time{}
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		slog.Warn("Invalid 'expiresAt' attribute", "value", value, "err", err)
+		return false, time.Time{}
+	}
+	return now.After(expiresAt), expiresAt
+}
@@ -0,0 +1,834 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+)
+
+// newTestSubscription starts a pstest server and returns a client connected
+// to it along with a topic and a subscription attached to that topic.
+func newTestSubscription(t *testing.T) (*pubsub.Client, *pubsub.Topic, *pubsub.Subscription, *pstest.Server) {
+	t.Helper()
+	ctx := context.Background()
+
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+
+	client, err := pubsub.NewClient(ctx, "test-project")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	topic, err := client.CreateTopic(ctx, "jobs")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	t.Cleanup(topic.Stop)
+	sub, err := client.CreateSubscription(ctx, "jobs-sub", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	return client, topic, sub, srv
+}
+
+// receiveOne publishes msg, delivers it to h.handleMessage and returns once
+// the handler has finished.
+func receiveOne(t *testing.T, topic *pubsub.Topic, sub *pubsub.Subscription, h *messageHandler, msg *pubsub.Message) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := topic.Publish(ctx, msg).Get(ctx); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	var once sync.Once
+	err := sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		h.handleMessage(ctx, m)
+		once.Do(cancel)
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+}
+
+func TestHandleMessageDone(t *testing.T) {
+	_, topic, sub, srv := newTestSubscription(t)
+
+	state := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+	state.updateMetric(9)
+
+	worked := false
+	h := &messageHandler{
+		state:       state,
+		jobDuration: time.Hour,
+		work:        func(context.Context, time.Duration) { worked = true },
+	}
+	receiveOne(t, topic, sub, h, &pubsub.Message{
+		Data:       []byte("DONE"),
+		Attributes: map[string]string{"numJobs": "0"},
+	})
+
+	if got := testutil.ToFloat64(numJobs); got != 0 {
+		t.Errorf("numJobs = %v after DONE, want 0", got)
+	}
+	if worked {
+		t.Error("DONE message ran the work function")
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 || msgs[0].Acks != 1 {
+		t.Errorf("DONE message was not acked exactly once: %+v", msgs)
+	}
+}
+
+func TestLeaseSafetyMarginPreventsRedelivery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a job close to the ack deadline")
+	}
+	client, topic, _, srv := newTestSubscription(t)
+	ctx := context.Background()
+
+	// The minimum ack deadline, with a job that takes almost all of it.
+	sub, err := client.CreateSubscription(ctx, "lease-sub", pubsub.SubscriptionConfig{
+		Topic:       topic,
+		AckDeadline: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	jobDuration := 9 * time.Second
+	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	sub.ReceiveSettings.MinExtensionPeriod = leaseExtensionPeriod(jobDuration, 5*time.Second)
+
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: jobDuration,
+		work:        func(_ context.Context, d time.Duration) { time.Sleep(d) },
+	}
+	receiveOne(t, topic, sub, h, &pubsub.Message{
+		Data:       []byte("job"),
+		Attributes: map[string]string{"numJobs": "1"},
+	})
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if msgs[0].Deliveries != 1 || msgs[0].Acks != 1 {
+		t.Errorf("message delivered %d times and acked %d times, want 1 and 1", msgs[0].Deliveries, msgs[0].Acks)
+	}
+}
+
+func TestConcurrentLongJobsKeepTheirLeases(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs many jobs longer than the ack deadline")
+	}
+	client, topic, _, srv := newTestSubscription(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Every job outlasts the ack deadline, so each lease has to be
+	// extended while all the others are being extended too.
+	sub, err := client.CreateSubscription(ctx, "stress-sub", pubsub.SubscriptionConfig{
+		Topic:       topic,
+		AckDeadline: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	const jobs = 50
+	jobDuration := 12 * time.Second
+	sub.ReceiveSettings.MaxOutstandingMessages = jobs
+	leases := leaseSettings{minExtensionPeriod: leaseExtensionPeriod(jobDuration, 5*time.Second)}
+	leases.apply(&sub.ReceiveSettings)
+
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: jobDuration,
+		work:        func(_ context.Context, d time.Duration) { time.Sleep(d) },
+		leases:      newLeaseTracker(leases.effectiveMaxExtension()),
+	}
+	for i := 0; i < jobs; i++ {
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte("job"), Attributes: map[string]string{"numJobs": "1"}}).Get(ctx); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	failures := testutil.ToFloat64(leaseExtensionFailures.WithLabelValues("redelivered"))
+	var mu sync.Mutex
+	done := 0
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		h.handleMessage(ctx, m)
+		mu.Lock()
+		defer mu.Unlock()
+		if done++; done == jobs {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != jobs {
+		t.Fatalf("got %d messages, want %d", len(msgs), jobs)
+	}
+	for _, m := range msgs {
+		if m.Deliveries != 1 || m.Acks != 1 {
+			t.Errorf("message %s delivered %d times and acked %d times, want 1 and 1", m.ID, m.Deliveries, m.Acks)
+		}
+	}
+	if got := testutil.ToFloat64(leaseExtensionFailures.WithLabelValues("redelivered")) - failures; got != 0 {
+		t.Errorf("lease_extension_failures_total{reason=\"redelivered\"} rose by %v, want 0", got)
+	}
+}
+
+func TestHandleMessageJobTypeLatency(t *testing.T) {
+	client, topic, sub, _ := newTestSubscription(t)
+
+	observations := func(jobType string) uint64 {
+		var m dto.Metric
+		if err := jobProcessingDuration.WithLabelValues(jobType).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	types, err := parseJobTypes("report,thumbnail")
+	if err != nil {
+		t.Fatalf("parseJobTypes: %v", err)
+	}
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) {},
+		jobTypes:    types,
+	}
+	report, thumbnail, other := observations("report"), observations("thumbnail"), observations("other")
+
+	for _, jobType := range []string{"report", "report", "unknown", ""} {
+		attrs := map[string]string{"numJobs": "1"}
+		if jobType != "" {
+			attrs[jobTypeAttr] = jobType
+		}
+		receiveOne(t, topic, sub, h, &pubsub.Message{Data: []byte("job"), Attributes: attrs})
+	}
+
+	if got := observations("report") - report; got != 2 {
+		t.Errorf("report jobs observed %d times, want 2", got)
+	}
+	if got := observations("thumbnail") - thumbnail; got != 0 {
+		t.Errorf("thumbnail jobs observed %d times, want 0", got)
+	}
+	// Unknown types and jobs without one share a single series.
+	if got := observations("other") - other; got != 2 {
+		t.Errorf("other jobs observed %d times, want 2", got)
+	}
+
+	// A job whose loop republish fails is nacked, not completed.
+	h.loopTopic = client.Topic("missing")
+	receiveOne(t, topic, sub, h, &pubsub.Message{Data: []byte("job"), Attributes: map[string]string{"numJobs": "1", jobTypeAttr: "thumbnail"}})
+	if got := observations("thumbnail") - thumbnail; got != 0 {
+		t.Errorf("failed thumbnail job observed %d times, want 0", got)
+	}
+}
+
+func TestHandleMessageDedupe(t *testing.T) {
+	_, topic, sub, srv := newTestSubscription(t)
+	ctx := context.Background()
+
+	store := newMemoryDedupe(time.Hour, time.Minute)
+	worked := 0
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) { worked++ },
+		dedupe:      store,
+	}
+	job := &pubsub.Message{Data: []byte("job"), Attributes: map[string]string{"numJobs": "1"}}
+
+	// Processed and acked: marked done.
+	receiveOne(t, topic, sub, h, job)
+	first := srv.Messages()[0]
+	if got, _ := store.claim(ctx, first.ID); got != deliveryDone {
+		t.Fatalf("acked message is %v in the store, want done", got)
+	}
+
+	// Another pod claimed this one and is still working on it, or died
+	// doing so: the duplicate is handed back, not acked.
+	if _, err := topic.Publish(ctx, job).Get(ctx); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	var second string
+	for _, m := range srv.Messages() {
+		if m.ID != first.ID {
+			second = m.ID
+		}
+	}
+	store.claim(ctx, second)
+	rctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err := sub.Receive(rctx, func(ctx context.Context, m *pubsub.Message) {
+		h.handleMessage(ctx, m)
+		cancel()
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if worked != 1 {
+		t.Errorf("work ran %d times, want once", worked)
+	}
+	for _, m := range srv.Messages() {
+		if m.ID == second && m.Acks != 0 {
+			t.Error("duplicate of a message still in progress was acked")
+		}
+	}
+	if got, _ := store.claim(ctx, second); got != deliveryInProgress {
+		t.Errorf("the nacked duplicate changed the claim to %v, want it kept in progress", got)
+	}
+}
+
+func TestHandleMessagePassesCanariesOnWithDedupe(t *testing.T) {
+	_, topic, sub, srv := newTestSubscription(t)
+	ctx := context.Background()
+
+	store := newMemoryDedupe(time.Hour, time.Minute)
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) {},
+		dedupe:      store,
+	}
+	receiveOne(t, topic, sub, h, &pubsub.Message{
+		Data:       []byte(canaryType),
+		Attributes: map[string]string{"numJobs": "0", "type": canaryType},
+	})
+
+	// Another worker's canary goes back for its owner, and this worker
+	// keeps no record that could take the redelivery for a duplicate.
+	msgs := srv.Messages()
+	if len(msgs) != 1 || msgs[0].Acks != 0 {
+		t.Fatalf("canary was acked: %+v", msgs)
+	}
+	if got, _ := store.claim(ctx, msgs[0].ID); got != deliveryNew {
+		t.Errorf("canary is %v in the dedupe store, want it unknown", got)
+	}
+}
+
+func TestHandleMessageMissingNumJobs(t *testing.T) {
+	_, topic, sub, _ := newTestSubscription(t)
+
+	for _, def := range []float64{1, 4} {
+		state := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+		h := &messageHandler{
+			state:          state,
+			jobDuration:    time.Millisecond,
+			defaultNumJobs: def,
+			work:           func(context.Context, time.Duration) {},
+		}
+		before := testutil.ToFloat64(invalidNumJobs)
+
+		// No numJobs attribute at all.
+		receiveOne(t, topic, sub, h, &pubsub.Message{Data: []byte("job")})
+
+		if got := state.snapshot().NumJobs; got != def {
+			t.Errorf("numJobs = %v for a message without the attribute, want the default %v", got, def)
+		}
+		if got := testutil.ToFloat64(invalidNumJobs) - before; got != 1 {
+			t.Errorf("invalid_num_jobs_total grew by %v, want 1", got)
+		}
+	}
+}
+
+func TestShutdownGraceAbortsLongJob(t *testing.T) {
+	_, topic, sub, srv := newTestSubscription(t)
+
+	// Shut down right after the job starts, with a grace period much
+	// shorter than the job.
+	ctx, shutdown := context.WithCancel(context.Background())
+	workCtx, cancelWork := withShutdownGrace(ctx, 100*time.Millisecond)
+	defer cancelWork()
+
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Minute,
+		work: func(ctx context.Context, d time.Duration) {
+			shutdown()
+			simulateWork(ctx, d)
+		},
+		lifetime: workCtx,
+	}
+	dropped := testutil.ToFloat64(droppedOnShutdown)
+	processed := testutil.ToFloat64(jobsProcessed)
+	start := time.Now()
+	receiveOne(t, topic, sub, h, &pubsub.Message{
+		Data:       []byte("job"),
+		Attributes: map[string]string{"numJobs": "1"},
+	})
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("handler took %v, want it aborted shortly after the grace period", elapsed)
+	}
+	if workCtx.Err() == nil {
+		t.Error("work context not cancelled after the grace period")
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 || msgs[0].Acks != 0 {
+		t.Errorf("aborted job was acked: %+v", msgs)
+	}
+	if got := testutil.ToFloat64(droppedOnShutdown) - dropped; got != 1 {
+		t.Errorf("messages_dropped_on_shutdown_total rose by %v, want 1", got)
+	}
+	// The aborted job isn't counted as processed.
+	if got := testutil.ToFloat64(jobsProcessed) - processed; got != 0 {
+		t.Errorf("jobs_processed_total rose by %v for an aborted job, want 0", got)
+	}
+	if got := h.state.snapshot(); got.InFlight != 0 || got.ProcessedTotal != 0 {
+		t.Errorf("inFlight = %d, processedTotal = %d after an aborted job, want 0, 0", got.InFlight, got.ProcessedTotal)
+	}
+}
+
+func TestHandleMessageSettlesAfterReceiveStops(t *testing.T) {
+	client, topic, sub, srv := newTestSubscription(t)
+	ctx := context.Background()
+	results, err := client.CreateTopic(ctx, "results")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	defer results.Stop()
+	if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte("job"), Attributes: map[string]string{"numJobs": "1"}}).Get(ctx); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// SIGTERM (or a pause) stops receiving while the job runs on, within
+	// the grace period.
+	receiveCtx, stopReceiving := context.WithCancel(ctx)
+	defer stopReceiving()
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work: func(context.Context, time.Duration) {
+			stopReceiving()
+			time.Sleep(100 * time.Millisecond)
+		},
+		lifetime:     ctx,
+		resultsTopic: results,
+	}
+	if err := sub.Receive(receiveCtx, h.handleMessage); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+
+	var job, result *pstest.Message
+	for _, m := range srv.Messages() {
+		if m.Attributes["outcome"] != "" {
+			result = m
+		} else {
+			job = m
+		}
+	}
+	if result == nil || result.Attributes["outcome"] != outcomeSuccess {
+		t.Errorf("result = %+v, want a success published after receiving stopped", result)
+	}
+	if job == nil || job.Acks != 1 {
+		t.Errorf("job = %+v, want it acked once", job)
+	}
+}
+
+func TestHandleMessageExactlyOnce(t *testing.T) {
+	client, topic, _, srv := newTestSubscription(t)
+	ctx := context.Background()
+
+	sub, err := client.CreateSubscription(ctx, "exactly-once-sub", pubsub.SubscriptionConfig{
+		Topic:                     topic,
+		EnableExactlyOnceDelivery: true,
+	})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) {},
+		exactlyOnce: true,
+	}
+	receiveOne(t, topic, sub, h, &pubsub.Message{
+		Data:       []byte("job"),
+		Attributes: map[string]string{"numJobs": "1"},
+	})
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 || msgs[0].Acks != 1 {
+		t.Errorf("message on an exactly-once subscription was not acked exactly once: %+v", msgs)
+	}
+}
+
+// publishJobs publishes n jobs to topic and waits until they are accepted.
+func publishJobs(t *testing.T, topic *pubsub.Topic, n int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		msg := &pubsub.Message{Data: []byte("job"), Attributes: map[string]string{"numJobs": "1"}}
+		if _, err := topic.Publish(ctx, msg).Get(ctx); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+}
+
+func TestReceiveModes(t *testing.T) {
+	for _, mode := range []string{modeStream, modeSync} {
+		t.Run(mode, func(t *testing.T) {
+			client, topic, sub, srv := newTestSubscription(t)
+			publishJobs(t, topic, 3)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var mu sync.Mutex
+			worked := 0
+			h := &messageHandler{
+				state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+				jobDuration: time.Millisecond,
+				work: func(context.Context, time.Duration) {
+					mu.Lock()
+					defer mu.Unlock()
+					if worked++; worked == 3 {
+						cancel()
+					}
+				},
+			}
+			sub.ReceiveSettings.Synchronous = mode == modeSync
+			r := &receiver{project: "test-project", client: client, sub: sub, subID: "jobs-sub"}
+			if err := r.run(ctx, &pauseController{}, h); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if worked != 3 {
+				t.Fatalf("processed %d jobs, want 3", worked)
+			}
+			for _, m := range srv.Messages() {
+				if m.Acks == 0 {
+					t.Errorf("message %s was not acked", m.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveModePullOnce(t *testing.T) {
+	_, topic, sub, srv := newTestSubscription(t)
+	publishJobs(t, topic, 3)
+
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) {},
+	}
+	n, err := pullOnce(context.Background(), sub, h, 2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("pullOnce: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("pullOnce handled %d messages, want 2", n)
+	}
+	acked := 0
+	for _, m := range srv.Messages() {
+		if m.Acks > 0 {
+			acked++
+		}
+	}
+	if acked != 2 {
+		t.Errorf("%d messages acked, want 2 (the third goes back to the subscription)", acked)
+	}
+}
+
+func TestParseReceiveMode(t *testing.T) {
+	for _, mode := range []string{modeStream, modeSync, modePullOnce} {
+		if got, err := parseReceiveMode(mode); err != nil || got != mode {
+			t.Errorf("parseReceiveMode(%q) = %q, %v", mode, got, err)
+		}
+	}
+	for _, mode := range []string{"push", "", "async"} {
+		if _, err := parseReceiveMode(mode); err == nil {
+			t.Errorf("parseReceiveMode(%q) succeeded, want an error", mode)
+		}
+	}
+}
+
+func TestPressureGate(t *testing.T) {
+	const mb = 1 << 20
+	g := &pressureGate{
+		maxMemoryBytes:   100 * mb,
+		minFreeDiskBytes: 50 * mb,
+		diskPath:         "/tmp",
+		memoryUsage:      func() uint64 { return 10 * mb },
+		freeDisk:         func(string) (uint64, error) { return 1000 * mb, nil },
+	}
+	if resource, _ := g.exceeded(); resource != "" {
+		t.Errorf("exceeded = %q below both thresholds", resource)
+	}
+	g.freeDisk = func(string) (uint64, error) { return 10 * mb, nil }
+	if resource, _ := g.exceeded(); resource != "disk" {
+		t.Errorf("exceeded = %q with little free disk, want disk", resource)
+	}
+	g.memoryUsage = func() uint64 { return 200 * mb }
+	if resource, _ := g.exceeded(); resource != "memory" {
+		t.Errorf("exceeded = %q with high memory usage, want memory", resource)
+	}
+	var off *pressureGate
+	if resource, _ := off.exceeded(); resource != "" {
+		t.Errorf("nil gate reported %q", resource)
+	}
+}
+
+func TestHandleMessageUnderPressure(t *testing.T) {
+	_, topic, sub, srv := newTestSubscription(t)
+
+	worked := false
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) { worked = true },
+		pressure: &pressureGate{
+			maxMemoryBytes: 1 << 20,
+			memoryUsage:    func() uint64 { return 1 << 30 },
+		},
+	}
+	before := testutil.ToFloat64(pressureRejections.WithLabelValues("memory"))
+	receiveOne(t, topic, sub, h, &pubsub.Message{
+		Data:       []byte("job"),
+		Attributes: map[string]string{"numJobs": "1"},
+	})
+
+	if worked {
+		t.Error("job ran under memory pressure")
+	}
+	if got := testutil.ToFloat64(pressureRejections.WithLabelValues("memory")) - before; got != 1 {
+		t.Errorf("pressure_rejections_total{resource=\"memory\"} rose by %v, want 1", got)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 || msgs[0].Acks != 0 {
+		t.Errorf("message was acked under pressure: %+v", msgs)
+	}
+}
+
+func TestStartupCanary(t *testing.T) {
+	client, topic, sub, srv := newTestSubscription(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Jobs queued ahead of the canary are processed, not handed back.
+	publishJobs(t, topic, 3)
+	h := &messageHandler{
+		state:       &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet},
+		jobDuration: time.Millisecond,
+		work:        func(context.Context, time.Duration) {},
+		canary:      newCanaryWatch("canary-1"),
+	}
+	ready := &readiness{}
+	received := make(chan error)
+	go func() { received <- sub.Receive(ctx, h.handleMessage) }()
+	h.canary.run(ctx, topic, 5*time.Second, ready)
+	if !ready.ready.Load() {
+		t.Fatal("worker not ready after its canary came back")
+	}
+	cancel()
+	if err := <-received; err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	for _, m := range srv.Messages() {
+		if m.Acks != 1 || m.Deliveries != 1 {
+			t.Errorf("message %s (type %q) delivered %d times and acked %d times, want once each", m.ID, m.Attributes["type"], m.Deliveries, m.Acks)
+		}
+	}
+
+	// A subscription on another topic never sees the canary: the worker
+	// stays unready and keeps trying instead of exiting.
+	other, err := client.CreateTopic(context.Background(), "other")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	defer other.Stop()
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	ready = &readiness{}
+	newCanaryWatch("canary-2").run(ctx, other, 100*time.Millisecond, ready)
+	if ready.ready.Load() {
+		t.Error("worker ready although its canary never arrived")
+	}
+	published := 0
+	for _, m := range srv.Messages() {
+		if m.Attributes[requestIDAttr] == "canary-2" {
+			published++
+		}
+	}
+	if published < 2 {
+		t.Errorf("canary published %d times, want it published again after each timeout", published)
+	}
+}
+
+func TestCreateSubscriptionExpiration(t *testing.T) {
+	client, _, _, _ := newTestSubscription(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		subID      string
+		expiration time.Duration
+		want       time.Duration
+	}{
+		{"expiring-sub", 48 * time.Hour, 48 * time.Hour},
+		{"never-expiring-sub", -1, 0},
+	} {
+		want := subscriptionExpectations{expiration: tc.expiration}
+		sub, err := getOrCreateSubscription(ctx, client, tc.subID, "jobs", true, want)
+		if err != nil {
+			t.Fatalf("getOrCreateSubscription(%s): %v", tc.subID, err)
+		}
+		cfg, err := sub.Config(ctx)
+		if err != nil {
+			t.Fatalf("Config: %v", err)
+		}
+		if got, ok := cfg.ExpirationPolicy.(time.Duration); !ok || got != tc.want {
+			t.Errorf("%s has expiration policy %v, want %v", tc.subID, cfg.ExpirationPolicy, tc.want)
+		}
+		if mismatches := diffSubscriptionConfig(want, cfg); len(mismatches) > 0 {
+			t.Errorf("%s: unexpected mismatches %v", tc.subID, mismatches)
+		}
+	}
+}
+
+func TestGetOrCreateCountsAdminOps(t *testing.T) {
+	client, _, _, _ := newTestSubscription(t)
+	ctx := context.Background()
+	count := func(operation, result string) float64 {
+		return testutil.ToFloat64(adminOps.WithLabelValues(operation, result))
+	}
+	before := map[[2]string]float64{}
+	ops := [][2]string{
+		{"get_subscription", adminNotFound}, {"create_subscription", adminCreated},
+		{"get_subscription", adminFound}, {"get_topic", adminFound},
+	}
+	for _, op := range ops {
+		before[op] = count(op[0], op[1])
+	}
+
+	// The first call creates the subscription on the existing topic, the
+	// second finds it.
+	for i := 0; i < 2; i++ {
+		if _, err := getOrCreateSubscription(ctx, client, "other-sub", "jobs", true, subscriptionExpectations{}); err != nil {
+			t.Fatalf("getOrCreateSubscription: %v", err)
+		}
+	}
+	for _, op := range ops {
+		if got := count(op[0], op[1]) - before[op]; got != 1 {
+			t.Errorf("%s %s counted %v times, want 1", op[0], op[1], got)
+		}
+	}
+}
+
+func TestGetOrCreateWithoutGetPermission(t *testing.T) {
+	// The lab grants only roles/pubsub.subscriber, which can't get the
+	// topic or subscription.
+	srv := pstest.NewServer(
+		pstest.WithErrorInjection("GetSubscription", codes.PermissionDenied, "denied"),
+		pstest.WithErrorInjection("GetTopic", codes.PermissionDenied, "denied"),
+	)
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "test-project")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	denied := testutil.ToFloat64(adminOps.WithLabelValues("get_subscription", adminDenied))
+	sub, err := getOrCreateSubscription(ctx, client, "jobs-sub", "jobs", true, subscriptionExpectations{})
+	if err != nil {
+		t.Fatalf("getOrCreateSubscription: %v", err)
+	}
+	if got := testutil.ToFloat64(adminOps.WithLabelValues("get_subscription", adminDenied)) - denied; got != 1 {
+		t.Errorf("denied get_subscription counted %v times, want 1", got)
+	}
+	if sub.ID() != "jobs-sub" {
+		t.Errorf("got subscription %s, want jobs-sub", sub.ID())
+	}
+	topic, err := getOrCreateTopic(ctx, client, "heartbeats", true)
+	if err != nil {
+		t.Fatalf("getOrCreateTopic: %v", err)
+	}
+	defer topic.Stop()
+	// Nothing was created on the assumption that it exists.
+	if _, err := client.CreateTopic(ctx, "heartbeats"); err != nil {
+		t.Errorf("CreateTopic after getOrCreateTopic: %v, want the topic not to exist yet", err)
+	}
+}
+
+func TestReceiverGivesUpOnDeletedSubscription(t *testing.T) {
+	// Without permission to get it, a deleted subscription is assumed to
+	// exist, so recreating it never helps.
+	srv := pstest.NewServer(pstest.WithErrorInjection("GetSubscription", codes.PermissionDenied, "denied"))
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, "test-project")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	// No delay, and a cap no Receive outlasts, so the backoff never resets.
+	backoff := &restartBackoff{initial: time.Millisecond, max: time.Minute, jitter: func() float64 { return 0 }}
+	r := &receiver{project: "test-project", client: client, sub: client.Subscription("jobs-sub"), subID: "jobs-sub", topicID: "jobs", autoCreate: true, backoff: backoff}
+	before := testutil.ToFloat64(subscriptionNotFound)
+	h := &messageHandler{state: &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}}
+	err = r.run(ctx, &pauseController{}, h)
+	if err == nil || !strings.Contains(err.Error(), "still not found") {
+		t.Fatalf("run = %v, want it to give up on the subscription", err)
+	}
+	if got := testutil.ToFloat64(subscriptionNotFound) - before; got != maxNotFoundRetries+1 {
+		t.Errorf("subscription_not_found_total grew by %v, want %d", got, maxNotFoundRetries+1)
+	}
+	if backoff.failures != maxNotFoundRetries {
+		t.Errorf("backoff counted %d failures, want %d", backoff.failures, maxNotFoundRetries)
+	}
+}
+
+func TestHandleMessageNormalizesAttributes(t *testing.T) {
+	_, topic, sub, _ := newTestSubscription(t)
+
+	for _, normalize := range []bool{false, true} {
+		state := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+		h := &messageHandler{
+			state:          state,
+			jobDuration:    time.Millisecond,
+			defaultNumJobs: 1,
+			work:           func(context.Context, time.Duration) {},
+			normalizeAttrs: normalize,
+		}
+		receiveOne(t, topic, sub, h, &pubsub.Message{
+			Data:       []byte("job"),
+			Attributes: map[string]string{" NumJobs": "4 "},
+		})
+
+		// Strict parsing falls back to the default.
+		want := 1.0
+		if normalize {
+			want = 4
+		}
+		if got := state.snapshot().NumJobs; got != want {
+			t.Errorf("normalize=%v: numJobs = %v, want %v", normalize, got, want)
+		}
+	}
+}
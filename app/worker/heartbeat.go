@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// heartbeat is the body of a message published to HEARTBEAT_TOPIC_ID, from
+// which an aggregator can build a fleet view without scraping every pod.
+type heartbeat struct {
+	Pod       string    `json:"pod"`
+	NumJobs   float64   `json:"numJobs"`
+	InFlight  int       `json:"inFlight"`
+	UptimeSec float64   `json:"uptimeSec"`
+	SentAt    time.Time `json:"sentAt"`
+}
+
+// heartbeatMessage builds the heartbeat for pod from the current metrics.
+// The type and pod attributes let subscribers filter without decoding.
+func heartbeatMessage(pod string, snap metricsSnapshot, startedAt, now time.Time) (*pubsub.Message, error) {
+	data, err := json.Marshal(heartbeat{
+		Pod:       pod,
+		NumJobs:   snap.NumJobs,
+		InFlight:  snap.InFlight,
+		UptimeSec: now.Sub(startedAt).Seconds(),
+		SentAt:    now.UTC(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %v", err)
+	}
+	return &pubsub.Message{Data: data, Attributes: map[string]string{"type": "heartbeat", "pod": pod}}, nil
+}
+
+// sendHeartbeats publishes a heartbeat to topic every interval until ctx is
+// cancelled. A failed heartbeat is logged and skipped; the next one follows
+// on schedule.
+func (s *globalState) sendHeartbeats(ctx context.Context, topic *pubsub.Topic, pod string, startedAt time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		msg, err := heartbeatMessage(pod, s.snapshot(), startedAt, time.Now())
+		if err != nil {
+			slog.Error("Failed to encode heartbeat", "err", err)
+			continue
+		}
+		if _, err := topic.Publish(ctx, msg).Get(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Failed to publish heartbeat", "err", err)
+			continue
+		}
+		slog.Debug("Published heartbeat")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// jobTypeAttr names a message's class of work in heterogeneous workloads,
+// e.g. set with the publisher's -attr jobType=report.
+const jobTypeAttr = "jobType"
+
+// jobTypes is the JOB_TYPES allowlist of job types that get their own
+// jobType label on job_processing_duration_seconds. Every other type, and
+// jobs without one, are labeled "other", so publishers can't blow up the
+// metric's cardinality.
+type jobTypes map[string]bool
+
+// parseJobTypes parses a comma-separated list of job types.
+func parseJobTypes(value string) (jobTypes, error) {
+	types := jobTypes{}
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if t == otherLabelValue {
+			return nil, fmt.Errorf("%q is reserved for job types not in the list", t)
+		}
+		if len(t) > maxAttributeLabelLength {
+			return nil, fmt.Errorf("job type %q is longer than %d characters", t, maxAttributeLabelLength)
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// label returns the jobType label for a message with attrs.
+func (t jobTypes) label(attrs map[string]string) string {
+	if jt := attrs[jobTypeAttr]; t[jt] {
+		return jt
+	}
+	return otherLabelValue
+}
+
+// labels returns every label value, so each series is exported from the
+// start.
+func (t jobTypes) labels() []string {
+	labels := []string{otherLabelValue}
+	for jt := range t {
+		labels = append(labels, jt)
+	}
+	return labels
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// defaultMaxExtension is what the client uses when
+// ReceiveSettings.MaxExtension is 0: how long it keeps extending a message's
+// lease after receiving it.
+const defaultMaxExtension = 60 * time.Minute
+
+// latencyExtensionPeriod approximates the extensions the client sizes from
+// observed ack latency when MinExtensionPeriod is 0: with fast acks they
+// settle at the client's minimum.
+const latencyExtensionPeriod = minLeaseExtension
+
+// manyExtensionsPerMinute is the extension rate above which /config suggests
+// LEASE_SAFETY_MARGIN_SEC. The client batches extensions, but each one still
+// counts against the subscription's ModifyAckDeadline throughput.
+const manyExtensionsPerMinute = 600
+
+// leaseSettings are the client's lease management settings. Zero values
+// keep the client's defaults.
+//
+// The client tracks the lease of every outstanding message separately and
+// renews them together in batched ModifyAckDeadline calls from a single
+// goroutine, so a long job never holds up the extensions of others, however
+// many run at once. What concurrency changes is how many leases are renewed
+// each round, and with short extensions that is most of them.
+type leaseSettings struct {
+	// minExtensionPeriod is the shortest extension the client sends, from
+	// LEASE_SAFETY_MARGIN_SEC.
+	minExtensionPeriod time.Duration
+	// maxExtensionPeriod caps each extension (ACK_MAX_EXTENSION_PERIOD_SEC).
+	// It wins over minExtensionPeriod, so it may not be shorter.
+	maxExtensionPeriod time.Duration
+	// maxExtension is how long a lease is extended in total before the
+	// client gives the message up for redelivery (ACK_MAX_EXTENSION_SEC).
+	maxExtension time.Duration
+}
+
+// apply sets the lease settings on rs.
+func (l leaseSettings) apply(rs *pubsub.ReceiveSettings) {
+	rs.MinExtensionPeriod = l.minExtensionPeriod
+	rs.MaxExtensionPeriod = l.maxExtensionPeriod
+	rs.MaxExtension = l.maxExtension
+}
+
+// validate reports settings the client would reject or silently override.
+func (l leaseSettings) validate() error {
+	if l.maxExtension < 0 {
+		return fmt.Errorf("ACK_MAX_EXTENSION_SEC must not be negative")
+	}
+	if l.maxExtensionPeriod != 0 && (l.maxExtensionPeriod < minLeaseExtension || l.maxExtensionPeriod > maxLeaseExtension) {
+		return fmt.Errorf("ACK_MAX_EXTENSION_PERIOD_SEC must be 0 or between %d and %d", int(minLeaseExtension.Seconds()), int(maxLeaseExtension.Seconds()))
+	}
+	if l.maxExtensionPeriod != 0 && l.maxExtensionPeriod < l.minExtensionPeriod {
+		return fmt.Errorf("ACK_MAX_EXTENSION_PERIOD_SEC (%v) is shorter than the extensions LEASE_SAFETY_MARGIN_SEC asks for (%v)", l.maxExtensionPeriod, l.minExtensionPeriod)
+	}
+	return nil
+}
+
+// effectiveMaxExtension returns maxExtension with the client's default
+// filled in.
+func (l leaseSettings) effectiveMaxExtension() time.Duration {
+	if l.maxExtension == 0 {
+		return defaultMaxExtension
+	}
+	return l.maxExtension
+}
+
+// extensionPeriod estimates how long each extension lasts.
+func (l leaseSettings) extensionPeriod() time.Duration {
+	period := l.minExtensionPeriod
+	if period == 0 {
+		period = latencyExtensionPeriod
+	}
+	if l.maxExtensionPeriod != 0 {
+		period = min(period, l.maxExtensionPeriod)
+	}
+	return period
+}
+
+// leaseGuidance describes the lease settings in effect and safe values for
+// JOB_DURATION_SEC and MAX_OUTSTANDING_MESSAGES, for /config.
+type leaseGuidance struct {
+	JobDurationSec int `json:"jobDurationSec"`
+	Concurrency    int `json:"concurrency"`
+	// The settings in effect, 0 for the client's default.
+	MinExtensionPeriodSec int `json:"minExtensionPeriodSec"`
+	MaxExtensionPeriodSec int `json:"maxExtensionPeriodSec"`
+	MaxExtensionSec       int `json:"maxExtensionSec"`
+	// ExtensionsPerMinute estimates the leases renewed per minute with
+	// every slot busy.
+	ExtensionsPerMinute float64 `json:"extensionsPerMinute"`
+	// SuggestedLeaseSafetyMarginSec lets a single extension cover a job
+	// that runs somewhat long.
+	SuggestedLeaseSafetyMarginSec int `json:"suggestedLeaseSafetyMarginSec"`
+	// SuggestedMaxExtensionSec leaves room for jobs that run twice as
+	// long as expected.
+	SuggestedMaxExtensionSec int      `json:"suggestedMaxExtensionSec"`
+	Warnings                 []string `json:"warnings"`
+}
+
+// adviseLease checks l against jobs of jobDuration running concurrency at a
+// time.
+func adviseLease(jobDuration time.Duration, concurrency int, l leaseSettings) leaseGuidance {
+	period := l.extensionPeriod()
+	g := leaseGuidance{
+		JobDurationSec:                int(jobDuration.Seconds()),
+		Concurrency:                   concurrency,
+		MinExtensionPeriodSec:         int(l.minExtensionPeriod.Seconds()),
+		MaxExtensionPeriodSec:         int(l.maxExtensionPeriod.Seconds()),
+		MaxExtensionSec:               int(l.maxExtension.Seconds()),
+		ExtensionsPerMinute:           float64(concurrency) * float64(time.Minute) / float64(period),
+		SuggestedLeaseSafetyMarginSec: int(math.Ceil(max(5*time.Second, jobDuration/10).Seconds())),
+		SuggestedMaxExtensionSec:      int(max(defaultMaxExtension, 2*jobDuration).Seconds()),
+		Warnings:                      []string{},
+	}
+	if maxExt := l.effectiveMaxExtension(); maxExt < jobDuration {
+		g.Warnings = append(g.Warnings, fmt.Sprintf("Leases are extended for %v in total, less than a job takes (%v): every message is redelivered while it is still being processed. Raise ACK_MAX_EXTENSION_SEC.", maxExt, jobDuration))
+	}
+	if l.minExtensionPeriod == 0 && g.ExtensionsPerMinute > manyExtensionsPerMinute && jobDuration > period {
+		g.Warnings = append(g.Warnings, fmt.Sprintf("With %d concurrent jobs of %v and extensions of about %v, about %.0f leases are renewed per minute. Set LEASE_SAFETY_MARGIN_SEC so one extension covers a job.", concurrency, jobDuration, period, g.ExtensionsPerMinute))
+	}
+	if l.minExtensionPeriod != 0 && jobDuration >= maxLeaseExtension {
+		g.Warnings = append(g.Warnings, fmt.Sprintf("Jobs of %v outlast the longest extension the client sends (%v), so each lease is renewed %d times per job and LEASE_SAFETY_MARGIN_SEC only covers the last one.", jobDuration, maxLeaseExtension, int(jobDuration/maxLeaseExtension)+1))
+	}
+	return g
+}
+
+// leaseTracker spots messages whose lease ran out while they were being
+// processed, which the client doesn't report: a redelivery of a message
+// that is still in flight here, and a job that outlasted maxExtension.
+type leaseTracker struct {
+	mu           sync.Mutex
+	held         map[string]int // message ID to deliveries in flight
+	maxExtension time.Duration
+}
+
+func newLeaseTracker(maxExtension time.Duration) *leaseTracker {
+	return &leaseTracker{held: map[string]int{}, maxExtension: maxExtension}
+}
+
+// hold records a delivery of id and reports whether an earlier delivery of
+// it is still in flight.
+func (t *leaseTracker) hold(id string) (redelivered bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.held[id]++
+	return t.held[id] > 1
+}
+
+// release ends a delivery of id held for heldFor and reports whether the
+// client had stopped extending its lease by then.
+func (t *leaseTracker) release(id string, heldFor time.Duration) (expired bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.held[id]--; t.held[id] <= 0 {
+		delete(t.held, id)
+	}
+	return heldFor > t.maxExtension
+}
+
+// trackLease counts the lease extension failures of msg in
+// lease_extension_failures_total. The returned func ends tracking once msg
+// is settled.
+func (h *messageHandler) trackLease(msg *pubsub.Message, log *slog.Logger) func() {
+	if h.leases == nil {
+		return func() {}
+	}
+	received := time.Now()
+	if h.leases.hold(msg.ID) {
+		log.Warn("Message redelivered while still being processed, its lease ran out.", "id", msg.ID)
+		leaseExtensionFailures.WithLabelValues("redelivered").Inc()
+	}
+	return func() {
+		if heldFor := time.Since(received); h.leases.release(msg.ID, heldFor) {
+			log.Warn("Message held longer than its leases are extended, it will be redelivered.", "id", msg.ID, "held", heldFor, "maxExtension", h.leases.maxExtension)
+			leaseExtensionFailures.WithLabelValues("max_extension").Inc()
+		}
+	}
+}
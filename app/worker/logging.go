@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs a text slog handler as the default logger, honoring
+// LOG_LEVEL (debug, info, warn or error) and LOG_CONTEXT. Per-message logs
+// are at debug level, so the default of info keeps log volume down at scale.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		fatal("Invalid LOG_LEVEL", "err", err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	// LOG_CONTEXT tags every line, e.g. with the deployment or experiment,
+	// for filtering aggregated logs.
+	attrs, err := parseLogContext(getEnv("LOG_CONTEXT", ""))
+	if err != nil {
+		slog.SetDefault(logger)
+		fatal("Invalid LOG_CONTEXT", "err", err)
+	}
+	slog.SetDefault(logger.With(attrs...))
+}
+
+// parseLogContext parses LOG_CONTEXT, a comma-separated list of key=value
+// pairs such as "deployment=canary,experiment=42", into slog attributes.
+func parseLogContext(value string) ([]any, error) {
+	var attrs []any
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		if seen[k] {
+			return nil, fmt.Errorf("duplicate key %q", k)
+		}
+		seen[k] = true
+		attrs = append(attrs, slog.String(k, strings.TrimSpace(v)))
+	}
+	return attrs, nil
+}
+
+// fatal logs msg at error level, which LOG_LEVEL never filters, and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logSampler decides which processed messages are logged at info level, so
+// logs stay readable at high throughput. Counters still see every message.
+type logSampler struct {
+	rate float64
+	// deterministic samples by message ID, so a redelivered message gets
+	// the same decision. Otherwise each message is sampled at random.
+	deterministic bool
+	rand          *randSource
+}
+
+// sampled reports whether the message with the given ID should be logged. A
+// nil sampler logs everything.
+func (s *logSampler) sampled(id string) bool {
+	if s == nil || s.rate >= 1 {
+		return true
+	}
+	if s.deterministic {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return float64(h.Sum32())/(1<<32) < s.rate
+	}
+	return s.rand.Float64() < s.rate
+}
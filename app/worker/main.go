@@ -2,53 +2,33 @@ package main
 
 import (
 	"context"
-	"log"
-	"math"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
 )
 
-// globalState protected by a mutex to hold our metric value and timestamp
-type globalState struct {
-	mu            sync.RWMutex
-	lastJobTime   time.Time
-	metricValue   float64
-	metricTimeout time.Duration
-}
-
-// numJobs is the custom metric we will export.
-var numJobs = prometheus.NewGauge(
-	prometheus.GaugeOpts{
-		Name: "numJobs",
-		Help: "The number of pending jobs in the queue as reported by the last message.",
-	},
-)
-
-func init() {
-	// Register the metric with Prometheus
-	prometheus.MustRegister(numJobs)
-}
-
 func main() {
-	log.Println("Starting worker...")
+	setupLogging()
+	slog.Info("Starting worker...")
 
 	// --- Configuration ---
 	// Read configuration from environment variables
 	projectID := getEnv("PROJECT_ID", "")
 	if projectID == "" {
-		log.Fatal("PROJECT_ID environment variable must be set")
+		fatal("PROJECT_ID environment variable must be set")
 	}
 
 	subscriptionID := getEnv("SUBSCRIPTION_ID", "")
 	if subscriptionID == "" {
-		log.Fatal("SUBSCRIPTION_ID environment variable must be set")
+		fatal("SUBSCRIPTION_ID environment variable must be set")
 	}
 
 	jobDurationSec, _ := strconv.Atoi(getEnv("JOB_DURATION_SEC", "90"))
@@ -57,125 +37,639 @@ func main() {
 	metricTimeoutSec, _ := strconv.Atoi(getEnv("METRIC_TIMEOUT_SEC", "120"))
 	metricTimeout := time.Duration(metricTimeoutSec) * time.Second
 
+	gaugeMode := getEnv("GAUGE_MODE", gaugeModeSet)
+	if gaugeMode != gaugeModeSet && gaugeMode != gaugeModeAdd {
+		fatal("GAUGE_MODE must be \"set\" or \"add\"", "value", gaugeMode)
+	}
+
+	// A decay factor of 0 keeps the default hard reset.
+	decayFactor, _ := strconv.ParseFloat(getEnv("METRIC_DECAY_FACTOR", "0"), 64)
+	if decayFactor < 0 || decayFactor >= 1 {
+		fatal("METRIC_DECAY_FACTOR must be in [0, 1)", "value", decayFactor)
+	}
+
+	// All randomness comes from one seed, logged so a run can be replayed.
+	seed := time.Now().UnixNano()
+	if v := getEnv("RANDOM_SEED", ""); v != "" {
+		var err error
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			fatal("Invalid RANDOM_SEED", "err", err)
+		}
+	}
+	slog.Info("Random seed", "seed", seed)
+	rng := newRandSource(seed)
+
+	// Log only a fraction of processed messages at info level.
+	logSampleRate, _ := strconv.ParseFloat(getEnv("LOG_SAMPLE_RATE", "1"), 64)
+	if logSampleRate < 0 || logSampleRate > 1 {
+		fatal("LOG_SAMPLE_RATE must be in [0, 1]", "value", logSampleRate)
+	}
+	logSampleMode := getEnv("LOG_SAMPLE_MODE", "random")
+	if logSampleMode != "random" && logSampleMode != "deterministic" {
+		fatal("LOG_SAMPLE_MODE must be \"random\" or \"deterministic\"", "value", logSampleMode)
+	}
+
+	maxOutstanding, _ := strconv.Atoi(getEnv("MAX_OUTSTANDING_MESSAGES", "1"))
+	if maxOutstanding < 1 {
+		fatal("MAX_OUTSTANDING_MESSAGES must be at least 1", "value", maxOutstanding)
+	}
+
+	// MODE is the old name of RECEIVE_MODE.
+	mode, err := parseReceiveMode(getEnv("RECEIVE_MODE", getEnv("MODE", modeStream)))
+	if err != nil {
+		fatal("Invalid RECEIVE_MODE", "err", err)
+	}
+	pullMaxMessages, _ := strconv.Atoi(getEnv("PULL_MAX_MESSAGES", "10"))
+	pullIdleTimeoutSec, _ := strconv.Atoi(getEnv("PULL_IDLE_TIMEOUT_SEC", "30"))
+	if mode == modePullOnce && (pullMaxMessages < 1 || pullIdleTimeoutSec < 1) {
+		fatal("PULL_MAX_MESSAGES and PULL_IDLE_TIMEOUT_SEC must be positive")
+	}
+
+	metricsStdoutIntervalSec, _ := strconv.Atoi(getEnv("METRICS_STDOUT_INTERVAL_SEC", "0"))
+
+	leaseSafetyMarginSec, _ := strconv.Atoi(getEnv("LEASE_SAFETY_MARGIN_SEC", "0"))
+	maxExtensionSec, _ := strconv.Atoi(getEnv("ACK_MAX_EXTENSION_SEC", "0"))
+	maxExtensionPeriodSec, _ := strconv.Atoi(getEnv("ACK_MAX_EXTENSION_PERIOD_SEC", "0"))
+	leases := leaseSettings{
+		minExtensionPeriod: leaseExtensionPeriod(jobDuration, time.Duration(leaseSafetyMarginSec)*time.Second),
+		maxExtensionPeriod: time.Duration(maxExtensionPeriodSec) * time.Second,
+		maxExtension:       time.Duration(maxExtensionSec) * time.Second,
+	}
+	if err := leases.validate(); err != nil {
+		fatal("Invalid lease settings", "err", err)
+	}
+	leaseAdvice := adviseLease(jobDuration, maxOutstanding, leases)
+	for _, w := range leaseAdvice.Warnings {
+		slog.Warn("Lease settings", "warning", w)
+	}
+
+	// Mirror the HPA target so the scaling math is visible on /metrics.
+	jobsPerReplica, _ := strconv.ParseFloat(getEnv("JOBS_PER_REPLICA", "1"), 64)
+	minReplicas, _ := strconv.Atoi(getEnv("MIN_REPLICAS", "1"))
+	maxReplicas, _ := strconv.Atoi(getEnv("MAX_REPLICAS", "0"))
+	if jobsPerReplica <= 0 {
+		fatal("JOBS_PER_REPLICA must be positive", "value", jobsPerReplica)
+	}
+	if maxReplicas > 0 && maxReplicas < minReplicas {
+		fatal("MAX_REPLICAS must not be less than MIN_REPLICAS", "min", minReplicas, "max", maxReplicas)
+	}
+
+	backlogPollIntervalSec, _ := strconv.Atoi(getEnv("BACKLOG_POLL_INTERVAL_SEC", "0"))
+
+	// Carry the metric over a quick restart instead of reporting 0.
+	metricStateFile := getEnv("METRIC_STATE_FILE", "")
+	metricStateMaxAgeSec, _ := strconv.Atoi(getEnv("METRIC_STATE_MAX_AGE_SEC", "60"))
+
+	workFuncName := getEnv("WORK_FUNC", "simulate")
+	work, err := lookupWorkFunc(workFuncName, rng)
+	if err != nil {
+		fatal("Invalid WORK_FUNC", "err", err)
+	}
+	workMemoryMB, _ := strconv.Atoi(getEnv("WORK_MEMORY_MB", "0"))
+	allocSampleRate, _ := strconv.ParseFloat(getEnv("JOB_ALLOC_SAMPLE_RATE", "0"), 64)
+	if allocSampleRate < 0 || allocSampleRate > 1 {
+		fatal("JOB_ALLOC_SAMPLE_RATE must be in [0, 1]", "value", allocSampleRate)
+	}
+
+	defaultNumJobs, err := strconv.ParseFloat(getEnv("DEFAULT_NUM_JOBS", "1"), 64)
+	if err != nil {
+		fatal("Invalid DEFAULT_NUM_JOBS", "err", err)
+	}
+
+	shutdownGraceSec, _ := strconv.Atoi(getEnv("SHUTDOWN_GRACE_SEC", "25"))
+
+	metricsBindRetrySec, _ := strconv.Atoi(getEnv("METRICS_BIND_RETRY_SEC", "30"))
+	metricsBindRetry := time.Duration(metricsBindRetrySec) * time.Second
+
+	startupDelaySec, _ := strconv.Atoi(getEnv("STARTUP_DELAY_SEC", "0"))
+
+	distinctMax, _ := strconv.Atoi(getEnv("DISTINCT_NUM_JOBS_MAX", "1000"))
+	distinctResetSec, _ := strconv.Atoi(getEnv("DISTINCT_NUM_JOBS_RESET_SEC", "0"))
+
+	throughputWindowSec, _ := strconv.Atoi(getEnv("THROUGHPUT_WINDOW_SEC", "300"))
+	if throughputWindowSec <= 0 {
+		fatal("THROUGHPUT_WINDOW_SEC must be positive", "value", throughputWindowSec)
+	}
+
+	lastErrorClearSec, _ := strconv.Atoi(getEnv("LAST_ERROR_CLEAR_SEC", "0"))
+
+	successRatioWindowSec, _ := strconv.Atoi(getEnv("SUCCESS_RATIO_WINDOW_SEC", "300"))
+	if successRatioWindowSec <= 0 {
+		fatal("SUCCESS_RATIO_WINDOW_SEC must be positive", "value", successRatioWindowSec)
+	}
+	averageWindowSec, _ := strconv.Atoi(getEnv("AVERAGE_NUM_JOBS_WINDOW_SEC", "300"))
+	if averageWindowSec <= 0 {
+		fatal("AVERAGE_NUM_JOBS_WINDOW_SEC must be positive", "value", averageWindowSec)
+	}
+	concurrencyWindowSec, _ := strconv.Atoi(getEnv("EFFECTIVE_CONCURRENCY_WINDOW_SEC", "60"))
+	if concurrencyWindowSec <= 0 {
+		fatal("EFFECTIVE_CONCURRENCY_WINDOW_SEC must be positive", "value", concurrencyWindowSec)
+	}
+	// Pressure gating is opt-in: each check is off while its threshold is 0.
+	pressureMemoryMB, _ := strconv.Atoi(getEnv("PRESSURE_MAX_MEMORY_MB", "0"))
+	pressureDiskMB, _ := strconv.Atoi(getEnv("PRESSURE_MIN_FREE_DISK_MB", "0"))
+	var pressure *pressureGate
+	if pressureMemoryMB > 0 || pressureDiskMB > 0 {
+		pressure = &pressureGate{
+			maxMemoryBytes:   uint64(max(pressureMemoryMB, 0)) << 20,
+			minFreeDiskBytes: uint64(max(pressureDiskMB, 0)) << 20,
+			diskPath:         getEnv("PRESSURE_DISK_PATH", "/tmp"),
+			memoryUsage:      runtimeMemoryUsage,
+			freeDisk:         statfsFreeDisk,
+		}
+	}
+	minNumJobs, _ := strconv.ParseFloat(getEnv("MIN_NUM_JOBS", "0"), 64)
+	if minNumJobs < 0 {
+		fatal("MIN_NUM_JOBS must not be negative", "value", minNumJobs)
+	}
+	metricScaleFactor, _ := strconv.ParseFloat(getEnv("METRIC_SCALE_FACTOR", "1"), 64)
+	if metricScaleFactor <= 0 {
+		fatal("METRIC_SCALE_FACTOR must be positive", "value", metricScaleFactor)
+	}
+
+	// Periodic CPU profiles are off unless an interval is set.
+	cpuProfileIntervalSec, _ := strconv.Atoi(getEnv("CPU_PROFILE_INTERVAL_SEC", "0"))
+	cpuProfileDurationSec, _ := strconv.Atoi(getEnv("CPU_PROFILE_DURATION_SEC", "10"))
+	cpuProfileInterval := time.Duration(cpuProfileIntervalSec) * time.Second
+	cpuProfileDuration := time.Duration(cpuProfileDurationSec) * time.Second
+	if cpuProfileInterval > 0 {
+		if cpuProfileInterval < minProfileInterval {
+			fatal("CPU_PROFILE_INTERVAL_SEC must be at least 60", "value", cpuProfileIntervalSec)
+		}
+		if cpuProfileDuration <= 0 || cpuProfileDuration > maxProfileDuration || cpuProfileDuration >= cpuProfileInterval {
+			fatal("CPU_PROFILE_DURATION_SEC must be positive, at most 60 and shorter than CPU_PROFILE_INTERVAL_SEC", "value", cpuProfileDurationSec)
+		}
+	}
+
+	var activeHours *activeWindow
+	if value := getEnv("ACTIVE_HOURS", ""); value != "" {
+		activeHours, err = parseActiveHours(value, getEnv("ACTIVE_HOURS_TZ", ""))
+		if err != nil {
+			fatal("Invalid ACTIVE_HOURS", "err", err)
+		}
+	}
+
+	normalizeAttrs, _ := strconv.ParseBool(getEnv("NORMALIZE_ATTRIBUTES", "false"))
+
+	orderedDrain, _ := strconv.ParseBool(getEnv("ORDERED_DRAIN", "false"))
+
+	startupCanary, _ := strconv.ParseBool(getEnv("STARTUP_CANARY", "false"))
+	startupCanaryTimeoutSec, _ := strconv.Atoi(getEnv("STARTUP_CANARY_TIMEOUT_SEC", "30"))
+
+	failOnConfigMismatch, _ := strconv.ParseBool(getEnv("FAIL_ON_CONFIG_MISMATCH", "false"))
+
+	// Transient Receive errors restart receiving with a backoff, unless the
+	// cap is 0: then they stop the worker for Kubernetes to restart.
+	receiveBackoffInitialMs, _ := strconv.Atoi(getEnv("RECEIVE_BACKOFF_INITIAL_MS", "1000"))
+	receiveBackoffMaxSec, _ := strconv.Atoi(getEnv("RECEIVE_BACKOFF_MAX_SEC", "60"))
+	receiveBackoffInitial := time.Duration(receiveBackoffInitialMs) * time.Millisecond
+	receiveBackoffMax := time.Duration(receiveBackoffMaxSec) * time.Second
+	if receiveBackoffMax > 0 && (receiveBackoffInitial <= 0 || receiveBackoffInitial > receiveBackoffMax) {
+		fatal("RECEIVE_BACKOFF_INITIAL_MS must be positive and at most RECEIVE_BACKOFF_MAX_SEC", "initialMs", receiveBackoffInitialMs, "maxSec", receiveBackoffMaxSec)
+	}
+	autoCreate, _ := strconv.ParseBool(getEnv("AUTO_CREATE", "true"))
+	resultsTopicID := getEnv("RESULTS_TOPIC_ID", "")
+
+	// In-app dead-letter routing is off unless a topic is set.
+	dlqTopicID := getEnv("DLQ_TOPIC_ID", "")
+	dlqPolicyName := getEnv("DLQ_POLICY", "either")
+	dlqPolicy, err := lookupDeadLetterPolicy(dlqPolicyName)
+	if err != nil {
+		fatal("Invalid DLQ_POLICY", "err", err)
+	}
+	dlqMaxAttempts, _ := strconv.Atoi(getEnv("DLQ_MAX_ATTEMPTS", "5"))
+	if dlqMaxAttempts < 1 {
+		fatal("DLQ_MAX_ATTEMPTS must be at least 1", "value", dlqMaxAttempts)
+	}
+	dlqReasons := parseFailureReasons(getEnv("DLQ_REASONS", failurePoison))
+
+	// Deduplication is off unless a window is set. Redis shares it across
+	// pods; without an address each pod dedupes on its own. A delivery is
+	// claimed for about as long as a job takes, so the claim of a job lost
+	// with its pod runs out soon after the message is redelivered.
+	dedupeWindowSec, _ := strconv.Atoi(getEnv("DEDUPE_WINDOW_SEC", "0"))
+	var dedupe dedupeStore
+	if dedupeWindowSec > 0 {
+		window := time.Duration(dedupeWindowSec) * time.Second
+		inProgress := jobDuration + dedupeClaimMargin
+		if addr := getEnv("DEDUPE_REDIS_ADDR", ""); addr != "" {
+			redisDedupe, err := newRedisDedupe(addr, getEnv("DEDUPE_REDIS_CA_FILE", ""), "dedupe:"+subscriptionID+":", window, inProgress)
+			if err != nil {
+				fatal("Invalid DEDUPE_REDIS_ADDR", "err", err)
+			}
+			dedupe = redisDedupe
+			slog.Info("Deduplicating messages across pods through Redis", "window", window)
+		} else {
+			dedupe = newMemoryDedupe(window, inProgress)
+			slog.Info("Deduplicating messages in memory", "window", window)
+		}
+	}
+
+	// Heartbeats are off unless a topic is set.
+	heartbeatTopicID := getEnv("HEARTBEAT_TOPIC_ID", "")
+	heartbeatIntervalSec, _ := strconv.Atoi(getEnv("HEARTBEAT_INTERVAL_SEC", "30"))
+	if heartbeatTopicID != "" && heartbeatIntervalSec <= 0 {
+		fatal("HEARTBEAT_INTERVAL_SEC must be positive", "value", heartbeatIntervalSec)
+	}
+
+	// Loop mode republishes every processed message to keep the backlog
+	// full forever, so it is only allowed in test mode.
+	testMode, _ := strconv.ParseBool(getEnv("TEST_MODE", "false"))
+	loopMode, _ := strconv.ParseBool(getEnv("LOOP_MODE", "false"))
+	topicID := getEnv("TOPIC_ID", "")
+	if loopMode && !testMode {
+		fatal("LOOP_MODE requires TEST_MODE=true")
+	}
+	if loopMode && topicID == "" {
+		fatal("LOOP_MODE requires TOPIC_ID to be set")
+	}
+	if startupCanary && topicID == "" {
+		fatal("STARTUP_CANARY requires TOPIC_ID to be set")
+	}
+
+	// Match GOMAXPROCS to the container CPU limit so CPU-based scaling demos
+	// reflect what the pod can actually use.
+	if autoMaxProcs, _ := strconv.ParseBool(getEnv("AUTO_GOMAXPROCS", "false")); autoMaxProcs {
+		procs, limited, err := setMaxProcsFromCgroup()
+		switch {
+		case err != nil:
+			slog.Warn("Could not read CPU limit, keeping GOMAXPROCS", "gomaxprocs", procs, "err", err)
+		case limited:
+			slog.Info("Set GOMAXPROCS from container CPU limit", "gomaxprocs", procs)
+		default:
+			slog.Info("No container CPU limit found, keeping GOMAXPROCS", "gomaxprocs", procs)
+		}
+	}
+
+	// Promote allowlisted message attributes to metric labels.
+	attrLabelsMaxSeries, _ := strconv.Atoi(getEnv("ATTRIBUTE_LABELS_MAX_SERIES", "100"))
+	attrLabels, err := newAttributeLabels(getEnv("ATTRIBUTE_LABELS", ""), attrLabelsMaxSeries)
+	if err != nil {
+		fatal("Invalid ATTRIBUTE_LABELS", "err", err)
+	}
+
+	// Every metric, including the Go runtime ones, carries CONSTANT_LABELS.
+	// Their names are checked against the labels of everything registered
+	// below, so a collision exits here instead of panicking in MustRegister.
+	var dryRun collectingRegisterer
+	registerCollectors(&dryRun, nil, attrLabels)
+	constLabels, err := parseConstantLabels(getEnv("CONSTANT_LABELS", ""), dryRun.labelNames())
+	if err != nil {
+		fatal("Invalid CONSTANT_LABELS", "err", err)
+	}
+	registry := prometheus.NewRegistry()
+	reg := prometheus.WrapRegistererWith(constLabels, registry)
+	metricsHandler := registerCollectors(reg, registry, attrLabels)
+
+	// Label job latency by jobType, for the allowlisted types only.
+	jobTypes, err := parseJobTypes(getEnv("JOB_TYPES", ""))
+	if err != nil {
+		fatal("Invalid JOB_TYPES", "err", err)
+	}
+	for _, jt := range jobTypes.labels() {
+		jobProcessingDuration.WithLabelValues(jt)
+	}
+
+	startedAt := time.Now()
+	startTime.SetToCurrentTime()
+	workConfigInfo.WithLabelValues(workFuncName, strconv.Itoa(jobDurationSec), strconv.Itoa(workMemoryMB), strconv.Itoa(maxOutstanding)).Set(1)
+
 	// --- Global State ---
 	// This state tracks when we last processed a job.
 	state := &globalState{
-		lastJobTime:   time.Now(), // Initialize to now
-		metricValue:   0,
-		metricTimeout: metricTimeout,
+		lastJobTime:    time.Now(), // Initialize to now
+		metricValue:    0,
+		metricTimeout:  metricTimeout,
+		gaugeMode:      gaugeMode,
+		decayFactor:    decayFactor,
+		maxOutstanding: maxOutstanding,
+		maxDistinct:    distinctMax,
+		throughput:     newThroughputMeter(time.Duration(throughputWindowSec) * time.Second),
+		lastErrorTTL:   time.Duration(lastErrorClearSec) * time.Second,
+		minNumJobs:     minNumJobs,
+		scaleFactor:    metricScaleFactor,
+		averages:       newValueWindow(time.Duration(averageWindowSec) * time.Second),
+		outcomes:       newOutcomeWindow(time.Duration(successRatioWindowSec) * time.Second),
+		concurrency:    newConcurrencyAverage(time.Duration(concurrencyWindowSec) * time.Second),
+		replicas:       replicaTarget{jobsPerReplica: jobsPerReplica, min: minReplicas, max: maxReplicas},
+	}
+	// Export the floor (or 0) and its replica count before any message.
+	state.setGauge(0)
+	processingSuccessRatio.Set(1)
+
+	// In "add" mode the gauge counts this pod's in-flight work, which
+	// doesn't survive a restart.
+	if metricStateFile != "" && gaugeMode == gaugeModeSet {
+		restored, err := state.restoreMetric(metricStateFile, time.Duration(metricStateMaxAgeSec)*time.Second, time.Now())
+		switch {
+		case err != nil:
+			slog.Warn("Could not restore metric", "err", err)
+		case restored:
+			slog.Info("Restored metric from before the restart", "numJobs", state.snapshot().NumJobs)
+		}
 	}
 
+	pauser := &pauseController{}
+	ready := &readiness{}
+	status := &statusServer{state: state, ready: ready, pauser: pauser, startedAt: startedAt, lease: leaseAdvice}
+
 	// --- Start Metrics Server ---
-	// This goroutine serves the /metrics endpoint
+	// This goroutine serves /metrics and the other HTTP endpoints
 	go func() {
-		log.Println("Starting metrics server on :8080")
-		http.Handle("/metrics", promhttp.Handler())
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Fatalf("Metrics server failed: %v", err)
+		slog.Info("Starting metrics server", "addr", ":8080")
+		http.Handle("/metrics", metricsHandler)
+		http.HandleFunc("/metrics.json", state.serveMetricsJSON)
+		http.HandleFunc("/jobs", state.serveJobs)
+		http.HandleFunc("/lasterror", state.serveLastError)
+		http.HandleFunc("/healthz", serveHealthz)
+		http.HandleFunc("/readyz", ready.serveReadyz)
+		http.HandleFunc("/status", status.serveStatus)
+		http.HandleFunc("/config", status.serveConfig)
+		// Pausing is a test-mode tool for demonstrating controlled drains.
+		if testMode {
+			http.HandleFunc("/pause", pauser.servePause)
+			http.HandleFunc("/resume", pauser.serveResume)
+		}
+		ln, err := listenWithRetry(":8080", metricsBindRetry)
+		if err != nil {
+			fatal("Metrics server failed", "err", err)
+		}
+		if err := http.Serve(ln, nil); err != nil {
+			fatal("Metrics server failed", "err", err)
 		}
 	}()
 
+	// For local runs without Prometheus, print the metrics periodically.
+	if metricsStdoutIntervalSec > 0 {
+		go printMetrics(registry, time.Duration(metricsStdoutIntervalSec)*time.Second)
+	}
+
+	// For StatsD or Datadog pipelines, send the core metrics there as well.
+	if statsdAddr := getEnv("STATSD_ADDR", ""); statsdAddr != "" {
+		statsdIntervalSec, _ := strconv.Atoi(getEnv("STATSD_INTERVAL_SEC", "10"))
+		if statsdIntervalSec <= 0 {
+			fatal("STATSD_INTERVAL_SEC must be positive", "value", statsdIntervalSec)
+		}
+		exporter, err := newStatsdExporter(statsdAddr, getEnv("STATSD_PREFIX", ""), registry)
+		if err != nil {
+			fatal("Invalid STATSD_ADDR", "err", err)
+		}
+		slog.Info("Sending metrics to StatsD", "addr", statsdAddr, "interval", time.Duration(statsdIntervalSec)*time.Second)
+		go exporter.run(time.Duration(statsdIntervalSec) * time.Second)
+	}
+
 	// --- Start Metric Updater ---
 	// This goroutine is responsible for setting the metric to 0
 	// if we haven't received a job in a while (metricTimeout).
 	go state.metricUpdater()
+	if distinctResetSec > 0 {
+		go state.resetDistinct(time.Duration(distinctResetSec) * time.Second)
+	}
+	if metricStateFile != "" {
+		go state.persistMetric(metricStateFile, metricStateSaveInterval)
+	}
 
 	// --- Start Pub/Sub Client ---
-	ctx := context.Background()
-	client, err := pubsub.NewClient(ctx, projectID)
+	// The context is cancelled on SIGTERM, so Receive stops pulling new
+	// messages and the shutdown grace period below starts.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Jobs in progress get SHUTDOWN_GRACE_SEC to finish after SIGTERM. If
+	// the worker still hasn't stopped shortly after that, exit anyway.
+	shutdownGrace := time.Duration(shutdownGraceSec) * time.Second
+	workCtx, cancelWork := withShutdownGrace(ctx, shutdownGrace)
+	defer cancelWork()
+	go func() {
+		<-workCtx.Done()
+		time.Sleep(5 * time.Second)
+		fatal("Worker did not stop after the shutdown grace period, forcing exit")
+	}()
+
+	if cpuProfileInterval > 0 {
+		sink, err := newProfileSink(ctx, getEnv("CPU_PROFILE_DEST", "/tmp/profiles"))
+		if err != nil {
+			fatal("Invalid CPU_PROFILE_DEST", "err", err)
+		}
+		go state.profileCPU(ctx, sink, cpuProfileInterval, cpuProfileDuration)
+	}
+
+	// Compare the publisher-supplied numJobs with the real backlog.
+	if backlogPollIntervalSec > 0 {
+		go state.pollBacklog(ctx, projectID, subscriptionID, time.Duration(backlogPollIntervalSec)*time.Second)
+	}
+	clientOpts, err := pubsubClientOptions()
+	if err != nil {
+		fatal("Failed to configure pubsub client", "err", err)
+	}
+	projects := parseProjects(getEnv("PROJECTS", ""), projectID)
+	credentialsDir := getEnv("PROJECT_CREDENTIALS_DIR", "")
+	client, err := pubsub.NewClient(ctx, projectID, projectClientOptions(clientOpts, credentialsDir, projectID)...)
 	if err != nil {
-		log.Fatalf("Failed to create pubsub client: %v", err)
+		fatal("Failed to create pubsub client", "err", err)
 	}
 	defer client.Close()
 
-	log.Printf("Listening to subscription '%s'...", subscriptionID)
-	log.Printf("Config: Job Duration: %v, Metric Timeout: %v", jobDuration, metricTimeout)
+	slog.Info("Listening to subscription", "subscription", subscriptionID)
+	slog.Info("Config", "jobDuration", jobDuration, "metricTimeout", metricTimeout, "gaugeMode", gaugeMode)
 
-	// --- Start Message Receiver ---
-	sub := client.Subscription(subscriptionID)
-	// CRITICAL: This ensures the pod only ever works on one message at a time.
-	sub.ReceiveSettings.MaxOutstandingMessages = 1
-
-	// Receive blocks until the context is cancelled.
-	err = sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		log.Println("Received message!")
+	var loopTopic *pubsub.Topic
+	if loopMode {
+		loopTopic, err = getOrCreateTopic(ctx, client, topicID, autoCreate)
+		if err != nil {
+			fatal("Failed to resolve loop topic", "err", err)
+		}
+		defer loopTopic.Stop()
+		slog.Info("LOOP_MODE enabled: processed messages are republished", "topic", topicID)
+	}
 
-		// 1. Parse the "numJobs" attribute from the message
-		jobValStr := msg.Attributes["numJobs"]
-		jobVal, err := strconv.ParseFloat(jobValStr, 64)
+	var resultsTopic *pubsub.Topic
+	if resultsTopicID != "" {
+		resultsTopic, err = getOrCreateTopic(ctx, client, resultsTopicID, autoCreate)
 		if err != nil {
-			log.Printf("Warning: 'numJobs' attribute missing or invalid: %v", err)
-			jobVal = 1 // Default to 1 if missing
+			fatal("Failed to resolve results topic", "err", err)
 		}
+		defer resultsTopic.Stop()
+		slog.Info("Publishing job results", "topic", resultsTopicID)
+	}
 
-		// 2. Update global state and metric
-		state.updateMetric(jobVal)
-		log.Printf("Set numJobs metric to %.0f", jobVal)
+	var deadLetter *deadLetterRouter
+	if dlqTopicID != "" {
+		dlqTopic, err := getOrCreateTopic(ctx, client, dlqTopicID, autoCreate)
+		if err != nil {
+			fatal("Failed to resolve dead-letter topic", "err", err)
+		}
+		defer dlqTopic.Stop()
+		deadLetter = &deadLetterRouter{
+			topic:  dlqTopic,
+			subID:  subscriptionID,
+			policy: dlqPolicy,
+			rule:   deadLetterRule{maxAttempts: dlqMaxAttempts, reasons: dlqReasons},
+		}
+		slog.Info("Routing failed messages to the dead-letter topic", "topic", dlqTopicID, "policy", dlqPolicyName)
+	}
 
-		// 3. Simulate the long-running, low-CPU work
-		log.Printf("Starting work (simulated duration: %v)...", jobDuration)
-		simulateWork(jobDuration)
-		log.Println("Work finished.")
+	if heartbeatTopicID != "" {
+		// Heartbeats on the job topic would be received as jobs.
+		if heartbeatTopicID == topicID {
+			fatal("HEARTBEAT_TOPIC_ID must differ from TOPIC_ID", "topic", heartbeatTopicID)
+		}
+		heartbeatTopic, err := getOrCreateTopic(ctx, client, heartbeatTopicID, autoCreate)
+		if err != nil {
+			fatal("Failed to resolve heartbeat topic", "err", err)
+		}
+		defer heartbeatTopic.Stop()
+		pod, _ := os.Hostname()
+		slog.Info("Publishing heartbeats", "topic", heartbeatTopicID, "interval", time.Duration(heartbeatIntervalSec)*time.Second)
+		go state.sendHeartbeats(ctx, heartbeatTopic, pod, startedAt, time.Duration(heartbeatIntervalSec)*time.Second)
+	}
 
-		// 4. Acknowledge the message
-		// This tells Pub/Sub we are done, and the client is free
-		// to pull the next message (respecting MaxOutstandingMessages=1).
-		msg.Ack()
-	})
+	// --- Start Message Receiver ---
+	expectations := loadSubscriptionExpectations()
+	// Pub/Sub rejects expiration policies shorter than a day.
+	if expectations.expiration > 0 && expectations.expiration < 24*time.Hour {
+		fatal("SUB_EXPIRATION_SEC must be at least 86400 (1 day), or -1 for never", "value", int(expectations.expiration.Seconds()))
+	}
+	// The client's synchronous pull doesn't work with exactly-once delivery.
+	if expectations.exactlyOnce && mode != modeStream {
+		fatal("EXACTLY_ONCE requires RECEIVE_MODE=stream: synchronous pull does not support exactly-once delivery", "mode", mode)
+	}
+	sub, err := getOrCreateSubscription(ctx, client, subscriptionID, topicID, autoCreate, expectations)
+	if err != nil {
+		fatal("Failed to resolve subscription", "err", err)
+	}
 
+	// Surface drift between the subscription and what we were configured for.
+	mismatches, err := checkSubscriptionConfig(ctx, sub, expectations)
 	if err != nil {
-		log.Fatalf("Pub/Sub Receive error: %v", err)
+		slog.Warn("Could not read subscription config", "err", err)
+	}
+	for _, m := range mismatches {
+		slog.Warn("Subscription config mismatch", "mismatch", m)
+	}
+	if len(mismatches) > 0 && failOnConfigMismatch {
+		fatal("Subscription does not match the expected config (FAIL_ON_CONFIG_MISMATCH=true)", "subscription", subscriptionID)
+	}
+	// CRITICAL: The default of 1 ensures the pod only ever works on one
+	// message at a time, so numJobs maps cleanly onto pods.
+	sub.ReceiveSettings.MaxOutstandingMessages = maxOutstanding
+	maxOutstandingConfigured.Set(float64(maxOutstanding))
+	leases.apply(&sub.ReceiveSettings)
+	sub.ReceiveSettings.Synchronous = mode == modeSync
+
+	h := &messageHandler{
+		state:          state,
+		jobDuration:    jobDuration,
+		defaultNumJobs: defaultNumJobs,
+		work:           withAllocSampling(withMemory(work, workMemoryMB), allocSampleRate, rng),
+		lifetime:       workCtx,
+		attrLabels:     attrLabels,
+		loopTopic:      loopTopic,
+		resultsTopic:   resultsTopic,
+		deadLetter:     deadLetter,
+		dedupe:         dedupe,
+		leases:         newLeaseTracker(leases.effectiveMaxExtension()),
+		jobTypes:       jobTypes,
+		exactlyOnce:    expectations.exactlyOnce,
+		logSample:      &logSampler{rate: logSampleRate, deterministic: logSampleMode == "deterministic", rand: rng},
+		testMode:       testMode,
+		pressure:       pressure,
+		normalizeAttrs: normalizeAttrs,
+	}
+	if orderedDrain {
+		h.ordered = newOrderedAcks()
 	}
-}
 
-// simulateWork performs a task that takes time but is not 100% CPU-bound.
-// This is key to showing why CPU scaling is not effective.
-func simulateWork(duration time.Duration) {
-	startTime := time.Now()
-	for time.Since(startTime) < duration {
-		// Perform some trivial calculations to generate a *little* CPU load
-		for i := 0; i < 1000000; i++ {
-			_ = math.Sqrt(float64(i))
+	// Simulate a slow application start. The HTTP endpoints are already
+	// up, but /readyz fails until processing begins.
+	if startupDelaySec > 0 {
+		slog.Info("Delaying startup", "delay", time.Duration(startupDelaySec)*time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(startupDelaySec) * time.Second):
 		}
-		// Sleep to stretch the job's duration without maxing out the CPU
-		time.Sleep(50 * time.Millisecond)
+		slog.Info("Startup delay over, processing messages.")
 	}
-}
 
-// updateMetric safely updates the global state and the Prometheus gauge.
-func (s *globalState) updateMetric(value float64) {
-	s.mu.Lock()
-	s.lastJobTime = time.Now()
-	s.metricValue = value
-	s.mu.Unlock()
-	numJobs.Set(value)
-}
+	// Prove that messages published to TOPIC_ID reach the subscription with
+	// their attributes intact before reporting ready. Jobs are processed
+	// in the meantime.
+	if startupCanary {
+		topic := client.Topic(topicID)
+		defer topic.Stop()
+		h.canary = newCanaryWatch(newRequestID())
+		go h.canary.run(ctx, topic, time.Duration(startupCanaryTimeoutSec)*time.Second, ready)
+	} else {
+		ready.ready.Store(true)
+	}
+
+	// Outside ACTIVE_HOURS the worker is paused like through /pause.
+	if activeHours != nil {
+		gate := &activeHoursGate{window: activeHours, pauser: pauser, state: state, now: time.Now}
+		go gate.run(ctx, 30*time.Second)
+	}
 
-// metricUpdater runs in a loop, checking if the last job is stale.
-// If it is, it sets the metric to 0 to allow the HPA to scale down.
-func (s *globalState) metricUpdater() {
-	// Check every 10 seconds
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	// pull-once drains a fixed number of messages and exits, which keeps
+	// tests and batch runs deterministic.
+	if mode == modePullOnce {
+		n, err := pullOnce(ctx, sub, h, pullMaxMessages, time.Duration(pullIdleTimeoutSec)*time.Second)
+		if err != nil {
+			fatal("Pub/Sub pull error", "err", err)
+		}
+		slog.Info("Pull-once finished.", "messages", n)
+		return
+	}
 
-	for range ticker.C {
-		s.mu.RLock()
-		lastJob := s.lastJobTime
-		timeout := s.metricTimeout
-		s.mu.RUnlock()
+	// With PROJECTS, the same subscription is consumed in every project, each
+	// with its own client. A project that can't be set up is skipped so the
+	// others still run.
+	receivers := []*receiver{{project: projectID, client: client, sub: sub, subID: subscriptionID, topicID: topicID, autoCreate: autoCreate, want: expectations}}
+	for _, p := range projects[1:] {
+		r, err := newReceiver(ctx, p, projectClientOptions(clientOpts, credentialsDir, p), subscriptionID, topicID, autoCreate, expectations, sub.ReceiveSettings)
+		if err != nil {
+			slog.Error("Skipping project", "project", p, "err", err)
+			continue
+		}
+		defer r.client.Close()
+		receivers = append(receivers, r)
+	}
+	if len(projects) > 1 {
+		slog.Info("Receiving from multiple projects", "projects", len(receivers), "configured", len(projects))
+	}
+	// Every receiver applies MAX_OUTSTANDING_MESSAGES on its own, so the
+	// worker only runs out of room once all of them are full. The metric
+	// stays one signal: numJobs is whatever the last message reported, from
+	// any project.
+	state.setMaxOutstanding(maxOutstanding * len(receivers))
 
-		if time.Since(lastJob) > timeout {
-			log.Println("No jobs received in timeout period. Setting numJobs metric to 0.")
-			numJobs.Set(0)
+	// Each Receive blocks until the context is cancelled. If one fails for
+	// good, the group cancels the others and the worker exits.
+	g, gctx := errgroup.WithContext(ctx)
+	for _, r := range receivers {
+		r := r
+		r.tolerateAccessErrors = len(receivers) > 1
+		if receiveBackoffMax > 0 {
+			r.backoff = newRestartBackoff(receiveBackoffInitial, receiveBackoffMax, rng)
 		}
+		g.Go(func() error { return r.run(gctx, pauser, h) })
+	}
+	if err := g.Wait(); err != nil {
+		fatal("Pub/Sub Receive error", "err", err)
+	}
+	if workCtx.Err() != nil {
+		slog.Warn("Shutdown was forced: jobs in progress were aborted and nacked.")
+	} else {
+		slog.Info("Shutdown was graceful: all jobs in progress finished.")
 	}
 }
 
 // getEnv is a helper to read an env var with a fallback.
 func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		value = fallback
 	}
-	return fallback
+	settings.record(key, value)
+	return value
 }
-
@@ -0,0 +1,1119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResetIfStaleCountsTransitions(t *testing.T) {
+	state := &globalState{metricTimeout: time.Minute}
+	start := testutil.ToFloat64(gaugeResets)
+
+	state.updateMetric(5)
+	now := time.Now()
+
+	// Still fresh: nothing happens.
+	state.resetIfStale(now.Add(30 * time.Second))
+	if got := testutil.ToFloat64(numJobs); got != 5 {
+		t.Fatalf("numJobs = %v before timeout, want 5", got)
+	}
+
+	// Stale: the gauge drops to 0 and one reset is counted.
+	state.resetIfStale(now.Add(2 * time.Minute))
+	if got := testutil.ToFloat64(numJobs); got != 0 {
+		t.Fatalf("numJobs = %v after timeout, want 0", got)
+	}
+
+	// Further idle ticks must not count again.
+	state.resetIfStale(now.Add(3 * time.Minute))
+	state.resetIfStale(now.Add(4 * time.Minute))
+	if got := testutil.ToFloat64(gaugeResets) - start; got != 1 {
+		t.Fatalf("gauge_resets_total grew by %v, want 1", got)
+	}
+
+	// A new job followed by another timeout is a second transition.
+	state.updateMetric(3)
+	state.resetIfStale(time.Now().Add(2 * time.Minute))
+	if got := testutil.ToFloat64(gaugeResets) - start; got != 2 {
+		t.Fatalf("gauge_resets_total grew by %v, want 2", got)
+	}
+}
+
+func TestUpdateMetricConcurrent(t *testing.T) {
+	state := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(v float64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				state.updateMetric(v)
+			}
+		}(float64(i))
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				state.mu.RLock()
+				_ = state.metricValue
+				_ = state.lastJobTime
+				state.mu.RUnlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	state.mu.RLock()
+	want := state.metricValue
+	state.mu.RUnlock()
+	if got := testutil.ToFloat64(numJobs); got != want {
+		t.Fatalf("numJobs = %v, want last stored value %v", got, want)
+	}
+}
+
+func TestUpdateMetricConcurrentWithReset(t *testing.T) {
+	// A zero timeout makes every resetIfStale call race with the updates.
+	state := &globalState{metricTimeout: 0, gaugeMode: gaugeModeSet}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(v float64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				state.updateMetric(v + 1)
+			}
+		}(float64(i))
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				state.resetIfStale(time.Now().Add(time.Second))
+			}
+		}()
+	}
+	wg.Wait()
+
+	state.mu.RLock()
+	want := state.metricValue
+	state.mu.RUnlock()
+	if got := testutil.ToFloat64(numJobs); got != want {
+		t.Fatalf("numJobs = %v, want last stored value %v", got, want)
+	}
+}
+
+func TestAddMetricConcurrent(t *testing.T) {
+	state := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeAdd}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(v float64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				state.addMetric(v)
+				state.addMetric(-v)
+			}
+		}(float64(i))
+	}
+	wg.Wait()
+
+	if got := testutil.ToFloat64(numJobs); got != 0 {
+		t.Fatalf("numJobs = %v after balanced adds, want 0", got)
+	}
+}
+
+func TestResetIfStaleDecay(t *testing.T) {
+	state := &globalState{metricTimeout: time.Minute, decayFactor: 0.5}
+	start := testutil.ToFloat64(gaugeResets)
+
+	state.updateMetric(8)
+	stale := time.Now().Add(2 * time.Minute)
+
+	// The value halves every tick until it would drop below 0.5, then snaps to 0.
+	for _, want := range []float64{4, 2, 1, 0.5, 0, 0} {
+		state.resetIfStale(stale)
+		if got := testutil.ToFloat64(numJobs); got != want {
+			t.Fatalf("numJobs = %v, want %v", got, want)
+		}
+	}
+	if got := testutil.ToFloat64(gaugeResets) - start; got != 1 {
+		t.Fatalf("gauge_resets_total grew by %v, want 1", got)
+	}
+}
+
+func TestMetricScaleFactor(t *testing.T) {
+	state := &globalState{
+		metricTimeout: time.Minute,
+		decayFactor:   0.5,
+		minNumJobs:    0.2,
+		scaleFactor:   10,
+		replicas:      replicaTarget{jobsPerReplica: 1, min: 1},
+	}
+	check := func(step string, want float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(numJobs); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("%s: numJobs = %v, want %v", step, got, want)
+		}
+	}
+
+	state.setGauge(0)
+	check("initial floor", 2)
+	state.updateMetric(3)
+	check("updateMetric", 30)
+	// The replica count is still derived from jobs, not scaled units.
+	if got := testutil.ToFloat64(desiredReplicas); got != 3 {
+		t.Fatalf("desired_replicas = %v, want 3", got)
+	}
+	state.addMetric(1.5)
+	check("addMetric", 45)
+
+	stale := time.Now().Add(2 * time.Minute)
+	state.resetIfStale(stale)
+	check("decay", 22.5)
+	state.metricValue = 0.6
+	state.resetIfStale(stale)
+	check("reset", 2)
+	// /metrics.json reports jobs, not scaled units.
+	if got := state.snapshot().NumJobs; got != 0.2 {
+		t.Fatalf("snapshot numJobs = %v, want 0.2", got)
+	}
+}
+
+func TestActiveJobsShareRequestID(t *testing.T) {
+	state := &globalState{throughput: newThroughputMeter(time.Minute)}
+	start := time.Now()
+	// A retried publish can deliver the same request ID twice.
+	state.jobStarted(activeJob{RequestID: "req", MessageID: "1", StartedAt: start})
+	state.jobStarted(activeJob{RequestID: "req", MessageID: "2", StartedAt: start.Add(time.Second)})
+	if jobs := state.activeJobs(); len(jobs) != 2 {
+		t.Fatalf("got %d active jobs, want 2", len(jobs))
+	}
+	state.jobFinished("1")
+	jobs := state.activeJobs()
+	if len(jobs) != 1 || jobs[0].MessageID != "2" {
+		t.Errorf("active jobs = %+v, want only message 2", jobs)
+	}
+}
+
+func TestSecondsToDrain(t *testing.T) {
+	state := &globalState{
+		metricTimeout: time.Minute,
+		throughput:    newThroughputMeter(time.Minute),
+		replicas:      replicaTarget{jobsPerReplica: 4},
+	}
+
+	// Work is waiting but nothing has completed yet.
+	state.updateMetric(12)
+	state.jobStarted(activeJob{MessageID: "a"})
+	state.updateSecondsToDrain(time.Now())
+	if got := testutil.ToFloat64(secondsToDrain); !math.IsInf(got, 1) {
+		t.Fatalf("seconds_to_drain = %v before any completion, want +Inf", got)
+	}
+
+	// One completion in the last minute: 12 jobs over 3 replicas leave this
+	// pod 4 jobs, which take 4 minutes.
+	state.jobFinished("a")
+	state.jobCompleted()
+	if got := testutil.ToFloat64(secondsToDrain); got != 240 {
+		t.Fatalf("seconds_to_drain = %v, want 240", got)
+	}
+
+	state.updateMetric(0)
+	state.updateSecondsToDrain(time.Now())
+	if got := testutil.ToFloat64(secondsToDrain); got != 0 {
+		t.Fatalf("seconds_to_drain = %v with no work left, want 0", got)
+	}
+}
+
+func TestFlowControlBlockedAcrossProjects(t *testing.T) {
+	// Two projects, each allowed one outstanding message.
+	s := &globalState{maxOutstanding: 1}
+	s.setMaxOutstanding(2)
+
+	s.messageStarted()
+	time.Sleep(10 * time.Millisecond)
+	if blocked := s.snapshot().FlowControlBlockedSeconds; blocked != 0 {
+		t.Errorf("blocked for %vs with one project's subscription full, want 0", blocked)
+	}
+	s.messageStarted()
+	time.Sleep(10 * time.Millisecond)
+	s.messageFinished()
+	s.messageFinished()
+	if blocked := s.snapshot().FlowControlBlockedSeconds; blocked < 0.01 {
+		t.Errorf("blocked for %vs with both full, want at least 0.01s", blocked)
+	}
+}
+
+func TestPeakOutstandingTracksMaximum(t *testing.T) {
+	state := &globalState{metricTimeout: time.Minute}
+
+	// Three messages at once, then they drain.
+	for i := 0; i < 3; i++ {
+		state.messageStarted()
+	}
+	for i := 0; i < 3; i++ {
+		state.messageFinished()
+	}
+	if got := testutil.ToFloat64(peakOutstanding); got != 3 {
+		t.Fatalf("peak_outstanding_messages = %v, want 3", got)
+	}
+
+	// Later, smaller bursts must not lower the peak.
+	state.messageStarted()
+	state.messageStarted()
+	state.messageFinished()
+	state.messageFinished()
+	if got := testutil.ToFloat64(peakOutstanding); got != 3 {
+		t.Fatalf("peak_outstanding_messages = %v after a smaller burst, want 3", got)
+	}
+	if state.outstanding != 0 {
+		t.Fatalf("outstanding = %d after all messages finished, want 0", state.outstanding)
+	}
+
+	// Concurrent messages raise it.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		state.messageStarted()
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.messageFinished()
+		}()
+	}
+	wg.Wait()
+	if got := testutil.ToFloat64(peakOutstanding); got != 5 {
+		t.Fatalf("peak_outstanding_messages = %v, want 5", got)
+	}
+}
+
+func TestRandomSeedReproducible(t *testing.T) {
+	a := &logSampler{rate: 0.5, rand: newRandSource(42)}
+	b := &logSampler{rate: 0.5, rand: newRandSource(42)}
+	for i := 0; i < 100; i++ {
+		if a.sampled("id") != b.sampled("id") {
+			t.Fatalf("sampling decision %d differs between runs with the same seed", i)
+		}
+	}
+
+	// A different seed gives a different sequence.
+	c, d := newRandSource(1), newRandSource(2)
+	same := true
+	for i := 0; i < 10; i++ {
+		if c.Float64() != d.Float64() {
+			same = false
+		}
+	}
+	if same {
+		t.Fatal("different seeds produced the same sequence")
+	}
+}
+
+func TestSaveRestoreMetric(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metric.json")
+	now := time.Now()
+
+	saved := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+	saved.updateMetric(7)
+	if err := saved.saveMetric(path, now); err != nil {
+		t.Fatalf("saveMetric: %v", err)
+	}
+
+	restored := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+	ok, err := restored.restoreMetric(path, time.Minute, now.Add(10*time.Second))
+	if err != nil || !ok {
+		t.Fatalf("restoreMetric = %v, %v, want true, nil", ok, err)
+	}
+	if got := restored.snapshot().NumJobs; got != 7 {
+		t.Errorf("restored numJobs = %v, want 7", got)
+	}
+	if got := testutil.ToFloat64(numJobs); got != 7 {
+		t.Errorf("numJobs gauge = %v after restore, want 7", got)
+	}
+	if !restored.lastJobTime.Equal(saved.lastJobTime) {
+		t.Errorf("restored lastJobTime = %v, want %v", restored.lastJobTime, saved.lastJobTime)
+	}
+
+	// Too old to trust.
+	stale := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+	ok, err = stale.restoreMetric(path, time.Minute, now.Add(2*time.Minute))
+	if err != nil || ok {
+		t.Fatalf("restoreMetric of a stale file = %v, %v, want false, nil", ok, err)
+	}
+	if got := stale.snapshot().NumJobs; got != 0 {
+		t.Errorf("numJobs = %v after stale restore, want 0", got)
+	}
+
+	// No file yet, e.g. the first start.
+	ok, err = stale.restoreMetric(filepath.Join(t.TempDir(), "missing.json"), time.Minute, now)
+	if err != nil || ok {
+		t.Fatalf("restoreMetric of a missing file = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestParseLogContext(t *testing.T) {
+	attrs, err := parseLogContext(" deployment=canary, region = europe-west1,,")
+	if err != nil {
+		t.Fatalf("parseLogContext: %v", err)
+	}
+	want := []any{slog.String("deployment", "canary"), slog.String("region", "europe-west1")}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("parseLogContext = %v, want %v", attrs, want)
+	}
+	for _, bad := range []string{"deployment", "=canary", "a=1,a=2"} {
+		if _, err := parseLogContext(bad); err == nil {
+			t.Errorf("parseLogContext(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestObservePullDelay(t *testing.T) {
+	histogram := func() (count uint64, sum float64) {
+		var m dto.Metric
+		if err := pullDelay.Write(&m); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	count, sum := histogram()
+	now := time.Now()
+	second := 2
+
+	observePullDelay(&pubsub.Message{PublishTime: now.Add(-3 * time.Second)}, now)
+	// A publisher clock ahead of ours counts as no delay.
+	observePullDelay(&pubsub.Message{PublishTime: now.Add(time.Second)}, now)
+	// Redeliveries and messages without a publish time are skipped.
+	observePullDelay(&pubsub.Message{PublishTime: now.Add(-time.Minute), DeliveryAttempt: &second}, now)
+	observePullDelay(&pubsub.Message{}, now)
+
+	// Other tests observe delays too, so the sum only matches up to
+	// rounding.
+	gotCount, gotSum := histogram()
+	if gotCount-count != 2 || math.Abs(gotSum-sum-3) > 1e-9 {
+		t.Fatalf("recorded %d delays summing to %vs, want 2 summing to 3s", gotCount-count, gotSum-sum)
+	}
+}
+
+func TestConcurrencyAverage(t *testing.T) {
+	c := newConcurrencyAverage(time.Minute)
+	t0 := time.Unix(1000, 0)
+	if got := c.at(t0); got != 0 {
+		t.Errorf("average before any job = %v, want 0", got)
+	}
+	c.observe(t0, 2)
+	// After one window at 2 jobs, the average has moved 1-1/e of the way.
+	if got, want := c.at(t0.Add(time.Minute)), 2*(1-math.Exp(-1)); math.Abs(got-want) > 1e-9 {
+		t.Errorf("average after a window = %v, want %v", got, want)
+	}
+	c.observe(t0.Add(10*time.Minute), 0)
+	if got := c.at(t0.Add(10 * time.Minute)); math.Abs(got-2) > 0.01 {
+		t.Errorf("average after a long busy stretch = %v, want about 2", got)
+	}
+	if got := c.at(t0.Add(20 * time.Minute)); got > 0.01 {
+		t.Errorf("average after a long idle stretch = %v, want about 0", got)
+	}
+}
+
+func TestOrderedAcksPreserveReceiveOrder(t *testing.T) {
+	o := newOrderedAcks()
+	var settled []string
+	finish := func(id, key string, ack bool) {
+		o.finish(&pubsub.Message{ID: id, OrderingKey: key}, ack, func(ack bool) {
+			result := "ack"
+			if !ack {
+				result = "nack"
+			}
+			settled = append(settled, id+":"+result)
+		})
+	}
+	for _, m := range []struct{ id, key string }{{"a1", "a"}, {"a2", "a"}, {"a3", "a"}, {"b1", "b"}} {
+		o.register(&pubsub.Message{ID: m.id, OrderingKey: m.key})
+	}
+
+	// Jobs finish out of order, as when a drain cuts some short.
+	finish("a3", "a", true)
+	finish("b1", "b", true)
+	finish("a2", "a", true)
+	finish("unordered", "", true)
+	finish("a1", "a", true)
+	want := []string{"b1:ack", "unordered:ack", "a1:ack", "a2:ack", "a3:ack"}
+	if !reflect.DeepEqual(settled, want) {
+		t.Errorf("settled %v, want %v", settled, want)
+	}
+
+	// A nack also nacks the later messages with its key.
+	settled = nil
+	for _, id := range []string{"c1", "c2", "c3"} {
+		o.register(&pubsub.Message{ID: id, OrderingKey: "c"})
+	}
+	finish("c2", "c", true)
+	finish("c1", "c", false)
+	finish("c3", "c", true)
+	want = []string{"c1:nack", "c2:nack", "c3:nack"}
+	if !reflect.DeepEqual(settled, want) {
+		t.Errorf("settled %v, want %v", settled, want)
+	}
+	if len(o.keys) != 0 || len(o.byID) != 0 {
+		t.Errorf("entries left after every message was settled: %d keys, %d messages", len(o.keys), len(o.byID))
+	}
+}
+
+func TestStatsdExporter(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer ln.Close()
+
+	reg := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(prometheus.Labels{"env": "test"}, reg).MustRegister(numJobs, jobsProcessed)
+	e, err := newStatsdExporter(ln.LocalAddr().String(), "lab.", reg)
+	if err != nil {
+		t.Fatalf("newStatsdExporter: %v", err)
+	}
+	receive := func() string {
+		t.Helper()
+		ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, statsdMaxPacket)
+		n, _, err := ln.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	// The first flush sends the counter's total so far.
+	numJobs.Set(7)
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	receive()
+
+	jobsProcessed.Add(2)
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	got := strings.Split(receive(), "\n")
+	sort.Strings(got)
+	want := []string{"lab.jobs_processed_total:2|c|#env:test", "lab.numJobs:7|g|#env:test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestParseConstantLabels(t *testing.T) {
+	var reg collectingRegisterer
+	registerCollectors(&reg, nil, nil)
+	taken := reg.labelNames()
+
+	got, err := parseConstantLabels(" env=dev, region = europe-west1 ,", taken)
+	if err != nil {
+		t.Fatalf("parseConstantLabels: %v", err)
+	}
+	if want := (prometheus.Labels{"env": "dev", "region": "europe-west1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+
+	// code is the label of promhttp_metric_handler_requests_total and version
+	// a constant label of go_info, neither of them registered in
+	// registerMetrics.
+	taken = append(taken, "customer")
+	for _, value := range []string{"env", "__name__=x", "env=a,env=b", "project=p", "jobType=x", "le=1", "code=x", "version=1", "customer=acme"} {
+		if _, err := parseConstantLabels(value, taken); err == nil {
+			t.Errorf("parseConstantLabels(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestNewAttributeLabels(t *testing.T) {
+	a, err := newAttributeLabels(" tenant, region ,", 10)
+	if err != nil {
+		t.Fatalf("newAttributeLabels: %v", err)
+	}
+	if want := []string{"tenant", "region"}; !reflect.DeepEqual(a.names, want) {
+		t.Errorf("names = %v, want %v", a.names, want)
+	}
+	if a, err := newAttributeLabels(" , ", 10); a != nil || err != nil {
+		t.Errorf("newAttributeLabels of an empty list = %v, %v, want nil, nil", a, err)
+	}
+	for _, value := range []string{"1tenant", "ten-ant", "__x", "tenant,region,tenant"} {
+		if _, err := newAttributeLabels(value, 10); err == nil {
+			t.Errorf("newAttributeLabels(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestActiveHoursGate(t *testing.T) {
+	window, err := parseActiveHours("09:00-17:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatalf("parseActiveHours: %v", err)
+	}
+	berlin := window.loc
+	now := time.Date(2024, 3, 4, 8, 30, 0, 0, berlin)
+	pauser := &pauseController{}
+	state := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeSet}
+	g := &activeHoursGate{window: window, pauser: pauser, state: state, now: func() time.Time { return now }}
+	received := func() bool {
+		return pauser.receiveContext(context.Background()).Err() == nil
+	}
+
+	// Before the window opens, nothing is pulled and numJobs reads 0.
+	state.updateMetric(5)
+	g.check()
+	if received() {
+		t.Error("receiving at 08:30, before the window")
+	}
+	if got := state.snapshot().NumJobs; got != 0 {
+		t.Errorf("numJobs = %v outside the window, want 0", got)
+	}
+
+	now = time.Date(2024, 3, 4, 9, 0, 0, 0, berlin)
+	g.check()
+	if !received() {
+		t.Error("not receiving at 09:00, within the window")
+	}
+
+	// The window is in Berlin time, whatever the clock's zone.
+	now = time.Date(2024, 3, 4, 16, 30, 0, 0, time.UTC) // 17:30 in Berlin
+	g.check()
+	if received() {
+		t.Error("receiving at 17:30 Berlin time, after the window")
+	}
+
+	// A manual pause isn't lifted when the window opens.
+	pauser.resume()
+	g.pausedByWindow = false
+	pauser.pause()
+	now = time.Date(2024, 3, 5, 10, 0, 0, 0, berlin)
+	g.check()
+	if received() {
+		t.Error("the window resumed a worker paused through /pause")
+	}
+
+	// In "add" mode the running job's value stays until it finishes, so
+	// numJobs never goes negative.
+	addState := &globalState{metricTimeout: time.Minute, gaugeMode: gaugeModeAdd}
+	addGate := &activeHoursGate{window: window, pauser: &pauseController{}, state: addState, now: func() time.Time { return now }}
+	now = time.Date(2024, 3, 5, 8, 0, 0, 0, berlin)
+	addState.addMetric(3)
+	addGate.check()
+	if got := addState.snapshot().NumJobs; got != 3 {
+		t.Errorf("numJobs = %v in add mode after the window closed, want 3", got)
+	}
+	addState.addMetric(-3)
+	if got := addState.snapshot().NumJobs; got != 0 {
+		t.Errorf("numJobs = %v in add mode once the job finished, want 0", got)
+	}
+}
+
+func TestActiveWindowOvernight(t *testing.T) {
+	window, err := parseActiveHours("22:00-06:00", "UTC")
+	if err != nil {
+		t.Fatalf("parseActiveHours: %v", err)
+	}
+	for hour, want := range map[int]bool{21: false, 22: true, 3: true, 6: false, 12: false} {
+		if got := window.contains(time.Date(2024, 1, 1, hour, 0, 0, 0, time.UTC)); got != want {
+			t.Errorf("contains(%02d:00) = %v, want %v", hour, got, want)
+		}
+	}
+	for _, bad := range []string{"09:00", "9-17", "09:00-09:00", "25:00-26:00"} {
+		if _, err := parseActiveHours(bad, ""); err == nil {
+			t.Errorf("parseActiveHours(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestNormalizeAttributes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		attrs map[string]string
+		want  map[string]string
+	}{
+		{
+			name:  "canonical",
+			attrs: map[string]string{"numJobs": "3", "type": "keepalive"},
+			want:  map[string]string{"numJobs": "3", "type": "keepalive"},
+		},
+		{
+			name:  "key case and whitespace",
+			attrs: map[string]string{"NumJobs": "3", " TYPE ": "keepalive", "RequestID": "r-1"},
+			want:  map[string]string{"numJobs": "3", "type": "keepalive", "requestId": "r-1"},
+		},
+		{
+			name:  "value whitespace",
+			attrs: map[string]string{"numJobs": " 3\n", "durationSec": "30 "},
+			want:  map[string]string{"numJobs": "3", "durationSec": "30"},
+		},
+		{
+			name:  "case-folded values",
+			attrs: map[string]string{"type": "KeepAlive", "poison": "TRUE", "expiresAt": "2024-01-01T00:00:00Z"},
+			want:  map[string]string{"type": "keepalive", "poison": "true", "expiresAt": "2024-01-01T00:00:00Z"},
+		},
+		{
+			name:  "jobType keeps its case",
+			attrs: map[string]string{"JobType": " Report "},
+			want:  map[string]string{"jobType": "Report"},
+		},
+		{
+			name:  "canonical key wins",
+			attrs: map[string]string{"numJobs": "3", "NumJobs": "5"},
+			want:  map[string]string{"numJobs": "3", "NumJobs": "5"},
+		},
+		{
+			name:  "other attributes untouched",
+			attrs: map[string]string{"Team": " Blue "},
+			want:  map[string]string{"Team": " Blue "},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeAttributes(tc.attrs); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("normalizeAttributes(%q) = %q, want %q", tc.attrs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	getEnv("STATUS_TEST_SETTING", "fallback")
+	getEnv("STATUS_TEST_URL", "rediss://:secret@10.0.0.3:6378")
+	state := &globalState{metricTimeout: time.Minute}
+	state.updateMetric(4)
+	state.recordError(errors.New("boom"))
+	st := &statusServer{state: state, ready: &readiness{}, pauser: &pauseController{}, startedAt: time.Now().Add(-time.Minute)}
+	st.ready.ready.Store(true)
+	st.pauser.pause()
+	defer st.pauser.resume()
+
+	rec := httptest.NewRecorder()
+	st.serveStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var got workerStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding /status: %v", err)
+	}
+	if !got.Healthy || !got.Ready || !got.Paused {
+		t.Errorf("healthy, ready, paused = %v, %v, %v, want all true", got.Healthy, got.Ready, got.Paused)
+	}
+	if got.UptimeSec < 60 {
+		t.Errorf("uptimeSec = %v, want at least 60", got.UptimeSec)
+	}
+	if got.Metrics.NumJobs != 4 {
+		t.Errorf("metrics.numJobs = %v, want 4", got.Metrics.NumJobs)
+	}
+	if got.LastError.Message != "boom" {
+		t.Errorf("lastError = %+v, want boom", got.LastError)
+	}
+	if v := got.Config["STATUS_TEST_SETTING"]; v != "fallback" {
+		t.Errorf("config STATUS_TEST_SETTING = %q, want the default it was read with", v)
+	}
+	if v := got.Config["STATUS_TEST_URL"]; strings.Contains(v, "secret") {
+		t.Errorf("config STATUS_TEST_URL = %q, want the password masked", v)
+	}
+
+	rec = httptest.NewRecorder()
+	st.serveStatus(rec, httptest.NewRequest(http.MethodPost, "/status", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status returned %d, want 405", rec.Code)
+	}
+}
+
+func TestDeadLetterPolicies(t *testing.T) {
+	rule := deadLetterRule{maxAttempts: 5, reasons: parseFailureReasons(" poison ,")}
+	tests := []struct {
+		policy  string
+		failure jobFailure
+		want    bool
+	}{
+		{"reason", jobFailure{reason: failurePoison}, true},
+		{"reason", jobFailure{reason: failureRepublish, attempt: 9}, false},
+		{"attempts", jobFailure{reason: failurePoison, attempt: 1}, false},
+		{"attempts", jobFailure{reason: failureRepublish, attempt: 5}, true},
+		// Without a subscription dead-letter policy the attempt is unknown.
+		{"attempts", jobFailure{reason: failureRepublish}, false},
+		{"either", jobFailure{reason: failurePoison}, true},
+		{"either", jobFailure{reason: failureRepublish, attempt: 6}, true},
+		{"either", jobFailure{reason: failureRepublish, attempt: 2}, false},
+	}
+	for _, tt := range tests {
+		policy, err := lookupDeadLetterPolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("lookupDeadLetterPolicy(%q): %v", tt.policy, err)
+		}
+		d := &deadLetterRouter{policy: policy, rule: rule}
+		if got := d.shouldRoute(tt.failure); got != tt.want {
+			t.Errorf("%s policy routes %+v: %v, want %v", tt.policy, tt.failure, got, tt.want)
+		}
+	}
+
+	var off *deadLetterRouter
+	if off.shouldRoute(jobFailure{reason: failurePoison, attempt: 100}) {
+		t.Error("nil router routed a message")
+	}
+	if _, err := lookupDeadLetterPolicy("never"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestOutcomeWindow(t *testing.T) {
+	w := newOutcomeWindow(time.Minute)
+	start := time.Unix(1_700_000_000, 0)
+	if got := w.ratio(start); got != 1 {
+		t.Fatalf("ratio = %v with no data, want 1", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		w.record(start, true)
+	}
+	w.record(start.Add(30*time.Second), false)
+	if got := w.ratio(start.Add(30 * time.Second)); got != 0.75 {
+		t.Fatalf("ratio = %v, want 0.75", got)
+	}
+
+	// The successes leave the window first, then the failure too.
+	if got := w.ratio(start.Add(70 * time.Second)); got != 0 {
+		t.Fatalf("ratio = %v after the successes expired, want 0", got)
+	}
+	if got := w.ratio(start.Add(100 * time.Second)); got != 1 {
+		t.Fatalf("ratio = %v after everything expired, want 1", got)
+	}
+
+	// A slice reused on a later pass around the ring starts from zero.
+	w.record(start.Add(2*time.Minute), true)
+	if got := w.ratio(start.Add(2 * time.Minute)); got != 1 {
+		t.Fatalf("ratio = %v, want 1", got)
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	b := newRestartBackoff(time.Second, 10*time.Second, newRandSource(1))
+
+	// With full jitter every delay stays under a ceiling that doubles per
+	// failure up to the cap.
+	for i, ceiling := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if d := b.next(); d < 0 || d >= ceiling*time.Second {
+			t.Fatalf("failure %d: backoff %v, want in [0, %vs)", i+1, d, int(ceiling))
+		}
+	}
+
+	// Injected failures with the jitter at its top grow until the cap.
+	b = &restartBackoff{initial: time.Second, max: 10 * time.Second, jitter: func() float64 { return 1 }}
+	var got []time.Duration
+	for i := 0; i < 6; i++ {
+		got = append(got, b.next())
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("backoffs %v, want %v", got, want)
+	}
+
+	// Success starts over.
+	b.reset()
+	if d := b.next(); d != time.Second {
+		t.Fatalf("backoff after reset = %v, want 1s", d)
+	}
+
+	if !isTransientReceiveError(status.Error(codes.Unavailable, "down")) {
+		t.Error("Unavailable not treated as transient")
+	}
+	if isTransientReceiveError(status.Error(codes.InvalidArgument, "bad")) {
+		t.Error("InvalidArgument treated as transient")
+	}
+}
+
+func TestHeartbeatMessage(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	snap := metricsSnapshot{NumJobs: 6, InFlight: 2}
+	msg, err := heartbeatMessage("worker-abc", snap, now.Add(-90*time.Second), now)
+	if err != nil {
+		t.Fatalf("heartbeatMessage: %v", err)
+	}
+	if msg.Attributes["type"] != "heartbeat" || msg.Attributes["pod"] != "worker-abc" {
+		t.Errorf("attributes = %v, want type=heartbeat and pod=worker-abc", msg.Attributes)
+	}
+	var got heartbeat
+	if err := json.Unmarshal(msg.Data, &got); err != nil {
+		t.Fatalf("decoding heartbeat: %v", err)
+	}
+	want := heartbeat{Pod: "worker-abc", NumJobs: 6, InFlight: 2, UptimeSec: 90, SentAt: now}
+	if got != want {
+		t.Errorf("heartbeat = %+v, want %+v", got, want)
+	}
+}
+
+func TestDedupeStores(t *testing.T) {
+	ctx := context.Background()
+	// An AUTH-enabled Redis, as on Memorystore.
+	srv := miniredis.RunT(t)
+	srv.RequireAuth("secret")
+	addr := "redis://:secret@" + srv.Addr()
+	stores := map[string]func() dedupeStore{
+		"memory": func() dedupeStore { return newMemoryDedupe(time.Hour, time.Minute) },
+		// Two pods sharing one Redis see each other's deliveries.
+		"redis": func() dedupeStore {
+			d, err := newRedisDedupe(addr, "", "dedupe:sub:", time.Hour, time.Minute)
+			if err != nil {
+				t.Fatalf("newRedisDedupe: %v", err)
+			}
+			return d
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			podA, podB := newStore(), newStore()
+			if name == "memory" {
+				podB = podA
+			}
+			check := func(store dedupeStore, id string, want deliveryState) {
+				t.Helper()
+				got, err := store.claim(ctx, id)
+				if err != nil {
+					t.Fatalf("claim(%s): %v", id, err)
+				}
+				if got != want {
+					t.Fatalf("claim(%s) = %v, want %v", id, got, want)
+				}
+			}
+			check(podA, name+"-1", deliveryNew)
+			// Not acked yet: the first delivery may still fail.
+			check(podB, name+"-1", deliveryInProgress)
+			if err := podA.complete(ctx, name+"-1"); err != nil {
+				t.Fatalf("complete: %v", err)
+			}
+			check(podB, name+"-1", deliveryDone)
+			check(podB, name+"-2", deliveryNew)
+
+			// A nacked message is processed again on redelivery.
+			if err := podB.forget(ctx, name+"-2"); err != nil {
+				t.Fatalf("forget: %v", err)
+			}
+			check(podA, name+"-2", deliveryNew)
+		})
+	}
+
+	// A claim that is never completed, as when the pod dies mid-job, runs
+	// out after the in-progress TTL while done IDs last the window.
+	d, err := newRedisDedupe(addr, "", "dedupe:ttl:", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("newRedisDedupe: %v", err)
+	}
+	d.claim(ctx, "lost")
+	d.claim(ctx, "acked")
+	d.complete(ctx, "acked")
+	srv.FastForward(2 * time.Minute)
+	if got, _ := d.claim(ctx, "lost"); got != deliveryNew {
+		t.Errorf("claim of a lost delivery after the in-progress TTL = %v, want new", got)
+	}
+	if got, _ := d.claim(ctx, "acked"); got != deliveryDone {
+		t.Errorf("claim of an acked delivery within the window = %v, want done", got)
+	}
+}
+
+func TestMemoryDedupeExpires(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	m := newMemoryDedupe(time.Hour, time.Minute)
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+	claim := func(id string, want deliveryState) {
+		t.Helper()
+		if got, _ := m.claim(ctx, id); got != want {
+			t.Fatalf("claim(%s) = %v, want %v", id, got, want)
+		}
+	}
+	claim("lost", deliveryNew)
+	claim("acked", deliveryNew)
+	m.complete(ctx, "acked")
+	now = now.Add(30 * time.Second)
+	claim("lost", deliveryInProgress)
+
+	// The pod processing "lost" died: its claim runs out, and the
+	// redelivery is processed.
+	now = now.Add(time.Minute)
+	claim("lost", deliveryNew)
+	claim("acked", deliveryDone)
+
+	now = now.Add(time.Hour)
+	claim("acked", deliveryNew)
+	if len(m.seen) != 1 {
+		t.Fatalf("%d IDs kept, want 1", len(m.seen))
+	}
+}
+
+func TestRedisDedupeUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	d, err := newRedisDedupe(addr, "", "dedupe:", time.Minute, time.Minute)
+	if err != nil {
+		t.Fatalf("newRedisDedupe: %v", err)
+	}
+	if _, err := d.claim(context.Background(), "a"); err == nil {
+		t.Fatal("claim succeeded without a Redis server")
+	}
+
+	// The wrong password is an error too, not a first delivery.
+	srv := miniredis.RunT(t)
+	srv.RequireAuth("secret")
+	d, err = newRedisDedupe("redis://:wrong@"+srv.Addr(), "", "dedupe:", time.Minute, time.Minute)
+	if err != nil {
+		t.Fatalf("newRedisDedupe: %v", err)
+	}
+	if _, err := d.claim(context.Background(), "a"); err == nil {
+		t.Fatal("claim succeeded with the wrong password")
+	}
+
+	for _, tc := range []struct{ addr, caFile string }{
+		{"redis://host:6379/notadb", ""},
+		{"redis://10.0.0.3:6379", "ca.pem"},
+		{"rediss://10.0.0.3:6378", filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := newRedisDedupe(tc.addr, tc.caFile, "dedupe:", time.Minute, time.Minute); err == nil {
+			t.Errorf("newRedisDedupe(%q, %q) succeeded, want an error", tc.addr, tc.caFile)
+		}
+	}
+}
+
+func TestLeaseExtensionPeriod(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		jobDuration time.Duration
+		margin      time.Duration
+		want        time.Duration
+	}{
+		{"no margin keeps the client default", 9 * time.Second, 0, 0},
+		{"negative margin keeps the client default", 9 * time.Second, -time.Second, 0},
+		{"job plus margin", 90 * time.Second, 10 * time.Second, 100 * time.Second},
+		{"short job is raised to the minimum", 2 * time.Second, time.Second, minLeaseExtension},
+		{"near-deadline job is covered", 9 * time.Second, 5 * time.Second, 14 * time.Second},
+		{"long job is capped at the maximum", 20 * time.Minute, 10 * time.Second, maxLeaseExtension},
+	} {
+		if got := leaseExtensionPeriod(tc.jobDuration, tc.margin); got != tc.want {
+			t.Errorf("%s: leaseExtensionPeriod(%v, %v) = %v, want %v", tc.name, tc.jobDuration, tc.margin, got, tc.want)
+		}
+	}
+}
+
+func TestAdviseLease(t *testing.T) {
+	// Defaults: latency-based extensions and the client's 60 minute cap.
+	g := adviseLease(90*time.Second, 200, leaseSettings{})
+	if g.ExtensionsPerMinute != 1200 {
+		t.Errorf("extensionsPerMinute = %v, want 1200 (200 leases every 10s)", g.ExtensionsPerMinute)
+	}
+	if len(g.Warnings) != 1 || !strings.Contains(g.Warnings[0], "LEASE_SAFETY_MARGIN_SEC") {
+		t.Errorf("warnings = %q, want one suggesting LEASE_SAFETY_MARGIN_SEC", g.Warnings)
+	}
+	if g.SuggestedLeaseSafetyMarginSec != 9 || g.SuggestedMaxExtensionSec != 3600 {
+		t.Errorf("suggested margin %ds and max extension %ds, want 9s and 3600s", g.SuggestedLeaseSafetyMarginSec, g.SuggestedMaxExtensionSec)
+	}
+
+	// One extension per job is fine at any concurrency.
+	safe := leaseSettings{minExtensionPeriod: leaseExtensionPeriod(90*time.Second, 10*time.Second)}
+	if g := adviseLease(90*time.Second, 200, safe); len(g.Warnings) != 0 || g.ExtensionsPerMinute != 120 {
+		t.Errorf("with a safety margin: %.0f extensions per minute, warnings %q; want 120 and none", g.ExtensionsPerMinute, g.Warnings)
+	}
+
+	// A total extension shorter than a job redelivers every message.
+	short := leaseSettings{maxExtension: time.Minute}
+	if g := adviseLease(90*time.Second, 1, short); len(g.Warnings) != 1 || !strings.Contains(g.Warnings[0], "ACK_MAX_EXTENSION_SEC") {
+		t.Errorf("warnings = %q, want one about ACK_MAX_EXTENSION_SEC", g.Warnings)
+	}
+
+	for _, tc := range []struct {
+		l  leaseSettings
+		ok bool
+	}{
+		{leaseSettings{}, true},
+		{leaseSettings{maxExtensionPeriod: 5 * time.Second}, false},
+		{leaseSettings{maxExtensionPeriod: 20 * time.Minute}, false},
+		{leaseSettings{minExtensionPeriod: time.Minute, maxExtensionPeriod: 30 * time.Second}, false},
+		{leaseSettings{minExtensionPeriod: time.Minute, maxExtensionPeriod: 2 * time.Minute}, true},
+		{leaseSettings{maxExtension: -time.Second}, false},
+	} {
+		if err := tc.l.validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: validate() = %v, want ok %v", tc.l, err, tc.ok)
+		}
+	}
+}
+
+func TestLeaseTracker(t *testing.T) {
+	lt := newLeaseTracker(time.Minute)
+	if lt.hold("a") {
+		t.Fatal("first delivery reported as a redelivery")
+	}
+	if !lt.hold("a") {
+		t.Fatal("delivery of a message still in flight not reported")
+	}
+	lt.release("a", time.Second)
+	lt.release("a", time.Second)
+	if lt.hold("a") {
+		t.Fatal("delivery after the earlier ones were released reported as a redelivery")
+	}
+	if !lt.release("a", 2*time.Minute) {
+		t.Error("job held past the max extension not reported")
+	}
+	if len(lt.held) != 0 {
+		t.Errorf("tracker still holds %v", lt.held)
+	}
+}
+
+func TestJobTypes(t *testing.T) {
+	types, err := parseJobTypes(" report, thumbnail,,report")
+	if err != nil {
+		t.Fatalf("parseJobTypes: %v", err)
+	}
+	for _, tc := range []struct {
+		jobType string
+		want    string
+	}{
+		{"report", "report"},
+		{"thumbnail", "thumbnail"},
+		{"video", "other"},
+		{"Report", "other"},
+		{"", "other"},
+	} {
+		if got := types.label(map[string]string{"jobType": tc.jobType}); got != tc.want {
+			t.Errorf("label for jobType %q = %q, want %q", tc.jobType, got, tc.want)
+		}
+	}
+	if got := types.label(nil); got != "other" {
+		t.Errorf("label without attributes = %q, want other", got)
+	}
+	labels := types.labels()
+	sort.Strings(labels)
+	if want := []string{"other", "report", "thumbnail"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels() = %v, want %v", labels, want)
+	}
+
+	// Without JOB_TYPES every job is "other".
+	if got := jobTypes(nil).label(map[string]string{"jobType": "report"}); got != "other" {
+		t.Errorf("label without an allowlist = %q, want other", got)
+	}
+	for _, bad := range []string{"other", strings.Repeat("x", 65)} {
+		if _, err := parseJobTypes(bad); err == nil {
+			t.Errorf("parseJobTypes(%q) succeeded, want an error", bad)
+		}
+	}
+}
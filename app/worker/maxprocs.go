@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroup files holding the container's CPU quota.
+const (
+	cgroupV2CPUMax    = "/sys/fs/cgroup/cpu.max"
+	cgroupV1CPUQuota  = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriod = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+)
+
+// setMaxProcsFromCgroup sets GOMAXPROCS to the container's CPU limit (rounded
+// up, at least 1), so the runtime doesn't schedule work on more threads than
+// the pod may actually use. Without this, Go sees every core on the node and
+// a CPU-limited pod is throttled instead. It returns the value in effect and
+// whether a quota was found.
+func setMaxProcsFromCgroup() (int, bool, error) {
+	quota, period, err := readCgroupCPUQuota()
+	if err != nil {
+		return runtime.GOMAXPROCS(0), false, err
+	}
+	if quota <= 0 || period <= 0 {
+		// No limit set.
+		return runtime.GOMAXPROCS(0), false, nil
+	}
+	procs := int(math.Ceil(float64(quota) / float64(period)))
+	if procs < 1 {
+		procs = 1
+	}
+	runtime.GOMAXPROCS(procs)
+	return procs, true, nil
+}
+
+// readCgroupCPUQuota returns the CPU quota and period in microseconds,
+// trying cgroup v2 first and falling back to v1. A quota of -1 means
+// unlimited.
+func readCgroupCPUQuota() (quota, period int64, err error) {
+	if data, err := os.ReadFile(cgroupV2CPUMax); err == nil {
+		return parseCgroupV2CPUMax(string(data))
+	}
+
+	quotaData, err := os.ReadFile(cgroupV1CPUQuota)
+	if err != nil {
+		return 0, 0, fmt.Errorf("no cgroup CPU quota found: %v", err)
+	}
+	periodData, err := os.ReadFile(cgroupV1CPUPeriod)
+	if err != nil {
+		return 0, 0, fmt.Errorf("read %s: %v", cgroupV1CPUPeriod, err)
+	}
+	quota, err = strconv.ParseInt(strings.TrimSpace(string(quotaData)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse %s: %v", cgroupV1CPUQuota, err)
+	}
+	period, err = strconv.ParseInt(strings.TrimSpace(string(periodData)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse %s: %v", cgroupV1CPUPeriod, err)
+	}
+	return quota, period, nil
+}
+
+// parseCgroupV2CPUMax parses the contents of cpu.max, e.g. "25000 100000"
+// or "max 100000".
+func parseCgroupV2CPUMax(data string) (quota, period int64, err error) {
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected cpu.max format: %q", data)
+	}
+	period, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse cpu.max period: %v", err)
+	}
+	if fields[0] == "max" {
+		return -1, period, nil
+	}
+	quota, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse cpu.max quota: %v", err)
+	}
+	return quota, period, nil
+}
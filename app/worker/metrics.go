@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// numJobs is the custom metric we will export.
+var numJobs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "numJobs",
+		Help: "The number of pending jobs in the queue as reported by the last message.",
+	},
+)
+
+// gaugeResets counts how often numJobs was reset to 0 due to staleness.
+var gaugeResets = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "gauge_resets_total",
+		Help: "The number of times numJobs was reset to 0 because no job arrived within the metric timeout.",
+	},
+)
+
+// republishedMessages counts messages put back on the topic in loop mode.
+var republishedMessages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "republished_messages_total",
+		Help: "The number of processed messages republished to the topic in loop mode.",
+	},
+)
+
+// startTime is the Unix time the worker started, so Prometheus can compute
+// uptime and spot restarts.
+var startTime = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "worker_start_time_seconds",
+		Help: "Start time of the worker since unix epoch in seconds.",
+	},
+)
+
+// expiredMessages counts messages skipped because their expiresAt passed.
+var expiredMessages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "expired_messages_total",
+		Help: "The number of messages acked without processing because they expired in the queue.",
+	},
+)
+
+// inFlightJobs is the number of jobs currently being processed.
+var inFlightJobs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "in_flight_jobs",
+		Help: "The number of jobs currently being processed by this worker.",
+	},
+)
+
+// jobsProcessed counts jobs that finished processing.
+var jobsProcessed = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "jobs_processed_total",
+		Help: "The number of jobs processed by this worker.",
+	},
+)
+
+// maxOutstandingConfigured is the configured MaxOutstandingMessages limit.
+var maxOutstandingConfigured = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "max_outstanding_configured",
+		Help: "The MaxOutstandingMessages limit the subscription receives with.",
+	},
+)
+
+// peakOutstanding is the most messages this worker has held at once. If it
+// never reaches max_outstanding_configured, the worker never saturated.
+var peakOutstanding = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "peak_outstanding_messages",
+		Help: "The peak number of messages processed concurrently during the worker's lifetime.",
+	},
+)
+
+// workerPaused is 1 while the worker is paused via /pause.
+var workerPaused = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "worker_paused",
+		Help: "Whether the worker is paused and not pulling new messages (1) or not (0).",
+	},
+)
+
+// desiredReplicas is the replica count the HPA aims for given numJobs.
+var desiredReplicas = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "desired_replicas",
+		Help: "ceil(numJobs / JOBS_PER_REPLICA), clamped to MIN_REPLICAS and MAX_REPLICAS.",
+	},
+)
+
+// subscriptionBacklog is the backlog last read from Cloud Monitoring.
+var subscriptionBacklog = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "subscription_backlog",
+		Help: "The subscription's undelivered messages as last polled from Cloud Monitoring.",
+	},
+)
+
+// metricBacklogDivergence is numJobs minus the polled backlog.
+var metricBacklogDivergence = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "metric_backlog_divergence",
+		Help: "numJobs as reported by the publisher minus the backlog polled from Cloud Monitoring.",
+	},
+)
+
+// invalidNumJobs counts messages whose numJobs attribute was missing or
+// invalid, so DEFAULT_NUM_JOBS was used instead.
+var invalidNumJobs = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "invalid_num_jobs_total",
+		Help: "The number of messages with a missing or invalid numJobs attribute.",
+	},
+)
+
+// numJobsUpdates counts updates to numJobs. A flat rate while jobs are
+// queued means the metric is stuck.
+var numJobsUpdates = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "num_jobs_updates_total",
+		Help: "The number of times numJobs was updated from a message.",
+	},
+)
+
+// flowControlBlocked is the time the worker spent with as many messages as
+// MaxOutstandingMessages allows, unable to pull more. A steadily growing
+// value while there is a backlog means the worker is the bottleneck.
+var flowControlBlocked = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "flow_control_blocked_seconds_total",
+		Help: "Seconds spent at the MaxOutstandingMessages limit, blocked from pulling more messages.",
+	},
+)
+
+// distinctNumJobs is how many different numJobs values messages carried. 1
+// means the publisher sends a constant.
+var distinctNumJobs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "distinct_num_jobs_values",
+		Help: "The number of distinct numJobs values seen (capped at DISTINCT_NUM_JOBS_MAX).",
+	},
+)
+
+// poisonMessages counts deliveries of poison messages, nacked in TEST_MODE.
+var poisonMessages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "poison_messages_total",
+		Help: "The number of poison message deliveries nacked in test mode.",
+	},
+)
+
+// throughputPerMinute is a moving average of messages completed per minute
+// over THROUGHPUT_WINDOW_SEC, to compare against the arrival rate.
+var throughputPerMinute = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "throughput_messages_per_minute",
+		Help: "Messages completed per minute, averaged over THROUGHPUT_WINDOW_SEC.",
+	},
+)
+
+// lastErrorTimestamp is when the last processing error happened, or 0 if
+// there was none recently. /lasterror has the message.
+var lastErrorTimestamp = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "last_error_timestamp_seconds",
+		Help: "Unix time of the last processing error, 0 if none (or cleared after LAST_ERROR_CLEAR_SEC).",
+	},
+)
+
+// subscriptionNotFound counts Receive calls that failed because the
+// subscription was deleted.
+var subscriptionNotFound = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "subscription_not_found_total",
+		Help: "The number of times Receive failed because the subscription no longer existed.",
+	},
+)
+
+// jobAllocatedBytes is what the last sampled job allocated, to size the
+// worker's memory requests once simulateWork does real work.
+var jobAllocatedBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "job_allocated_bytes",
+		Help: "Bytes allocated while the last sampled job ran (see JOB_ALLOC_SAMPLE_RATE).",
+	},
+)
+
+// ackErrors counts acks that failed, by reason. Only exactly-once
+// subscriptions report ack results, so it stays 0 elsewhere.
+var ackErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ack_errors_total",
+		Help: "The number of failed acks on an exactly-once subscription, by reason.",
+	},
+	[]string{"reason"},
+)
+
+// projectReceiving is 1 for each project the worker is receiving from. A
+// project that refused access drops to 0 while the others keep going.
+var projectReceiving = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "project_receiving",
+		Help: "Whether the worker is receiving from the project's subscription (1) or not (0).",
+	},
+	[]string{"project"},
+)
+
+// projectMessages counts messages received per project.
+var projectMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "project_messages_total",
+		Help: "The number of messages received from each project's subscription.",
+	},
+	[]string{"project"},
+)
+
+// averageNumJobs smooths spiky numJobs reports for dashboards, or for
+// scaling less eagerly.
+var averageNumJobs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "average_num_jobs",
+		Help: "The mean of the numJobs values set within AVERAGE_NUM_JOBS_WINDOW_SEC, 0 if none.",
+	},
+)
+
+// workConfigInfo describes the simulated workload in its labels, so
+// dashboards can tell apart pods running different workloads. Always 1.
+var workConfigInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "worker_work_config_info",
+		Help: "The worker's simulated workload: WORK_FUNC, JOB_DURATION_SEC, WORK_MEMORY_MB and MAX_OUTSTANDING_MESSAGES.",
+	},
+	[]string{"work_func", "job_duration_sec", "work_memory_mb", "max_outstanding"},
+)
+
+// droppedOnShutdown counts messages nacked because the worker shut down
+// before their job finished. Another pod redoes them, so they are both
+// scale-down churn and a source of duplicate processing.
+var droppedOnShutdown = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "messages_dropped_on_shutdown_total",
+		Help: "The number of messages nacked for redelivery because shutdown aborted their job.",
+	},
+)
+
+// pressureRejections counts jobs nacked because memory or disk was over its
+// threshold.
+var pressureRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pressure_rejections_total",
+		Help: "The number of messages nacked under resource pressure, by resource (memory or disk).",
+	},
+	[]string{"resource"},
+)
+
+// startupCanarySuccess is 1 once the startup canary made the round trip.
+var startupCanarySuccess = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "startup_canary_success",
+		Help: "Whether the startup canary was published and received intact (1) or not, or was skipped (0).",
+	},
+)
+
+// deliveryAttempts is the distribution of delivery attempts at receipt. Many
+// messages past 1 mean jobs outlive their ack deadline or keep failing, and
+// are being processed more than once. Pub/Sub only counts attempts on
+// subscriptions with a dead-letter policy, so elsewhere it stays empty.
+var deliveryAttempts = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "delivery_attempts",
+		Help:    "The delivery attempt of each received message (only on subscriptions with a dead-letter policy).",
+		Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100},
+	},
+)
+
+// effectiveConcurrency smooths in_flight_jobs over time. Well below
+// max_outstanding_configured means the worker has spare capacity; close to
+// it means more concurrency (or pods) would help.
+var effectiveConcurrency = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "effective_concurrency",
+		Help: "Time-weighted moving average of in_flight_jobs over EFFECTIVE_CONCURRENCY_WINDOW_SEC.",
+	},
+)
+
+// pullDelay is the time from publish to the first pull of each message, i.e.
+// Pub/Sub's share of the end-to-end latency. A high pull delay with a short
+// processing time means messages wait in the subscription: too few workers
+// or too little flow control, not slow jobs.
+var pullDelay = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "pull_delay_seconds",
+		Help:    "Time from publish to the first pull of each message.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	},
+)
+
+// secondsToDrain forecasts how long the worker needs to clear its share of
+// the work at its current throughput. +Inf means work is waiting but nothing
+// completed recently, i.e. the worker is stuck or just started.
+var secondsToDrain = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "seconds_to_drain",
+		Help: "Estimated seconds to finish max(numJobs / desired_replicas, in_flight_jobs) at throughput_messages_per_minute; +Inf with no recent completions.",
+	},
+)
+
+// deadLettered counts failed messages the worker routed to DLQ_TOPIC_ID
+// itself, by failure reason.
+var deadLettered = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dead_lettered_total",
+		Help: "Failed messages republished to the in-app dead-letter topic and acked, by reason.",
+	},
+	[]string{"reason"},
+)
+
+// processingSuccessRatio is the share of messages processed successfully
+// rather than failed, over SUCCESS_RATIO_WINDOW_SEC: an SLO-style signal to
+// alert on directly. It is 1 while nothing finished in the window.
+var processingSuccessRatio = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "processing_success_ratio",
+		Help: "Processed / (processed + failed) messages over SUCCESS_RATIO_WINDOW_SEC; 1 with no messages in the window.",
+	},
+)
+
+// receiveRestarts counts restarts of the receive loop after transient
+// errors. A steady climb means Pub/Sub keeps failing, not that the worker
+// is stuck in a tight loop: the restarts back off up to
+// RECEIVE_BACKOFF_MAX_SEC.
+var receiveRestarts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "receive_restarts_total",
+		Help: "Restarts of the receive loop after transient errors, by project.",
+	},
+	[]string{"project"},
+)
+
+// duplicateMessages counts deliveries of messages already delivered within
+// DEDUPE_WINDOW_SEC, acked without running the job again.
+var duplicateMessages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "duplicate_messages_total",
+		Help: "Duplicate deliveries acked without work, within DEDUPE_WINDOW_SEC.",
+	},
+)
+
+// leaseExtensionFailures counts messages whose lease ran out while they
+// were being processed, by how it was noticed: "redelivered" when a message
+// arrives again while still in flight in this pod, "max_extension" when a
+// job outlasts ACK_MAX_EXTENSION_SEC. A lapse noticed only by another pod
+// isn't counted.
+var leaseExtensionFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lease_extension_failures_total",
+		Help: "Messages whose lease ran out while they were processed, by reason.",
+	},
+	[]string{"reason"},
+)
+
+// adminOps counts the topic and subscription admin calls of the
+// get-or-create helpers by result, so it's visible how often resources are
+// created versus found.
+var adminOps = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pubsub_admin_operations_total",
+		Help: "The number of Pub/Sub admin operations, by operation and result.",
+	},
+	[]string{"operation", "result"},
+)
+
+// Results of pubsub_admin_operations_total: a get finds the resource or not,
+// or is denied (the worker then assumes the resource exists), and a create
+// creates it. Any other failed call is an error.
+const (
+	adminFound    = "found"
+	adminNotFound = "not_found"
+	adminDenied   = "denied"
+	adminCreated  = "created"
+	adminError    = "error"
+)
+
+// recordAdminOp increments adminOps for the given operation with result, or
+// with adminDenied or adminError if err is set.
+func recordAdminOp(operation, result string, err error) {
+	switch {
+	case isPermissionDenied(err):
+		result = adminDenied
+	case err != nil:
+		result = adminError
+	}
+	adminOps.WithLabelValues(operation, result).Inc()
+}
+
+// existsResult is the result of a get that reported whether the resource
+// exists.
+func existsResult(exists bool) string {
+	if exists {
+		return adminFound
+	}
+	return adminNotFound
+}
+
+// jobProcessingDuration is how long each completed job took, by jobType
+// (from JOB_TYPES, "other" for the rest), to compare latency across job
+// classes. Jobs aborted by shutdown aren't observed.
+var jobProcessingDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "job_processing_duration_seconds",
+		Help:    "Time spent processing each completed job, by jobType.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	},
+	[]string{"jobType"},
+)
+
+// registerMetrics registers the worker's metrics with reg. main wraps the
+// registry with CONSTANT_LABELS before calling it, so every metric carries
+// them.
+func registerMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(numJobs, gaugeResets, republishedMessages, startTime, expiredMessages, inFlightJobs, jobsProcessed, maxOutstandingConfigured, peakOutstanding, workerPaused, desiredReplicas, subscriptionBacklog, metricBacklogDivergence, invalidNumJobs, numJobsUpdates, flowControlBlocked, distinctNumJobs, poisonMessages, throughputPerMinute, lastErrorTimestamp, subscriptionNotFound, jobAllocatedBytes, ackErrors, projectReceiving, projectMessages, averageNumJobs, workConfigInfo, droppedOnShutdown, pressureRejections, startupCanarySuccess, deliveryAttempts, effectiveConcurrency, pullDelay, secondsToDrain, deadLettered, processingSuccessRatio, receiveRestarts, duplicateMessages, leaseExtensionFailures, jobProcessingDuration, adminOps)
+}
+
+// registerCollectors registers everything the worker exports with reg: the Go
+// runtime and process collectors, registerMetrics, the attribute labels if
+// any, and the promhttp_* metrics of the returned /metrics handler, which
+// serves gatherer.
+func registerCollectors(reg prometheus.Registerer, gatherer prometheus.Gatherer, attrLabels *attributeLabels) http.Handler {
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	registerMetrics(reg)
+	if attrLabels != nil {
+		reg.MustRegister(attrLabels.info)
+	}
+	return promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
+
+// collectingRegisterer records the collectors registered with it instead of
+// registering them, so their descriptors can be inspected before the real
+// registry exists.
+type collectingRegisterer struct{ collectors []prometheus.Collector }
+
+func (r *collectingRegisterer) Register(c prometheus.Collector) error {
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+func (r *collectingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	r.collectors = append(r.collectors, cs...)
+}
+
+func (r *collectingRegisterer) Unregister(prometheus.Collector) bool { return false }
+
+// histogramLabelNames are added by histograms and summaries when they are
+// collected, so they don't show up in any descriptor.
+var histogramLabelNames = []string{"le", "quantile"}
+
+var (
+	descVariableLabels = regexp.MustCompile(`variableLabels: \{([^}]*)\}`)
+	descConstLabels    = regexp.MustCompile(`constLabels: \{(.*)\}, variableLabels`)
+	descConstLabelName = regexp.MustCompile(`(?:^|,)([a-zA-Z_][a-zA-Z0-9_]*)=`)
+)
+
+// labelNames returns every label name the recorded collectors use, constant
+// or variable, plus histogramLabelNames. A constant label with one of these
+// names would make registration fail. client_golang has no accessors for a
+// Desc's labels, so they are read from its String form.
+func (r *collectingRegisterer) labelNames() []string {
+	names := slices.Clone(histogramLabelNames)
+	for _, c := range r.collectors {
+		descs := make(chan *prometheus.Desc)
+		go func() {
+			c.Describe(descs)
+			close(descs)
+		}()
+		for d := range descs {
+			desc := d.String()
+			if m := descVariableLabels.FindStringSubmatch(desc); m != nil && m[1] != "" {
+				for _, name := range strings.Split(m[1], ",") {
+					// Constrained labels print as c(name).
+					names = append(names, strings.TrimSuffix(strings.TrimPrefix(name, "c("), ")"))
+				}
+			}
+			if m := descConstLabels.FindStringSubmatch(desc); m != nil {
+				for _, lm := range descConstLabelName.FindAllStringSubmatch(m[1], -1) {
+					names = append(names, lm[1])
+				}
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// parseConstantLabels parses CONSTANT_LABELS, a comma-separated list of
+// key=value pairs such as "env=dev,region=europe-west1". Keys may not be
+// one of the label names in taken.
+func parseConstantLabels(value string, taken []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		// Names starting with __ are reserved for Prometheus itself.
+		if !labelNameRe.MatchString(k) || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if slices.Contains(taken, k) {
+			return nil, fmt.Errorf("label %q is already used by the worker's metrics", k)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("duplicate label %q", k)
+		}
+		labels[k] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
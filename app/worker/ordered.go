@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// orderedAcks holds back the acks and nacks of messages with an ordering key
+// until every message received before them with the same key is settled, so
+// they reach Pub/Sub in the order the messages were received even when jobs
+// finish out of order, as they do when a drain aborts some of them. Once a
+// message is nacked, the ones received after it with the same key are nacked
+// too: Pub/Sub redelivers them after it anyway, and acking them first would
+// let them overtake it.
+type orderedAcks struct {
+	mu   sync.Mutex
+	keys map[string]*orderedKey
+	// byID finds a registered message's entry when it is settled.
+	byID map[string]*orderedEntry
+}
+
+// orderedKey is the queue of unsettled messages with one ordering key, in
+// the order they were received.
+type orderedKey struct {
+	entries []*orderedEntry
+	// flushing is set while a goroutine settles entries from the front, so
+	// that no other goroutine settles this key's entries concurrently.
+	flushing bool
+	// nacked is set once an entry was nacked, until the queue empties.
+	nacked bool
+}
+
+// orderedEntry is a message waiting for its turn to be settled.
+type orderedEntry struct {
+	done   bool
+	ack    bool
+	settle func(ack bool)
+}
+
+func newOrderedAcks() *orderedAcks {
+	return &orderedAcks{keys: map[string]*orderedKey{}, byID: map[string]*orderedEntry{}}
+}
+
+// register queues msg behind the earlier messages with its ordering key.
+// Messages without a key are not held back.
+func (o *orderedAcks) register(msg *pubsub.Message) {
+	if o == nil || msg.OrderingKey == "" {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q := o.keys[msg.OrderingKey]
+	if q == nil {
+		q = &orderedKey{}
+		o.keys[msg.OrderingKey] = q
+	}
+	e := &orderedEntry{}
+	q.entries = append(q.entries, e)
+	o.byID[msg.ID] = e
+}
+
+// finish records that msg should be acked (or nacked) by calling settle.
+// settle runs once every earlier message with the same key was settled,
+// possibly on another goroutine after finish returns. Unregistered messages
+// are settled right away.
+func (o *orderedAcks) finish(msg *pubsub.Message, ack bool, settle func(ack bool)) {
+	if o == nil {
+		settle(ack)
+		return
+	}
+	o.mu.Lock()
+	e, ok := o.byID[msg.ID]
+	if !ok {
+		o.mu.Unlock()
+		settle(ack)
+		return
+	}
+	delete(o.byID, msg.ID)
+	e.done, e.ack, e.settle = true, ack, settle
+	q := o.keys[msg.OrderingKey]
+	if q.flushing {
+		o.mu.Unlock()
+		return
+	}
+	q.flushing = true
+	for {
+		// Take the settled entries at the front, then settle them without
+		// holding the lock: with exactly-once delivery that waits for Pub/Sub.
+		var ready []*orderedEntry
+		for len(q.entries) > 0 && q.entries[0].done {
+			ready = append(ready, q.entries[0])
+			q.entries = q.entries[1:]
+		}
+		if len(ready) == 0 {
+			q.flushing = false
+			if len(q.entries) == 0 {
+				delete(o.keys, msg.OrderingKey)
+			}
+			o.mu.Unlock()
+			return
+		}
+		for _, r := range ready {
+			if !r.ack {
+				q.nacked = true
+			}
+			r.ack = r.ack && !q.nacked
+		}
+		o.mu.Unlock()
+		for _, r := range ready {
+			r.settle(r.ack)
+		}
+		o.mu.Lock()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// pauseController stops and restarts the receive loop for maintenance. A
+// pause cancels the Receive context, so no new messages are pulled while
+// in-flight jobs finish; a resume starts receiving again.
+type pauseController struct {
+	mu     sync.Mutex
+	paused bool
+	// cancels stop the current Receive calls, one per project.
+	cancels []context.CancelFunc
+	// resumed is closed when a pause ends.
+	resumed chan struct{}
+}
+
+// receiveContext returns the context for the next Receive call.
+func (p *pauseController) receiveContext(ctx context.Context) context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	// A pause that arrived before this Receive started still applies.
+	if p.paused {
+		cancel()
+		return ctx
+	}
+	p.cancels = append(p.cancels, cancel)
+	return ctx
+}
+
+// pause stops pulling new messages. It reports false if already paused.
+func (p *pauseController) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	p.resumed = make(chan struct{})
+	for _, cancel := range p.cancels {
+		cancel()
+	}
+	p.cancels = nil
+	workerPaused.Set(1)
+	return true
+}
+
+// isPaused reports whether the worker is paused.
+func (p *pauseController) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// resume starts pulling messages again. It reports false if not paused.
+func (p *pauseController) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	close(p.resumed)
+	workerPaused.Set(0)
+	return true
+}
+
+// waitWhilePaused blocks until the worker is resumed. It reports false if
+// ctx ends first or the worker isn't paused, i.e. Receive stopped for another
+// reason.
+func (p *pauseController) waitWhilePaused(ctx context.Context) bool {
+	p.mu.Lock()
+	if !p.paused {
+		p.mu.Unlock()
+		return false
+	}
+	resumed := p.resumed
+	p.mu.Unlock()
+
+	slog.Info("Worker paused, waiting to be resumed.")
+	select {
+	case <-resumed:
+		slog.Info("Worker resumed.")
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// servePause handles POST /pause.
+func (p *pauseController) servePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.pause() {
+		http.Error(w, "already paused", http.StatusConflict)
+		return
+	}
+	slog.Info("Pausing: no new messages will be pulled, in-flight jobs will finish.")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveResume handles POST /resume.
+func (p *pauseController) serveResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.resume() {
+		http.Error(w, "not paused", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
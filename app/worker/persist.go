@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metricStateSaveInterval is how often METRIC_STATE_FILE is rewritten. It
+// should stay well below the default METRIC_STATE_MAX_AGE_SEC.
+const metricStateSaveInterval = 5 * time.Second
+
+// savedMetric is the metric state persisted across restarts.
+type savedMetric struct {
+	Value       float64   `json:"value"`
+	LastJobTime time.Time `json:"lastJobTime"`
+	SavedAt     time.Time `json:"savedAt"`
+}
+
+// saveMetric writes the current metric value and last job time to path, so a
+// restarted worker can pick them up instead of reporting a spurious 0. The
+// file is written to a temporary file and renamed, so a crash mid-write
+// never leaves a truncated file behind.
+func (s *globalState) saveMetric(path string, now time.Time) error {
+	s.mu.RLock()
+	saved := savedMetric{Value: s.metricValue, LastJobTime: s.lastJobTime, SavedAt: now}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write metric state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close metric state: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreMetric loads a metric saved by saveMetric, unless it was saved more
+// than maxAge before now: an old value says nothing about the current
+// backlog. It reports whether the value was restored. A missing file is not
+// an error.
+func (s *globalState) restoreMetric(path string, maxAge time.Duration, now time.Time) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read metric state: %v", err)
+	}
+	var saved savedMetric
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return false, fmt.Errorf("parse metric state %s: %v", path, err)
+	}
+	if now.Sub(saved.SavedAt) > maxAge {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metricValue = saved.Value
+	s.lastJobTime = saved.LastJobTime
+	s.setGauge(saved.Value)
+	return true, nil
+}
+
+// persistMetric saves the metric to path every interval. Saving continuously
+// rather than on shutdown means a restart finds a recent value however the
+// previous worker stopped, without tying persistence to signal handling.
+func (s *globalState) persistMetric(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := s.saveMetric(path, now); err != nil {
+			slog.Warn("Could not save metric", "file", path, "err", err)
+		}
+	}
+}
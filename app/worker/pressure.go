@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"runtime/metrics"
+	"syscall"
+)
+
+// pressureGate defers jobs while the worker is short on memory or disk, to
+// simulate backpressure and avoid OOM kills under load. A zero threshold
+// disables its check.
+type pressureGate struct {
+	maxMemoryBytes   uint64
+	minFreeDiskBytes uint64
+	diskPath         string
+	// memoryUsage and freeDisk read the current values. They are
+	// runtimeMemoryUsage and statfsFreeDisk outside of tests.
+	memoryUsage func() uint64
+	freeDisk    func(path string) (uint64, error)
+}
+
+// exceeded reports which resource, if any, is over its threshold: "memory"
+// or "disk". A nil gate never reports pressure.
+func (g *pressureGate) exceeded() (resource string, detail string) {
+	if g == nil {
+		return "", ""
+	}
+	if g.maxMemoryBytes > 0 {
+		if used := g.memoryUsage(); used > g.maxMemoryBytes {
+			return "memory", fmt.Sprintf("%d MB in use, limit %d MB", used>>20, g.maxMemoryBytes>>20)
+		}
+	}
+	if g.minFreeDiskBytes > 0 {
+		free, err := g.freeDisk(g.diskPath)
+		// If the disk can't be read, don't block work on it.
+		if err == nil && free < g.minFreeDiskBytes {
+			return "disk", fmt.Sprintf("%d MB free on %s, minimum %d MB", free>>20, g.diskPath, g.minFreeDiskBytes>>20)
+		}
+	}
+	return "", ""
+}
+
+// runtimeMemoryUsage returns the memory the Go runtime has mapped, which
+// tracks the process's resident memory closely and is cheap to read (unlike
+// runtime.ReadMemStats, it doesn't stop the world).
+func runtimeMemoryUsage() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// statfsFreeDisk returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func statfsFreeDisk(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %v", path, err)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
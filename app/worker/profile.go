@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Bounds for CPU_PROFILE_DURATION_SEC and CPU_PROFILE_INTERVAL_SEC, so
+// profiling never costs more than a small fraction of the worker's time.
+const (
+	maxProfileDuration = time.Minute
+	minProfileInterval = time.Minute
+)
+
+// profileSink stores captured profiles.
+type profileSink interface {
+	write(ctx context.Context, name string, data []byte) error
+}
+
+// dirSink writes profiles to a local directory, e.g. an emptyDir volume.
+type dirSink struct {
+	dir string
+}
+
+func (d dirSink) write(_ context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(d.dir, name), data, 0o644)
+}
+
+// gcsSink uploads profiles to a Cloud Storage bucket under prefix.
+type gcsSink struct {
+	svc    *storage.Service
+	bucket string
+	prefix string
+}
+
+func (g gcsSink) write(ctx context.Context, name string, data []byte) error {
+	obj := &storage.Object{Name: g.prefix + name, ContentType: "application/octet-stream"}
+	if _, err := g.svc.Objects.Insert(g.bucket, obj).Media(bytes.NewReader(data)).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("upload gs://%s/%s: %v", g.bucket, obj.Name, err)
+	}
+	return nil
+}
+
+// newProfileSink returns the sink for CPU_PROFILE_DEST: a gs://bucket/prefix
+// URL, or a local directory otherwise.
+func newProfileSink(ctx context.Context, dest string) (profileSink, error) {
+	rest, ok := strings.CutPrefix(dest, "gs://")
+	if !ok {
+		return dirSink{dir: dest}, nil
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in %q", dest)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	svc, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewService: %v", err)
+	}
+	return gcsSink{svc: svc, bucket: bucket, prefix: prefix}, nil
+}
+
+// profileCPU captures a duration-long CPU profile every interval while jobs
+// are in progress, and stores it in sink. Idle periods are skipped, since
+// there is no job CPU to look at.
+func (s *globalState) profileCPU(ctx context.Context, sink profileSink, interval, duration time.Duration) {
+	host, _ := os.Hostname()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.snapshot().InFlight == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			slog.Warn("Could not start CPU profile", "err", err)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+		pprof.StopCPUProfile()
+
+		name := fmt.Sprintf("cpu-%s-%s.pprof", host, time.Now().UTC().Format("20060102T150405Z"))
+		if err := sink.write(context.WithoutCancel(ctx), name, buf.Bytes()); err != nil {
+			slog.Warn("Could not store CPU profile", "name", name, "err", err)
+			continue
+		}
+		slog.Info("Stored CPU profile", "name", name, "bytes", buf.Len())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// parseProjects parses PROJECTS, a comma-separated list of project IDs to
+// consume SUBSCRIPTION_ID from. The primary project (PROJECT_ID) always comes
+// first, and duplicates are dropped.
+func parseProjects(value, primary string) []string {
+	projects := []string{primary}
+	seen := map[string]bool{primary: true}
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		projects = append(projects, p)
+	}
+	return projects
+}
+
+// projectClientOptions returns the client options for project: the shared
+// ones, plus <dir>/<project>.json as credentials if that file exists, for
+// projects the default service account can't access.
+func projectClientOptions(base []option.ClientOption, dir, project string) []option.ClientOption {
+	opts := append([]option.ClientOption(nil), base...)
+	if dir == "" {
+		return opts
+	}
+	file := filepath.Join(dir, project+".json")
+	if _, err := os.Stat(file); err == nil {
+		opts = append(opts, option.WithCredentialsFile(file))
+	}
+	return opts
+}
+
+// receiver runs the receive loop for one project's subscription.
+type receiver struct {
+	project    string
+	client     *pubsub.Client
+	sub        *pubsub.Subscription
+	subID      string
+	topicID    string
+	autoCreate bool
+	want       subscriptionExpectations
+	// tolerateAccessErrors stops just this receiver, instead of the worker,
+	// when the project denies access or runs out of quota. It is set when
+	// there are other projects to keep serving.
+	tolerateAccessErrors bool
+	// backoff, if set, restarts Receive after transient errors instead of
+	// stopping the worker.
+	backoff *restartBackoff
+}
+
+// Recreating a deleted subscription is retried after notFoundRetryDelay (or
+// the restart backoff, if set), at most maxNotFoundRetries times in a row.
+// Without permission to get the subscription, getOrCreateSubscription assumes
+// a deleted one still exists, so every retry would fail the same way.
+const (
+	notFoundRetryDelay = 10 * time.Second
+	maxNotFoundRetries = 5
+)
+
+// isAccessError reports whether err is the project refusing us, as opposed
+// to a problem with the worker itself.
+func isAccessError(err error) bool {
+	switch status.Code(err) {
+	case codes.PermissionDenied, codes.Unauthenticated, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// run receives until ctx is cancelled. A pause cancels Receive too; in that
+// case it waits for the resume and starts receiving again. With a backoff,
+// transient errors restart Receive after a delay.
+func (r *receiver) run(ctx context.Context, pauser *pauseController, h *messageHandler) error {
+	log := slog.With("project", r.project, "subscription", r.subID)
+	projectReceiving.WithLabelValues(r.project).Set(1)
+	defer projectReceiving.WithLabelValues(r.project).Set(0)
+	var received atomic.Bool
+	handle := func(ctx context.Context, msg *pubsub.Message) {
+		received.Store(true)
+		projectMessages.WithLabelValues(r.project).Inc()
+		h.handleMessage(ctx, msg)
+	}
+	notFound := 0
+	for {
+		received.Store(false)
+		started := time.Now()
+		err := r.sub.Receive(pauser.receiveContext(ctx), handle)
+		// A Receive that delivered messages, or lasted longer than the
+		// longest backoff, worked: the next failure starts over.
+		if r.backoff != nil && (received.Load() || time.Since(started) >= r.backoff.max) {
+			r.backoff.reset()
+		}
+		if received.Load() {
+			notFound = 0
+		}
+		// The subscription can be deleted under a running worker, e.g. when
+		// the lab is torn down. Recreate it if allowed, else stop cleanly.
+		if isNotFound(err) {
+			subscriptionNotFound.Inc()
+			if !r.autoCreate {
+				log.Error("Subscription was deleted and AUTO_CREATE=false, stopping.")
+				return nil
+			}
+			if notFound++; notFound > maxNotFoundRetries {
+				return fmt.Errorf("project %s: subscription %s still not found after %d attempts to recreate it", r.project, r.subID, maxNotFoundRetries)
+			}
+			delay := notFoundRetryDelay
+			if r.backoff != nil {
+				delay = r.backoff.next()
+			}
+			log.Warn("Subscription was deleted, recreating it.", "topic", r.topicID, "backoff", delay, "attempt", notFound)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil
+			}
+			recreated, err := getOrCreateSubscription(ctx, r.client, r.subID, r.topicID, r.autoCreate, r.want)
+			if err != nil {
+				return fmt.Errorf("recreate subscription in project %s: %v", r.project, err)
+			}
+			recreated.ReceiveSettings = r.sub.ReceiveSettings
+			r.sub = recreated
+			continue
+		}
+		if err != nil && r.tolerateAccessErrors && isAccessError(err) {
+			log.Error("Project refused access or is out of quota, no longer receiving from it.", "err", err)
+			return nil
+		}
+		if err != nil && r.backoff != nil && isTransientReceiveError(err) && ctx.Err() == nil {
+			delay := r.backoff.next()
+			receiveRestarts.WithLabelValues(r.project).Inc()
+			log.Warn("Receive failed, restarting after a backoff.", "err", err, "backoff", delay, "failures", r.backoff.failures)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("project %s: %w", r.project, err)
+		}
+		if !pauser.waitWhilePaused(ctx) {
+			return nil
+		}
+	}
+}
+
+// newReceiver connects to another project and resolves its subscription the
+// same way as the primary one, with the same receive settings.
+func newReceiver(ctx context.Context, project string, opts []option.ClientOption, subID, topicID string, autoCreate bool, want subscriptionExpectations, settings pubsub.ReceiveSettings) (*receiver, error) {
+	client, err := pubsub.NewClient(ctx, project, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create client: %v", err)
+	}
+	sub, err := getOrCreateSubscription(ctx, client, subID, topicID, autoCreate, want)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	sub.ReceiveSettings = settings
+	return &receiver{project: project, client: client, sub: sub, subID: subID, topicID: topicID, autoCreate: autoCreate, want: want}, nil
+}
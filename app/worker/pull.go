@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Receive modes, selected with RECEIVE_MODE. All of them hand messages to
+// messageHandler.handleMessage.
+const (
+	// modeStream receives asynchronously with StreamingPull until the
+	// process is stopped. This is the default.
+	modeStream = "stream"
+	// modeSync pulls, processes and acks in a loop with synchronous Pull
+	// requests until the process is stopped.
+	modeSync = "sync"
+	// modePullOnce uses synchronous pull to process up to PULL_MAX_MESSAGES
+	// messages, then exits.
+	modePullOnce = "pull-once"
+)
+
+// parseReceiveMode validates RECEIVE_MODE.
+func parseReceiveMode(value string) (string, error) {
+	switch value {
+	case modeStream, modeSync, modePullOnce:
+		return value, nil
+	case "push":
+		return "", fmt.Errorf("push delivery is not supported: the worker has no push endpoint, use %q or %q", modeStream, modeSync)
+	}
+	return "", fmt.Errorf("unknown receive mode %q (want %q, %q or %q)", value, modeStream, modeSync, modePullOnce)
+}
+
+// pullOnce processes up to max messages from sub with synchronous pull and
+// returns how many it handled. It also returns once no message has arrived
+// for idleTimeout, so draining a short queue doesn't block forever. Messages
+// pulled beyond max are nacked and go back to the subscription.
+func pullOnce(ctx context.Context, sub *pubsub.Subscription, h *messageHandler, max int, idleTimeout time.Duration) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sub.ReceiveSettings.Synchronous = true
+
+	var (
+		mu     sync.Mutex
+		taken  int
+		active int
+	)
+	// The idle timer only runs while no message is being processed.
+	idle := time.AfterFunc(idleTimeout, func() {
+		slog.Info("No messages within the idle timeout, stopping.", "idleTimeout", idleTimeout)
+		cancel()
+	})
+	defer idle.Stop()
+
+	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		if taken >= max {
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		taken++
+		active++
+		idle.Stop()
+		mu.Unlock()
+
+		h.handleMessage(ctx, msg)
+
+		mu.Lock()
+		defer mu.Unlock()
+		active--
+		if taken >= max && active == 0 {
+			cancel()
+			return
+		}
+		if active == 0 {
+			idle.Reset(idleTimeout)
+		}
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	return taken, err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// randSource is the worker's single source of randomness. Every jitter and
+// sampling feature draws from it, so one RANDOM_SEED makes a whole run
+// reproducible. It is safe for concurrent use.
+type randSource struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newRandSource(seed int64) *randSource {
+	return &randSource{r: rand.New(rand.NewSource(seed))}
+}
+
+// Float64 returns a pseudo-random number in [0.0, 1.0).
+func (s *randSource) Float64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Float64()
+}
+
+// Int63 returns a non-negative pseudo-random 63-bit integer.
+func (s *randSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Int63()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isTransientReceiveError reports whether a Receive error may clear up on
+// its own, e.g. during a Pub/Sub outage, so receiving is worth restarting.
+func isTransientReceiveError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// restartBackoff spaces out restarts of the receive loop with full jitter:
+// each delay is random between 0 and a ceiling that doubles with every
+// failure in a row, up to max. Many workers failing together then retry
+// spread out rather than in lockstep.
+type restartBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	// jitter returns a number in [0, 1) that scales the ceiling.
+	jitter func() float64
+	// failures counts the restarts since the last success.
+	failures int
+}
+
+func newRestartBackoff(initial, max time.Duration, rng *randSource) *restartBackoff {
+	return &restartBackoff{initial: initial, max: max, jitter: rng.Float64}
+}
+
+// next returns the delay before the next restart and counts the failure.
+func (b *restartBackoff) next() time.Duration {
+	ceiling := b.initial
+	for i := 0; i < b.failures && ceiling < b.max; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, b.max)
+	b.failures++
+	return time.Duration(b.jitter() * float64(ceiling))
+}
+
+// reset starts over from initial after receiving worked again.
+func (b *restartBackoff) reset() {
+	b.failures = 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Job outcomes reported on the results topic.
+const (
+	outcomeSuccess = "success"
+	outcomeFailed  = "failed"
+	outcomeExpired = "expired"
+)
+
+// jobResult is the body of a message published to the results topic.
+type jobResult struct {
+	MessageID   string    `json:"messageId"`
+	RequestID   string    `json:"requestId"`
+	Outcome     string    `json:"outcome"`
+	DurationSec float64   `json:"durationSec"`
+	FinishedAt  time.Time `json:"finishedAt"`
+}
+
+// publishResult reports a job's outcome on the results topic, if one is
+// configured, so downstream consumers can aggregate and track jobs end to
+// end. Failures are logged but never affect the job itself.
+func (h *messageHandler) publishResult(ctx context.Context, msg *pubsub.Message, outcome string, duration time.Duration) {
+	if h.resultsTopic == nil {
+		return
+	}
+	data, err := json.Marshal(jobResult{
+		MessageID:   msg.ID,
+		RequestID:   msg.Attributes[requestIDAttr],
+		Outcome:     outcome,
+		DurationSec: duration.Seconds(),
+		FinishedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Error("Failed to encode job result", "err", err)
+		return
+	}
+	res := h.resultsTopic.Publish(ctx, &pubsub.Message{
+		Data:       data,
+		Attributes: map[string]string{"outcome": outcome, requestIDAttr: msg.Attributes[requestIDAttr]},
+	})
+	if _, err := res.Get(ctx); err != nil {
+		slog.Error("Failed to publish job result", "id", msg.ID, "requestId", msg.Attributes[requestIDAttr], "err", err)
+		h.state.recordError(fmt.Errorf("publish result for message %s: %v", msg.ID, err))
+	}
+}
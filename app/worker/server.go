@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serveMetricsJSON serves the key worker metrics as a flat JSON object, for
+// scripts and dashboards that don't speak the Prometheus format.
+func (s *globalState) serveMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.snapshot()); err != nil {
+		slog.Error("Failed to write /metrics.json response", "err", err)
+	}
+}
+
+// serveJobs serves the jobs in progress, with their request IDs, as JSON.
+func (s *globalState) serveJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.activeJobs()); err != nil {
+		slog.Error("Failed to write /jobs response", "err", err)
+	}
+}
+
+// serveLastError serves the last processing error as JSON, or an empty
+// message if there was none (or it was cleared).
+func (s *globalState) serveLastError(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.currentError()); err != nil {
+		slog.Error("Failed to write /lasterror response", "err", err)
+	}
+}
+
+// listenWithRetry binds addr, retrying with exponential backoff for up to
+// window. During a fast restart the previous pod may still hold the port for
+// a moment, which shouldn't be fatal.
+func listenWithRetry(addr string, window time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(window)
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("Bound metrics port after retrying", "addr", addr, "attempts", attempt)
+			}
+			return ln, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("listen on %s: giving up after %d attempts: %v", addr, attempt, err)
+		}
+		slog.Warn("Could not bind metrics port, retrying", "addr", addr, "attempt", attempt, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// serveHealthz reports that the process is up. It never fails, so the
+// liveness probe doesn't restart a worker that is still starting up.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readiness tracks whether the worker is processing messages.
+type readiness struct {
+	ready atomic.Bool
+}
+
+// serveReadyz returns 503 until the worker starts processing messages, and
+// with STARTUP_CANARY until its canary came back, so a readiness probe keeps
+// a starting pod out of the Service and holds up a broken rollout.
+func (rd *readiness) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if !rd.ready.Load() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
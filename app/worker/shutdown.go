@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// withShutdownGrace returns a context for running jobs that outlives ctx by
+// grace: when ctx is cancelled (SIGTERM), jobs in progress get grace to
+// finish before the returned context is cancelled too and aborts them. Keep
+// grace below the pod's terminationGracePeriodSeconds so the worker exits on
+// its own terms instead of being SIGKILLed.
+func withShutdownGrace(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	workCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-workCtx.Done():
+			return
+		}
+		slog.Info("Shutting down, letting jobs in progress finish.", "grace", grace)
+		t := time.NewTimer(grace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			slog.Warn("Shutdown grace period is over, aborting jobs in progress.")
+			cancel()
+		case <-workCtx.Done():
+		}
+	}()
+	return workCtx, cancel
+}
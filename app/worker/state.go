@@ -0,0 +1,436 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Gauge modes select how messages drive the numJobs gauge.
+const (
+	// gaugeModeSet overwrites the gauge with each message's numJobs value,
+	// i.e. the publisher's view of the queue depth. This is the default.
+	gaugeModeSet = "set"
+	// gaugeModeAdd adds each message's value when the job starts and
+	// subtracts it when the job finishes, so the gauge is a live count of the
+	// work currently held by this pod.
+	gaugeModeAdd = "add"
+)
+
+// globalState protected by a mutex to hold our metric value and timestamp
+type globalState struct {
+	mu            sync.RWMutex
+	lastJobTime   time.Time
+	metricValue   float64
+	metricTimeout time.Duration
+	gaugeMode     string
+	// decayFactor, if set, makes a stale metric decay by this factor per
+	// tick instead of dropping straight to 0.
+	decayFactor float64
+	inFlight    int
+	processed   int64
+	// updates counts calls to updateMetric and addMetric.
+	updates int64
+	// outstanding is the number of messages inside handleMessage, and
+	// peakOutstanding the most there have ever been at once.
+	outstanding     int
+	peakOutstanding int
+	// maxOutstanding is the MaxOutstandingMessages limit. While outstanding
+	// is at it, the client can't pull more: atCapacitySince records when
+	// that started and blocked sums the finished stretches.
+	maxOutstanding  int
+	atCapacitySince time.Time
+	blocked         time.Duration
+	// jobs holds the jobs in progress, keyed by message ID: request IDs
+	// come from the publisher and aren't guaranteed to be unique.
+	jobs map[string]activeJob
+	// replicas turns the metric into the replica count the HPA aims for.
+	replicas replicaTarget
+	// distinct holds the numJobs values seen, up to maxDistinct of them.
+	distinct    map[float64]struct{}
+	maxDistinct int
+	// throughput averages completed messages per minute. Nil disables it.
+	throughput *throughputMeter
+	// lastError is the last processing error, cleared lastErrorTTL after it
+	// happened if that is set.
+	lastError    lastError
+	lastErrorTTL time.Duration
+	// minNumJobs is the floor of the exported gauge. metricValue itself can
+	// go lower, e.g. when reset for staleness.
+	minNumJobs float64
+	// averages holds the recent gauge values for average_num_jobs. Nil
+	// disables it.
+	averages *valueWindow
+	// concurrency averages inFlight over time for effective_concurrency.
+	// Nil disables it.
+	concurrency *concurrencyAverage
+	// outcomes counts succeeded and failed messages for
+	// processing_success_ratio. Nil reports 1.
+	outcomes *outcomeWindow
+	// scaleFactor multiplies the exported numJobs gauge, e.g. 10 to export
+	// tenths. Zero means 1. metricValue and the other gauges stay in jobs.
+	scaleFactor float64
+}
+
+// lastError is a processing error and when it happened, as served by
+// /lasterror. The zero value means no error.
+type lastError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// recordError remembers err as the last processing error.
+func (s *globalState) recordError(err error) {
+	now := time.Now()
+	s.mu.Lock()
+	s.lastError = lastError{Message: err.Error(), Time: now}
+	lastErrorTimestamp.Set(float64(now.Unix()))
+	s.mu.Unlock()
+}
+
+// currentError returns the last processing error, or the zero value if there
+// was none.
+func (s *globalState) currentError() lastError {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastError
+}
+
+// clearOldError forgets the last error once no error happened for
+// lastErrorTTL, so a worker that recovered stops looking broken.
+func (s *globalState) clearOldError(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastErrorTTL <= 0 || s.lastError.Time.IsZero() || now.Sub(s.lastError.Time) < s.lastErrorTTL {
+		return
+	}
+	s.lastError = lastError{}
+	lastErrorTimestamp.Set(0)
+}
+
+// observeNumJobs records a numJobs value from a message. Once maxDistinct
+// values are known, new ones are no longer added, so the gauge saturates
+// instead of the set growing without bound.
+func (s *globalState) observeNumJobs(value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.distinct[value]; ok {
+		return
+	}
+	if s.distinct == nil {
+		s.distinct = map[float64]struct{}{}
+	}
+	if s.maxDistinct > 0 && len(s.distinct) >= s.maxDistinct {
+		return
+	}
+	s.distinct[value] = struct{}{}
+	distinctNumJobs.Set(float64(len(s.distinct)))
+}
+
+// resetDistinct forgets the numJobs values seen so far every interval, so the
+// gauge reflects recent behavior rather than the whole lifetime.
+func (s *globalState) resetDistinct(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		s.distinct = nil
+		distinctNumJobs.Set(0)
+		s.mu.Unlock()
+	}
+}
+
+// replicaTarget mirrors the HPA's scaling math: one replica per jobsPerReplica
+// jobs, clamped to [min, max]. A max of 0 means no upper bound.
+type replicaTarget struct {
+	jobsPerReplica float64
+	min            int
+	max            int
+}
+
+// desired returns the replica count for a metric value.
+func (r replicaTarget) desired(value float64) int {
+	perReplica := r.jobsPerReplica
+	if perReplica <= 0 {
+		perReplica = 1
+	}
+	n := int(math.Ceil(value / perReplica))
+	if n < r.min {
+		n = r.min
+	}
+	if r.max > 0 && n > r.max {
+		n = r.max
+	}
+	return n
+}
+
+// setGauge publishes the metric value and the replica count derived from it,
+// raised to minNumJobs if that is higher. numJobs is exported multiplied by
+// scaleFactor. The caller must hold s.mu.
+func (s *globalState) setGauge(value float64) {
+	value = max(value, s.minNumJobs)
+	exported := value
+	if s.scaleFactor > 0 {
+		exported *= s.scaleFactor
+	}
+	numJobs.Set(exported)
+	now := time.Now()
+	s.averages.record(now, value)
+	averageNumJobs.Set(s.averages.average(now))
+	desiredReplicas.Set(float64(s.replicas.desired(value)))
+}
+
+// activeJob describes a job in progress, as served by /jobs.
+type activeJob struct {
+	RequestID string    `json:"requestId"`
+	MessageID string    `json:"messageId"`
+	NumJobs   float64   `json:"numJobs"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// setMaxOutstanding sets the limit at which the worker counts as blocked by
+// flow control.
+func (s *globalState) setMaxOutstanding(n int) {
+	s.mu.Lock()
+	s.maxOutstanding = n
+	s.mu.Unlock()
+}
+
+// messageStarted records that a message entered handleMessage and updates the
+// peak outstanding count.
+func (s *globalState) messageStarted() {
+	s.mu.Lock()
+	s.outstanding++
+	if s.outstanding > s.peakOutstanding {
+		s.peakOutstanding = s.outstanding
+		peakOutstanding.Set(float64(s.peakOutstanding))
+	}
+	if s.maxOutstanding > 0 && s.outstanding == s.maxOutstanding {
+		s.atCapacitySince = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+// messageFinished records that a message left handleMessage.
+func (s *globalState) messageFinished() {
+	s.mu.Lock()
+	if s.maxOutstanding > 0 && s.outstanding == s.maxOutstanding {
+		d := time.Since(s.atCapacitySince)
+		s.blocked += d
+		flowControlBlocked.Add(d.Seconds())
+	}
+	s.outstanding--
+	s.mu.Unlock()
+}
+
+// jobStarted records that a job began processing.
+func (s *globalState) jobStarted(job activeJob) {
+	s.mu.Lock()
+	if s.jobs == nil {
+		s.jobs = map[string]activeJob{}
+	}
+	s.jobs[job.MessageID] = job
+	s.inFlight++
+	inFlightJobs.Set(float64(s.inFlight))
+	s.observeConcurrency(time.Now())
+	s.mu.Unlock()
+}
+
+// jobFinished records that the job of message messageID is no longer
+// running, whether it completed or was cut short.
+func (s *globalState) jobFinished(messageID string) {
+	s.mu.Lock()
+	delete(s.jobs, messageID)
+	s.inFlight--
+	inFlightJobs.Set(float64(s.inFlight))
+	s.observeConcurrency(time.Now())
+	s.mu.Unlock()
+}
+
+// jobCompleted counts a job that ran to the end in jobs_processed_total and
+// the throughput. Call it after jobFinished, and not for a job aborted by
+// shutdown, which is nacked and processed again elsewhere.
+func (s *globalState) jobCompleted() {
+	s.mu.Lock()
+	s.processed++
+	jobsProcessed.Inc()
+	s.mu.Unlock()
+	s.throughput.record(time.Now())
+	throughputPerMinute.Set(s.throughput.perMinute(time.Now()))
+	s.updateSecondsToDrain(time.Now())
+}
+
+// updateSecondsToDrain sets seconds_to_drain from this pod's share of the
+// work left and its current throughput. numJobs counts the whole queue, so it
+// is split across the replicas the HPA aims for; every replica drains its
+// share in parallel.
+func (s *globalState) updateSecondsToDrain(now time.Time) {
+	s.mu.RLock()
+	share := s.metricValue / float64(max(s.replicas.desired(s.metricValue), 1))
+	remaining := max(share, float64(s.inFlight))
+	s.mu.RUnlock()
+	secondsToDrain.Set(drainEstimate(remaining, s.throughput.perMinute(now)))
+}
+
+// drainEstimate returns how many seconds remaining jobs take at perMinute
+// completions per minute: 0 with nothing left, +Inf with work left but no
+// recent completions.
+func drainEstimate(remaining, perMinute float64) float64 {
+	if remaining <= 0 {
+		return 0
+	}
+	if perMinute <= 0 {
+		return math.Inf(1)
+	}
+	return remaining / perMinute * 60
+}
+
+// recordOutcome counts a message that was processed (success) or failed,
+// and updates processing_success_ratio.
+func (s *globalState) recordOutcome(success bool) {
+	now := time.Now()
+	s.mu.Lock()
+	s.outcomes.record(now, success)
+	processingSuccessRatio.Set(s.outcomes.ratio(now))
+	s.mu.Unlock()
+}
+
+// observeConcurrency feeds the current inFlight count into the moving
+// average and updates effective_concurrency. The caller holds s.mu.
+func (s *globalState) observeConcurrency(now time.Time) {
+	s.concurrency.observe(now, s.inFlight)
+	effectiveConcurrency.Set(s.concurrency.at(now))
+}
+
+// metricsSnapshot holds the key worker metrics, as served by /metrics.json.
+type metricsSnapshot struct {
+	NumJobs        float64 `json:"numJobs"`
+	InFlight       int     `json:"inFlight"`
+	ProcessedTotal int64   `json:"processedTotal"`
+	UpdatesTotal   int64   `json:"updatesTotal"`
+	// FlowControlBlockedSeconds includes the current stretch at capacity.
+	FlowControlBlockedSeconds float64 `json:"flowControlBlockedSeconds"`
+	SecondsSinceLastJob       float64 `json:"secondsSinceLastJob"`
+	ThroughputPerMinute       float64 `json:"throughputPerMinute"`
+	AverageNumJobs            float64 `json:"averageNumJobs"`
+	EffectiveConcurrency      float64 `json:"effectiveConcurrency"`
+	SuccessRatio              float64 `json:"successRatio"`
+}
+
+// snapshot returns a consistent copy of the key metrics.
+func (s *globalState) snapshot() metricsSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blocked := s.blocked
+	if s.maxOutstanding > 0 && s.outstanding == s.maxOutstanding {
+		blocked += time.Since(s.atCapacitySince)
+	}
+	return metricsSnapshot{
+		NumJobs:                   max(s.metricValue, s.minNumJobs),
+		InFlight:                  s.inFlight,
+		ProcessedTotal:            s.processed,
+		UpdatesTotal:              s.updates,
+		FlowControlBlockedSeconds: blocked.Seconds(),
+		SecondsSinceLastJob:       time.Since(s.lastJobTime).Seconds(),
+		ThroughputPerMinute:       s.throughput.perMinute(time.Now()),
+		AverageNumJobs:            s.averages.average(time.Now()),
+		EffectiveConcurrency:      s.concurrency.at(time.Now()),
+		SuccessRatio:              s.outcomes.ratio(time.Now()),
+	}
+}
+
+// activeJobs returns the jobs in progress, oldest first.
+func (s *globalState) activeJobs() []activeJob {
+	s.mu.RLock()
+	jobs := make([]activeJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.Before(jobs[j].StartedAt) })
+	return jobs
+}
+
+// updateMetric safely updates the global state and the Prometheus gauge.
+func (s *globalState) updateMetric(value float64) {
+	s.mu.Lock()
+	s.lastJobTime = time.Now()
+	s.metricValue = value
+	s.updates++
+	numJobsUpdates.Inc()
+	// Set the gauge under the lock so it always matches metricValue.
+	s.setGauge(value)
+	s.mu.Unlock()
+}
+
+// addMetric safely adds delta to the global state and the Prometheus gauge.
+// It is used in "add" gauge mode, where the value tracks in-flight work.
+func (s *globalState) addMetric(delta float64) {
+	s.mu.Lock()
+	s.lastJobTime = time.Now()
+	s.metricValue += delta
+	s.updates++
+	numJobsUpdates.Inc()
+	s.setGauge(s.metricValue)
+	s.mu.Unlock()
+}
+
+// metricUpdater runs in a loop, checking if the last job is stale.
+// If it is, it sets the metric to 0 to allow the HPA to scale down.
+func (s *globalState) metricUpdater() {
+	// Check every 10 seconds
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.resetIfStale(time.Now())
+		s.clearOldError(time.Now())
+		s.mu.RLock()
+		averageNumJobs.Set(s.averages.average(time.Now()))
+		// Between job starts and finishes the average still moves towards
+		// the current count.
+		effectiveConcurrency.Set(s.concurrency.at(time.Now()))
+		// Old outcomes leave the window even when nothing finishes.
+		processingSuccessRatio.Set(s.outcomes.ratio(time.Now()))
+		s.mu.RUnlock()
+		// Recompute between completions so an idle worker decays to 0.
+		throughputPerMinute.Set(s.throughput.perMinute(time.Now()))
+		s.updateSecondsToDrain(time.Now())
+	}
+}
+
+// decaySnapThreshold is the value below which a decaying metric snaps to 0.
+// Less than half a job is no job at all for the HPA's purposes.
+const decaySnapThreshold = 0.5
+
+// resetIfStale sets the metric to 0 if no job arrived within the timeout,
+// or, with a decay factor, multiplies it by that factor until it falls below
+// decaySnapThreshold. Only a transition from a non-zero value to 0 counts as
+// a reset, so an idle worker doesn't bump gauge_resets_total on every tick.
+func (s *globalState) resetIfStale(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// In "add" mode the gauge already returns to 0 as jobs finish, and
+	// resetting it mid-job would drive it negative when the job completes.
+	if s.gaugeMode == gaugeModeAdd {
+		return
+	}
+	if now.Sub(s.lastJobTime) <= s.metricTimeout || s.metricValue == 0 {
+		return
+	}
+	if s.decayFactor > 0 {
+		s.metricValue *= s.decayFactor
+		if s.metricValue >= decaySnapThreshold {
+			slog.Debug("No jobs received in timeout period. Decaying numJobs metric.", "value", s.metricValue)
+			s.setGauge(s.metricValue)
+			return
+		}
+	}
+	slog.Info("No jobs received in timeout period. Setting numJobs metric to 0.")
+	s.metricValue = 0
+	s.setGauge(0)
+	gaugeResets.Inc()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMetrics are the metrics sent to StatsD: numJobs and the core
+// counters and gauges, not everything /metrics has.
+var statsdMetrics = map[string]bool{
+	"numJobs":                            true,
+	"in_flight_jobs":                     true,
+	"desired_replicas":                   true,
+	"jobs_processed_total":               true,
+	"expired_messages_total":             true,
+	"gauge_resets_total":                 true,
+	"invalid_num_jobs_total":             true,
+	"poison_messages_total":              true,
+	"messages_dropped_on_shutdown_total": true,
+}
+
+// statsdMaxPacket keeps each datagram under a typical MTU.
+const statsdMaxPacket = 1400
+
+// statsdExporter sends the metrics in statsdMetrics to a StatsD server. The
+// values are gathered from the same registry /metrics serves, so both always
+// agree. Gauges are sent as they are; counters as the increase since the
+// last flush, which is what StatsD counters expect.
+type statsdExporter struct {
+	gatherer prometheus.Gatherer
+	conn     net.Conn
+	prefix   string
+	// last holds each counter's value at the previous flush.
+	last map[string]float64
+}
+
+func newStatsdExporter(addr, prefix string, gatherer prometheus.Gatherer) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %v", addr, err)
+	}
+	return &statsdExporter{gatherer: gatherer, conn: conn, prefix: prefix, last: map[string]float64{}}, nil
+}
+
+// run flushes every interval. UDP failures are logged and otherwise ignored,
+// so StatsD being down never affects the worker.
+func (e *statsdExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := e.flush(); err != nil {
+			slog.Warn("Failed to send metrics to StatsD", "err", err)
+		}
+	}
+}
+
+// flush sends the current values. Labels, such as CONSTANT_LABELS, become
+// DogStatsD tags.
+func (e *statsdExporter) flush() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather: %v", err)
+	}
+	var lines []string
+	for _, mf := range families {
+		if !statsdMetrics[mf.GetName()] {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			name := e.prefix + mf.GetName()
+			tags := statsdTags(m.GetLabel())
+			switch {
+			case m.Gauge != nil:
+				lines = append(lines, name+":"+formatStatsdValue(m.GetGauge().GetValue())+"|g"+tags)
+			case m.Counter != nil:
+				key := seriesName(mf.GetName(), m.GetLabel())
+				value := m.GetCounter().GetValue()
+				delta := value - e.last[key]
+				e.last[key] = value
+				if delta > 0 {
+					lines = append(lines, name+":"+formatStatsdValue(delta)+"|c"+tags)
+				}
+			}
+		}
+	}
+	return e.send(lines)
+}
+
+// send writes lines in as few datagrams as fit under statsdMaxPacket.
+func (e *statsdExporter) send(lines []string) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			if _, err := e.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(buf.Bytes())
+	return err
+}
+
+// statsdTags formats labels as DogStatsD tags, e.g. "|#env:dev,region:eu".
+func statsdTags(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for _, l := range labels {
+		tags = append(tags, l.GetName()+":"+l.GetValue())
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+func formatStatsdValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// settingsRecord holds every setting read through getEnv with the value in
+// effect, defaults included, for /status.
+type settingsRecord struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// settings records the worker's configuration as it is read.
+var settings = &settingsRecord{}
+
+// record keeps value for key, with any password in a URL, such as
+// DEDUPE_REDIS_ADDR's, masked.
+func (r *settingsRecord) record(key, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values == nil {
+		r.values = map[string]string{}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		value = u.Redacted()
+	}
+	r.values[key] = value
+}
+
+// all returns a copy of the recorded settings.
+func (r *settingsRecord) all() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := make(map[string]string, len(r.values))
+	for k, v := range r.values {
+		values[k] = v
+	}
+	return values
+}
+
+// workerStatus is the combined view served by /status.
+type workerStatus struct {
+	StartedAt time.Time `json:"startedAt"`
+	UptimeSec float64   `json:"uptimeSec"`
+	// Healthy is what /healthz reports, always true while the process
+	// serves requests; Ready is what /readyz reports.
+	Healthy   bool              `json:"healthy"`
+	Ready     bool              `json:"ready"`
+	Paused    bool              `json:"paused"`
+	Metrics   metricsSnapshot   `json:"metrics"`
+	LastError lastError         `json:"lastError"`
+	Config    map[string]string `json:"config"`
+}
+
+// statusServer gathers /status from the sources of the other endpoints.
+type statusServer struct {
+	state     *globalState
+	ready     *readiness
+	pauser    *pauseController
+	startedAt time.Time
+	// lease is the ack extension guidance for /config.
+	lease leaseGuidance
+}
+
+func (st *statusServer) status(now time.Time) workerStatus {
+	return workerStatus{
+		StartedAt: st.startedAt,
+		UptimeSec: now.Sub(st.startedAt).Seconds(),
+		Healthy:   true,
+		Ready:     st.ready.ready.Load(),
+		Paused:    st.pauser.isPaused(),
+		Metrics:   st.state.snapshot(),
+		LastError: st.state.currentError(),
+		Config:    settings.all(),
+	}
+}
+
+// serveStatus serves config, metrics, health, readiness, the last error and
+// uptime as one JSON object, a single place to start debugging a worker.
+func (st *statusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st.status(time.Now())); err != nil {
+		slog.Error("Failed to write /status response", "err", err)
+	}
+}
+
+// workerConfig is served by /config: the settings and whether the lease
+// settings suit the job duration and concurrency.
+type workerConfig struct {
+	Settings      map[string]string `json:"settings"`
+	LeaseGuidance leaseGuidance     `json:"leaseGuidance"`
+}
+
+// serveConfig serves the worker's settings with guidance on safe lease
+// settings, the first thing to check when jobs are redelivered.
+func (st *statusServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(workerConfig{Settings: settings.all(), LeaseGuidance: st.lease}); err != nil {
+		slog.Error("Failed to write /config response", "err", err)
+	}
+}
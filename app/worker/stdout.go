@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricsLine is one line printed by printMetrics.
+type metricsLine struct {
+	Time    time.Time          `json:"ts"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// printMetrics writes the worker's metrics to stdout as one JSON line every
+// interval, for local runs without Prometheus. Values come from the same
+// registry that /metrics serves. The Go runtime and process metrics are left
+// out to keep the output short.
+func printMetrics(gatherer prometheus.Gatherer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	for range ticker.C {
+		families, err := gatherer.Gather()
+		if err != nil {
+			slog.Warn("Failed to gather metrics", "err", err)
+			continue
+		}
+		line := metricsLine{Time: time.Now().UTC(), Metrics: map[string]float64{}}
+		for _, mf := range families {
+			if strings.HasPrefix(mf.GetName(), "go_") || strings.HasPrefix(mf.GetName(), "process_") || strings.HasPrefix(mf.GetName(), "promhttp_") {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				value, ok := metricValue(m)
+				if !ok {
+					continue
+				}
+				line.Metrics[seriesName(mf.GetName(), m.GetLabel())] = value
+			}
+		}
+		if err := enc.Encode(line); err != nil {
+			slog.Warn("Failed to print metrics", "err", err)
+		}
+	}
+}
+
+// metricValue returns the value of a gauge or counter. Histograms and
+// summaries are reported by their sample count.
+func metricValue(m *dto.Metric) (float64, bool) {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue(), true
+	case m.Counter != nil:
+		return m.GetCounter().GetValue(), true
+	case m.Histogram != nil:
+		return float64(m.GetHistogram().GetSampleCount()), true
+	case m.Summary != nil:
+		return float64(m.GetSummary().GetSampleCount()), true
+	}
+	return 0, false
+}
+
+// seriesName formats name and labels like the Prometheus text format, e.g.
+// message_attributes_info{type="batch"}.
+func seriesName(name string, labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"=\""+l.GetValue()+"\"")
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
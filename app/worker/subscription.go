@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// subscriptionExpectations holds the subscription settings the worker was
+// configured to expect. Zero values mean "don't care".
+type subscriptionExpectations struct {
+	ackDeadline         time.Duration
+	filter              string
+	deadLetterTopic     string
+	maxDeliveryAttempts int
+	retryMinBackoff     time.Duration
+	retryMaxBackoff     time.Duration
+	exactlyOnce         bool
+	// expiration is how long the subscription may be inactive before Pub/Sub
+	// deletes it. Negative means never; 0 keeps the GCP default (31 days).
+	expiration time.Duration
+}
+
+// getOrCreateTopic returns the topic, creating it if it doesn't exist and
+// autoCreate is set. Without autoCreate a missing topic is an error, so a
+// typo doesn't silently spawn an orphan topic.
+func getOrCreateTopic(ctx context.Context, client *pubsub.Client, topicID string, autoCreate bool) (*pubsub.Topic, error) {
+	topic := client.Topic(topicID)
+	exists, err := topic.Exists(ctx)
+	recordAdminOp("get_topic", existsResult(exists), err)
+	if isPermissionDenied(err) {
+		slog.Warn("Not allowed to check whether the topic exists, assuming it does.", "topic", topicID, "err", err)
+		return topic, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("check topic %s: %v", topicID, err)
+	}
+	if exists {
+		return topic, nil
+	}
+	if !autoCreate {
+		return nil, fmt.Errorf("topic %s does not exist and AUTO_CREATE=false", topicID)
+	}
+	topic, err = client.CreateTopic(ctx, topicID)
+	recordAdminOp("create_topic", adminCreated, err)
+	if err != nil {
+		return nil, fmt.Errorf("create topic %s: %v", topicID, err)
+	}
+	slog.Info("Topic created.", "topic", topicID)
+	return topic, nil
+}
+
+// isNotFound reports whether err means the resource, such as the
+// subscription being received from, doesn't exist.
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// isPermissionDenied reports whether err means the worker's service account
+// lacks a permission. Checking whether a topic or subscription exists needs
+// pubsub.topics.get or pubsub.subscriptions.get, which roles/pubsub.subscriber
+// and roles/pubsub.publisher don't grant; the worker then assumes it exists,
+// as it does in the lab, and leaves creating it to someone who may.
+func isPermissionDenied(err error) bool {
+	return status.Code(err) == codes.PermissionDenied
+}
+
+// getOrCreateSubscription returns the subscription, creating it on topicID
+// if it doesn't exist and autoCreate is set. A new subscription gets the
+// expected ack deadline, filter, exactly-once setting and expiration policy.
+func getOrCreateSubscription(ctx context.Context, client *pubsub.Client, subID, topicID string, autoCreate bool, want subscriptionExpectations) (*pubsub.Subscription, error) {
+	sub := client.Subscription(subID)
+	exists, err := sub.Exists(ctx)
+	recordAdminOp("get_subscription", existsResult(exists), err)
+	if isPermissionDenied(err) {
+		slog.Warn("Not allowed to check whether the subscription exists, assuming it does.", "subscription", subID, "err", err)
+		return sub, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("check subscription %s: %v", subID, err)
+	}
+	if exists {
+		return sub, nil
+	}
+	if !autoCreate {
+		return nil, fmt.Errorf("subscription %s does not exist and AUTO_CREATE=false", subID)
+	}
+	if topicID == "" {
+		return nil, fmt.Errorf("subscription %s does not exist and TOPIC_ID is not set to create it", subID)
+	}
+	topic, err := getOrCreateTopic(ctx, client, topicID, autoCreate)
+	if err != nil {
+		return nil, err
+	}
+	cfg := pubsub.SubscriptionConfig{
+		Topic:                     topic,
+		AckDeadline:               want.ackDeadline,
+		Filter:                    want.filter,
+		EnableExactlyOnceDelivery: want.exactlyOnce,
+	}
+	// An expiration policy of 0 means the subscription never expires.
+	switch {
+	case want.expiration > 0:
+		cfg.ExpirationPolicy = want.expiration
+	case want.expiration < 0:
+		cfg.ExpirationPolicy = time.Duration(0)
+	}
+	sub, err = client.CreateSubscription(ctx, subID, cfg)
+	recordAdminOp("create_subscription", adminCreated, err)
+	if err != nil {
+		return nil, fmt.Errorf("create subscription %s: %v", subID, err)
+	}
+	slog.Info("Subscription created.", "subscription", subID, "topic", topicID)
+	return sub, nil
+}
+
+// Bounds the client accepts for ReceiveSettings.MinExtensionPeriod.
+const (
+	minLeaseExtension = 10 * time.Second
+	maxLeaseExtension = 600 * time.Second
+)
+
+// leaseExtensionPeriod returns the minimum ack deadline extension for jobs of
+// jobDuration, so that a single extension covers the whole job plus margin.
+// The client only renews a lease a few seconds before it expires, so without
+// the margin a job that runs slightly long races the renewal and may be
+// redelivered. A margin of 0 keeps the client's default (0), which sizes
+// extensions from observed ack latency.
+func leaseExtensionPeriod(jobDuration, margin time.Duration) time.Duration {
+	if margin <= 0 {
+		return 0
+	}
+	period := jobDuration + margin
+	if period < minLeaseExtension {
+		return minLeaseExtension
+	}
+	if period > maxLeaseExtension {
+		return maxLeaseExtension
+	}
+	return period
+}
+
+// loadSubscriptionExpectations reads the expected subscription settings from
+// the environment.
+func loadSubscriptionExpectations() subscriptionExpectations {
+	ackDeadlineSec, _ := strconv.Atoi(getEnv("SUB_ACK_DEADLINE_SEC", "0"))
+	maxDeliveryAttempts, _ := strconv.Atoi(getEnv("SUB_MAX_DELIVERY_ATTEMPTS", "0"))
+	retryMinBackoffSec, _ := strconv.Atoi(getEnv("SUB_RETRY_MIN_BACKOFF_SEC", "0"))
+	retryMaxBackoffSec, _ := strconv.Atoi(getEnv("SUB_RETRY_MAX_BACKOFF_SEC", "0"))
+	exactlyOnce, _ := strconv.ParseBool(getEnv("EXACTLY_ONCE", "false"))
+	expirationSec, _ := strconv.Atoi(getEnv("SUB_EXPIRATION_SEC", "0"))
+	return subscriptionExpectations{
+		ackDeadline:         time.Duration(ackDeadlineSec) * time.Second,
+		filter:              getEnv("SUB_FILTER", ""),
+		deadLetterTopic:     getEnv("SUB_DEAD_LETTER_TOPIC", ""),
+		maxDeliveryAttempts: maxDeliveryAttempts,
+		retryMinBackoff:     time.Duration(retryMinBackoffSec) * time.Second,
+		retryMaxBackoff:     time.Duration(retryMaxBackoffSec) * time.Second,
+		exactlyOnce:         exactlyOnce,
+		expiration:          time.Duration(expirationSec) * time.Second,
+	}
+}
+
+// checkSubscriptionConfig fetches the subscription's actual config and
+// returns a description of every setting that differs from what we expect.
+// Some settings (like the filter) are immutable, so drift here usually means
+// the env was changed but the subscription was never recreated.
+func checkSubscriptionConfig(ctx context.Context, sub *pubsub.Subscription, want subscriptionExpectations) ([]string, error) {
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Config: %v", err)
+	}
+	return diffSubscriptionConfig(want, cfg), nil
+}
+
+// diffSubscriptionConfig compares the expected settings against cfg.
+func diffSubscriptionConfig(want subscriptionExpectations, cfg pubsub.SubscriptionConfig) []string {
+	var mismatches []string
+
+	if want.ackDeadline > 0 && cfg.AckDeadline != want.ackDeadline {
+		mismatches = append(mismatches, fmt.Sprintf("ack deadline is %v, expected %v", cfg.AckDeadline, want.ackDeadline))
+	}
+	if want.filter != "" && cfg.Filter != want.filter {
+		mismatches = append(mismatches, fmt.Sprintf("filter is %q, expected %q (filters are immutable, recreate the subscription)", cfg.Filter, want.filter))
+	}
+
+	var dlqTopic string
+	var maxAttempts int
+	if cfg.DeadLetterPolicy != nil {
+		dlqTopic = cfg.DeadLetterPolicy.DeadLetterTopic
+		maxAttempts = cfg.DeadLetterPolicy.MaxDeliveryAttempts
+	}
+	if want.deadLetterTopic != "" && !sameTopic(dlqTopic, want.deadLetterTopic) {
+		mismatches = append(mismatches, fmt.Sprintf("dead-letter topic is %q, expected %q", dlqTopic, want.deadLetterTopic))
+	}
+	if want.maxDeliveryAttempts > 0 && maxAttempts != want.maxDeliveryAttempts {
+		mismatches = append(mismatches, fmt.Sprintf("max delivery attempts is %d, expected %d", maxAttempts, want.maxDeliveryAttempts))
+	}
+
+	var minBackoff, maxBackoff time.Duration
+	if cfg.RetryPolicy != nil {
+		minBackoff, _ = cfg.RetryPolicy.MinimumBackoff.(time.Duration)
+		maxBackoff, _ = cfg.RetryPolicy.MaximumBackoff.(time.Duration)
+	}
+	if want.retryMinBackoff > 0 && minBackoff != want.retryMinBackoff {
+		mismatches = append(mismatches, fmt.Sprintf("retry minimum backoff is %v, expected %v", minBackoff, want.retryMinBackoff))
+	}
+	if want.retryMaxBackoff > 0 && maxBackoff != want.retryMaxBackoff {
+		mismatches = append(mismatches, fmt.Sprintf("retry maximum backoff is %v, expected %v", maxBackoff, want.retryMaxBackoff))
+	}
+
+	if want.expiration != 0 {
+		got, _ := cfg.ExpirationPolicy.(time.Duration)
+		if wantTTL := max(want.expiration, 0); got != wantTTL {
+			mismatches = append(mismatches, fmt.Sprintf("expiration policy is %s, expected %s", describeExpiration(got), describeExpiration(wantTTL)))
+		}
+	}
+
+	// Confirmed acks are pointless without exactly-once delivery, and
+	// without them an exactly-once subscription redelivers silently.
+	if want.exactlyOnce != cfg.EnableExactlyOnceDelivery {
+		mismatches = append(mismatches, fmt.Sprintf("exactly-once delivery is %v, expected %v", cfg.EnableExactlyOnceDelivery, want.exactlyOnce))
+	}
+
+	return mismatches
+}
+
+// describeExpiration describes an expiration policy TTL, where 0 means the
+// subscription never expires.
+func describeExpiration(ttl time.Duration) string {
+	if ttl == 0 {
+		return "never"
+	}
+	return ttl.String()
+}
+
+// sameTopic reports whether the fully qualified topic name refers to want,
+// which may be either a full name or a bare topic ID.
+func sameTopic(name, want string) bool {
+	if strings.Contains(want, "/") {
+		return name == want
+	}
+	return strings.HasSuffix(name, "/topics/"+want)
+}
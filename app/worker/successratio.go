@@ -0,0 +1,59 @@
+package main
+
+import "time"
+
+// outcomeBuckets is how many slices an outcomeWindow divides its window
+// into. The window slides one slice at a time.
+const outcomeBuckets = 60
+
+// outcomeWindow counts succeeded and failed messages in time slices covering
+// the window, for processing_success_ratio. It is guarded by globalState.mu.
+type outcomeWindow struct {
+	width   time.Duration // of one slice
+	buckets [outcomeBuckets]struct {
+		slot              int64 // slice number the counts belong to
+		succeeded, failed int64
+	}
+}
+
+func newOutcomeWindow(window time.Duration) *outcomeWindow {
+	return &outcomeWindow{width: max(window/outcomeBuckets, time.Millisecond)}
+}
+
+// record counts one outcome at t.
+func (w *outcomeWindow) record(t time.Time, success bool) {
+	if w == nil {
+		return
+	}
+	slot := t.UnixNano() / int64(w.width)
+	b := &w.buckets[slot%outcomeBuckets]
+	// The slice last held counts from an earlier pass around the ring.
+	if b.slot != slot {
+		b.slot, b.succeeded, b.failed = slot, 0, 0
+	}
+	if success {
+		b.succeeded++
+	} else {
+		b.failed++
+	}
+}
+
+// ratio returns succeeded/(succeeded+failed) within the window ending at now,
+// or 1 if nothing finished in it: no failures counts as healthy.
+func (w *outcomeWindow) ratio(now time.Time) float64 {
+	if w == nil {
+		return 1
+	}
+	current := now.UnixNano() / int64(w.width)
+	var succeeded, failed int64
+	for _, b := range w.buckets {
+		if b.slot > current-outcomeBuckets && b.slot <= current {
+			succeeded += b.succeeded
+			failed += b.failed
+		}
+	}
+	if succeeded+failed == 0 {
+		return 1
+	}
+	return float64(succeeded) / float64(succeeded+failed)
+}
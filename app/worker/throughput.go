@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// throughputSamples is how many completion times a throughputMeter keeps.
+// Beyond that the oldest are overwritten and the rate is computed over the
+// shorter span the buffer still covers.
+const throughputSamples = 4096
+
+// throughputMeter computes a moving average of completed messages per
+// minute from a ring buffer of completion times.
+type throughputMeter struct {
+	mu     sync.Mutex
+	window time.Duration
+	times  [throughputSamples]time.Time
+	next   int // index the next completion is written to
+	count  int // number of valid entries, at most throughputSamples
+}
+
+func newThroughputMeter(window time.Duration) *throughputMeter {
+	return &throughputMeter{window: window}
+}
+
+// record adds a completion at t.
+func (m *throughputMeter) record(t time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.times[m.next] = t
+	m.next = (m.next + 1) % throughputSamples
+	if m.count < throughputSamples {
+		m.count++
+	}
+	m.mu.Unlock()
+}
+
+// perMinute returns the completions per minute over the window ending at
+// now. It falls to 0 once no message completed for a whole window.
+func (m *throughputMeter) perMinute(now time.Time) float64 {
+	if m == nil || m.window <= 0 {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since := now.Add(-m.window)
+	span := m.window
+	n := 0
+	// Walk back from the newest entry until one falls outside the window.
+	for i := 1; i <= m.count; i++ {
+		t := m.times[(m.next-i+throughputSamples)%throughputSamples]
+		if !t.After(since) {
+			break
+		}
+		n++
+	}
+	// The whole buffer is inside the window: older completions were
+	// overwritten, so only the span it covers can be counted.
+	if n == throughputSamples {
+		span = now.Sub(m.times[m.next])
+		if span <= 0 {
+			return 0
+		}
+	}
+	return float64(n) / span.Minutes()
+}
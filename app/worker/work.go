@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// workFunc runs one job for duration and returns early if ctx is cancelled.
+type workFunc func(ctx context.Context, duration time.Duration)
+
+// workFuncs returns the simulated workloads WORK_FUNC selects from. Those
+// that need randomness draw it from rng, so RANDOM_SEED covers them too. To
+// add one, write a workFunc and register it here.
+func workFuncs(rng *randSource) map[string]workFunc {
+	return map[string]workFunc{
+		"simulate": simulateWork,
+		"sleep":    sleepWork,
+		"cpu":      cpuWork,
+		"fib":      fibWork,
+		"sort": func(ctx context.Context, duration time.Duration) {
+			sortWork(ctx, duration, rng)
+		},
+	}
+}
+
+// lookupWorkFunc returns the work function registered as name.
+func lookupWorkFunc(name string, rng *randSource) (workFunc, error) {
+	return lookupNamed(workFuncs(rng), "work function", name)
+}
+
+// lookupNamed returns the entry registered as name in registry, or an error
+// listing the valid names. kind describes the entries in the error.
+func lookupNamed[T any](registry map[string]T, kind, name string) (T, error) {
+	if v, ok := registry[name]; ok {
+		return v, nil
+	}
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var zero T
+	return zero, fmt.Errorf("unknown %s %q (want one of %s)", kind, name, strings.Join(names, ", "))
+}
+
+// simulateWork performs a task that takes time but is not 100% CPU-bound.
+// This is key to showing why CPU scaling is not effective. It stops early
+// if ctx is cancelled.
+func simulateWork(ctx context.Context, duration time.Duration) {
+	startTime := time.Now()
+	for time.Since(startTime) < duration && ctx.Err() == nil {
+		// Perform some trivial calculations to generate a *little* CPU load
+		for i := 0; i < 1000000; i++ {
+			_ = math.Sqrt(float64(i))
+		}
+		// Sleep to stretch the job's duration without maxing out the CPU
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sleepWork uses no CPU at all, like a job waiting on an external service.
+func sleepWork(ctx context.Context, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// cpuWork keeps one core busy for the whole job, the case where CPU-based
+// scaling does work.
+func cpuWork(ctx context.Context, duration time.Duration) {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		for i := 0; i < 1000000; i++ {
+			_ = math.Sqrt(float64(i))
+		}
+	}
+}
+
+// fibWork computes Fibonacci numbers recursively, a CPU-bound workload
+// dominated by function calls rather than arithmetic.
+func fibWork(ctx context.Context, duration time.Duration) {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		_ = fib(25)
+	}
+}
+
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+
+// sortWork repeatedly sorts a slice of random numbers, a CPU-bound workload
+// that also allocates, so it shows up in job_allocated_bytes. Each job seeds
+// its own generator from rng, so concurrent jobs don't contend for it.
+func sortWork(ctx context.Context, duration time.Duration, rng *randSource) {
+	deadline := time.Now().Add(duration)
+	r := rand.New(rand.NewSource(rng.Int63()))
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		values := make([]float64, 100000)
+		for i := range values {
+			values[i] = r.Float64()
+		}
+		sort.Float64s(values)
+	}
+}